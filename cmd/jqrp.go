@@ -25,26 +25,89 @@ func main() {
 	}
 
 	config := proxy.NewConfig()
-	evaluator, err := config.Evaluator()
+	if err := config.LoadRoutes(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load routes: %s\n", err)
+		os.Exit(1)
+	}
+	components, err := config.Build()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to allocate compiler")
+		fmt.Fprintf(os.Stderr, "Failed to allocate evaluator: %s\n", err)
+		os.Exit(1)
+	}
+	if config.AdminPort > 0 && config.AdminToken == "" {
+		fmt.Fprintln(os.Stderr, "ADMIN_TOKEN must be set to enable the admin API")
 		os.Exit(1)
 	}
 	logger := config.Logger()
-	frontend := proxy.NewProxy(url, config.Transport(), evaluator, logger)
+	if err := config.WarmQueryCache(components.QueryCache, logger); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to warm query cache: %s\n", err)
+		os.Exit(1)
+	}
+	go config.DumpQueryCache(components.QueryCache, nil, logger)
+	frontend, err := proxy.NewProxyWithOptions(url, config.Transport(), components.Evaluator, config.ProxyOptions(components), logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create proxy: %s\n", err)
+		os.Exit(1)
+	}
 
 	logger.Debug(fmt.Sprintf("URL: %s", url))
 	logger.Debug(fmt.Sprintf("Port: %d", config.Port))
 	logger.Debug(fmt.Sprintf("Query evaluation timeout: %s", config.EvaluationTimeout))
 	logger.Debug(fmt.Sprintf("Query cache size: %d", config.CacheSize))
+	logger.Debug(fmt.Sprintf("Query cache maximum bytes: %d", config.CacheMaxBytes))
+	logger.Debug(fmt.Sprintf("Query cache TTL: %s", config.CacheTTL))
+	logger.Debug(fmt.Sprintf("Query cache idle TTL: %s", config.CacheIdleTTL))
+	logger.Debug(fmt.Sprintf("Query file: %s", config.QueryFile))
+	logger.Debug(fmt.Sprintf("Query dump file: %s", config.QueryDumpFile))
+	logger.Debug(fmt.Sprintf("Query dump interval: %s", config.QueryDumpInterval))
+	logger.Debug(fmt.Sprintf("Compile error cache size: %d", config.ErrorCacheSize))
+	logger.Debug(fmt.Sprintf("Compile error cache TTL: %s", config.ErrorCacheTTL))
+	logger.Debug(fmt.Sprintf("Response cache size: %d", config.ResponseCacheSize))
+	logger.Debug(fmt.Sprintf("Response cache TTL: %s", config.ResponseCacheTTL))
+	logger.Debug(fmt.Sprintf("Result cache size: %d", config.ResultCacheSize))
+	logger.Debug(fmt.Sprintf("Result cache TTL: %s", config.ResultCacheTTL))
+	logger.Debug(fmt.Sprintf("Coalesce requests: %t", config.CoalesceRequests))
+	logger.Debug(fmt.Sprintf("Coalesce buffer size: %d", config.CoalesceBufferSize))
+	logger.Debug(fmt.Sprintf("Maximum concurrent evaluations: %d", config.MaxEvaluations))
+	logger.Debug(fmt.Sprintf("Evaluation queue size: %d", config.EvaluationQueue))
+	logger.Debug(fmt.Sprintf("Evaluation queue timeout: %s", config.QueueTimeout))
+	logger.Debug(fmt.Sprintf("Retry after: %s", config.RetryAfter))
+	logger.Debug(fmt.Sprintf("Rate limit key: %s", config.RateLimitKey))
+	logger.Debug(fmt.Sprintf("Rate limit requests per minute: %d", config.RateLimitRequests))
+	logger.Debug(fmt.Sprintf("Rate limit evaluation time per minute: %d", config.RateLimitEvalTime))
+	logger.Debug(fmt.Sprintf("Trusted proxies: %s", config.TrustedProxies))
+	logger.Debug(fmt.Sprintf("JWT verified in front: %t", config.JWTVerified))
+	logger.Debug(fmt.Sprintf("Query statistics size: %d", config.QueryStatsSize))
+	logger.Debug(fmt.Sprintf("Slow query threshold: %s", config.SlowQueryThreshold))
+	logger.Debug(fmt.Sprintf("Slow query log: %s", config.SlowQueryLogFile))
+	logger.Debug(fmt.Sprintf("Admin port: %d", config.AdminPort))
 	logger.Debug(fmt.Sprintf("Frontend read timeout: %s", config.ReadTimeout))
 	logger.Debug(fmt.Sprintf("Frontend write timeout: %s", config.WriteTimeout))
 	logger.Debug(fmt.Sprintf("Backend TCP dial timeout: %s", config.DialTimeout))
 	logger.Debug(fmt.Sprintf("Backend TLS handshake timout: %s", config.TLSHandshakeTimeout))
 	logger.Debug(fmt.Sprintf("Backend response header timeout: %s", config.ResponseHeaderTimeout))
 	logger.Debug(fmt.Sprintf("Backend 100-continue timeout: %s", config.ExpectContinueTimeout))
+	logger.Debug(fmt.Sprintf("Empty result: %s", config.EmptyResult))
+	logger.Debug(fmt.Sprintf("Transformed error status codes: %s", config.TransformStatus))
+	logger.Debug(fmt.Sprintf("Success status: %s", config.SuccessStatus))
+	logger.Debug(fmt.Sprintf("User error status codes: %s", config.UserErrorStatus))
+	logger.Debug(fmt.Sprintf("Maximum upstream body size: %d", config.MaxBodySize))
+	logger.Debug(fmt.Sprintf("Maximum output size: %d", config.MaxOutputSize))
+	logger.Debug(fmt.Sprintf("Maximum result count: %d", config.MaxResults))
+	logger.Debug(fmt.Sprintf("Maximum query length: %d", config.MaxQueryLength))
+	logger.Debug(fmt.Sprintf("Routes: %d", len(config.Routes)))
 	logger.Debug(fmt.Sprintf("Log level: %s", logger.Level))
 
+	if config.AdminPort > 0 {
+		admin := &http.Server{
+			Addr:    fmt.Sprintf(":%d", config.AdminPort),
+			Handler: proxy.NewAdmin(config, components, logger),
+		}
+		go func() {
+			logger.Error(admin.ListenAndServe().Error())
+		}()
+	}
+
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", config.Port),
 		Handler:      frontend,
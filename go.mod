@@ -6,4 +6,5 @@ require (
 	github.com/google/uuid v1.2.0
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/itchyny/gojq v0.12.1
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
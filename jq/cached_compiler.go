@@ -3,37 +3,177 @@ package jq
 import (
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/itchyny/gojq"
+	"sync"
+	"time"
 )
 
-// CachedCompiler wraps a compiler with an LRU cache.
+// CachedCompiler wraps a compiler with an LRU cache. Compile errors are cached
+// too, in a separate cache whose entries expire. Queries are cached under
+// their normalized spelling, and concurrent compilations of the same query
+// are deduplicated.
 type CachedCompiler struct {
 	compiler Compiler
-	cache    *lru.Cache
+	cache    *queryCache
+	errors   *lru.Cache
+	options  CacheOptions
+
+	mu        sync.Mutex
+	compiling map[string]*compilation
+}
+
+// CacheOptions configure the limits of the cache, and the caching of compile
+// errors.
+type CacheOptions struct {
+	// MaxBytes is the maximum estimated size of all cached queries in bytes,
+	// which is estimated from their length. Setting it to 0 disables the
+	// limit.
+	MaxBytes int64
+
+	// TTL is how long queries are cached after they were compiled. Setting it
+	// to 0 caches them until evicted.
+	TTL time.Duration
+
+	// IdleTTL is how long queries are cached after they were last used.
+	// Setting it to 0 caches them until evicted.
+	IdleTTL time.Duration
+
+	// ErrorSize is the number of compile errors cached. Setting the size to 0
+	// disables caching of compile errors.
+	ErrorSize int
+
+	// ErrorTTL is how long compile errors are cached. Setting it to 0 caches
+	// them until evicted.
+	ErrorTTL time.Duration
+}
+
+// DefaultCacheOptions are the options of compilers returned by
+// NewCachedCompiler.
+var DefaultCacheOptions = CacheOptions{ErrorSize: 128, ErrorTTL: time.Minute}
+
+type cachedError struct {
+	err     error
+	expires time.Time
+}
+
+// compilation is a compilation in progress.
+type compilation struct {
+	done chan struct{}
+	code *gojq.Code
+	err  error
 }
 
 // NewCachedCompiler returns a new LRU-caching compiler of given cache size.
 func NewCachedCompiler(compiler Compiler, size int) (*CachedCompiler, error) {
-	lruCache, err := lru.New(size)
+	return NewCachedCompilerWithOptions(compiler, size, DefaultCacheOptions)
+}
+
+// NewCachedCompilerWithOptions returns a new LRU-caching compiler of given
+// cache size, limiting the cache and caching compile errors as options
+// configure.
+func NewCachedCompilerWithOptions(compiler Compiler, size int, options CacheOptions) (*CachedCompiler, error) {
+	cache, err := newQueryCache(size, options)
 	if err != nil {
 		return nil, err
 	}
-	return &CachedCompiler{
-		compiler: compiler,
-		cache:    lruCache,
-	}, nil
+	cachedCompiler := &CachedCompiler{
+		compiler:  compiler,
+		cache:     cache,
+		options:   options,
+		compiling: map[string]*compilation{},
+	}
+	if options.ErrorSize > 0 {
+		if cachedCompiler.errors, err = lru.New(options.ErrorSize); err != nil {
+			return nil, err
+		}
+	}
+	return cachedCompiler, nil
 }
 
 // Compiler looks up the rawQuery in the cache. If found, it returns the
-// precompiled query. Otherwise, it compiles rawQuery, and caches the result.
+// precompiled query, or the compile error. Otherwise, it compiles rawQuery,
+// unless it is being compiled already, and caches the result.
 func (c *CachedCompiler) Compiler(rawQuery string) (*gojq.Code, error) {
-	code, found := c.cache.Get(rawQuery)
-	if found {
-		return code.(*gojq.Code), nil
+	key := NormalizeQuery(rawQuery)
+	if code, found := c.cache.get(key); found {
+		return code, nil
 	}
-	code, err := c.compiler(rawQuery)
-	if err != nil {
+	if err := c.cachedError(key); err != nil {
 		return nil, err
 	}
-	c.cache.Add(rawQuery, code)
-	return code.(*gojq.Code), nil
+
+	c.mu.Lock()
+	if pending, ok := c.compiling[key]; ok {
+		c.mu.Unlock()
+		<-pending.done
+		return pending.code, pending.err
+	}
+	pending := &compilation{done: make(chan struct{})}
+	c.compiling[key] = pending
+	c.mu.Unlock()
+
+	pending.code, pending.err = c.compiler(rawQuery)
+	if pending.err != nil {
+		c.cacheError(key, pending.err)
+	} else {
+		c.cache.add(key, pending.code)
+	}
+
+	c.mu.Lock()
+	delete(c.compiling, key)
+	c.mu.Unlock()
+	close(pending.done)
+	return pending.code, pending.err
+}
+
+// Snapshot returns the cached queries, along with their usage.
+func (c *CachedCompiler) Snapshot() CacheSnapshot {
+	return c.cache.snapshot()
+}
+
+// Purge removes rawQuery and its compile error from the cache, and reports
+// whether it was cached.
+func (c *CachedCompiler) Purge(rawQuery string) bool {
+	key := NormalizeQuery(rawQuery)
+	purged := c.cache.delete(key)
+	if c.errors != nil && c.errors.Remove(key) {
+		purged = true
+	}
+	return purged
+}
+
+// PurgeAll removes all queries and compile errors from the cache, and returns
+// the number of queries removed.
+func (c *CachedCompiler) PurgeAll() int {
+	if c.errors != nil {
+		c.errors.Purge()
+	}
+	return c.cache.purge()
+}
+
+// cachedError returns the cached compile error of the query, if any.
+func (c *CachedCompiler) cachedError(key string) error {
+	if c.errors == nil {
+		return nil
+	}
+	value, found := c.errors.Get(key)
+	if !found {
+		return nil
+	}
+	cached := value.(*cachedError)
+	if !cached.expires.IsZero() && !time.Now().Before(cached.expires) {
+		c.errors.Remove(key)
+		return nil
+	}
+	return cached.err
+}
+
+func (c *CachedCompiler) cacheError(key string, err error) {
+	if c.errors == nil {
+		return
+	}
+	cached := &cachedError{err: err}
+	if c.options.ErrorTTL > 0 {
+		cached.expires = time.Now().Add(c.options.ErrorTTL)
+	}
+	c.errors.Add(key, cached)
 }
@@ -2,7 +2,10 @@ package jq
 
 import (
 	"github.com/itchyny/gojq"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type mockCompiler struct {
@@ -94,7 +97,95 @@ func TestCachedCompilerInvalidQuery(t *testing.T) {
 	if code != nil {
 		t.Fatal("Compilation succeeded")
 	}
+	if compiler.Calls != 1 {
+		t.Fatal("Invalid query not cached")
+	}
+}
+
+func TestCachedCompilerInvalidQueryExpiry(t *testing.T) {
+	compiler := mockCompiler{}
+	options := CacheOptions{ErrorSize: 1, ErrorTTL: time.Millisecond}
+	cachedCompiler, _ := NewCachedCompilerWithOptions(compiler.Compiler, 1, options)
+	cachedCompiler.Compiler("!")
+	time.Sleep(2 * time.Millisecond)
+	if _, err := cachedCompiler.Compiler("!"); err == nil {
+		t.Fatal("Compilation succeeded")
+	}
 	if compiler.Calls != 2 {
-		t.Fatal("Cached invalid query")
+		t.Fatal("Expired invalid query cached")
+	}
+
+	cachedCompiler, _ = NewCachedCompilerWithOptions(compiler.Compiler, 1, CacheOptions{})
+	cachedCompiler.Compiler("!")
+	cachedCompiler.Compiler("!")
+	if compiler.Calls != 4 {
+		t.Fatal("Invalid query cached")
+	}
+}
+
+func TestCachedCompilerNormalizedQuery(t *testing.T) {
+	compiler := mockCompiler{}
+	cachedCompiler, _ := NewCachedCompiler(compiler.Compiler, 2)
+	for _, rawQuery := range []string{".a | .b", " .a|.b # comment", ".a |\n.b"} {
+		if _, err := cachedCompiler.Compiler(rawQuery); err != nil {
+			t.Fatalf("Compilation failed: %s", err)
+		}
+	}
+	if compiler.Calls != 2 {
+		t.Fatalf("Unexpected compiler calls %d", compiler.Calls)
+	}
+}
+
+func TestCachedCompilerConcurrentCompilation(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	compiler := func(rawQuery string) (*gojq.Code, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return QueryCompiler(rawQuery)
+	}
+	cachedCompiler, _ := NewCachedCompiler(compiler, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code, err := cachedCompiler.Compiler("."); err != nil || code == nil {
+				t.Errorf("Compilation failed")
+			}
+		}()
+	}
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("Unexpected compiler calls %d", calls)
+	}
+}
+
+func TestCachedCompilerPurge(t *testing.T) {
+	compiler := mockCompiler{}
+	cachedCompiler, _ := NewCachedCompiler(compiler.Compiler, 8)
+	for _, query := range []string{".a", ".b", ".c |"} {
+		cachedCompiler.Compiler(query)
+	}
+	if !cachedCompiler.Purge(".a  ") {
+		t.Errorf("Cached query not purged")
+	}
+	if !cachedCompiler.Purge(".c |") {
+		t.Errorf("Cached compile error not purged")
+	}
+	if cachedCompiler.Purge(".d") {
+		t.Errorf("Uncached query purged")
+	}
+	if purged := cachedCompiler.PurgeAll(); purged != 1 {
+		t.Errorf("Expected 1 query purged, got %d", purged)
+	}
+	cachedCompiler.Compiler(".b")
+	if compiler.Calls != 4 {
+		t.Errorf("Expected 4 compilations, got %d", compiler.Calls)
 	}
 }
@@ -0,0 +1,174 @@
+package jq
+
+import (
+	"context"
+	"encoding/json"
+	lru "github.com/hashicorp/golang-lru"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// CachedEvaluator wraps an evaluator with an LRU cache of query results. Only
+// evaluations under a context carrying a CacheKey are cached.
+type CachedEvaluator struct {
+	evaluator Evaluator
+	cache     *lru.Cache
+	ttl       time.Duration
+	hits      uint64
+	misses    uint64
+}
+
+// CacheKey identifies the input of an evaluation to a CachedEvaluator.
+type CacheKey struct {
+	// Input identifies the input, e.g. by a hash of the document it was
+	// decoded from.
+	Input string
+
+	// Annotation is cached along with the results, e.g. the key order of the
+	// objects among them.
+	Annotation interface{}
+
+	// Copy, if set, returns deep copies of results and their annotation.
+	// Results are copied when cached and on each cache hit, so that they are
+	// not shared between evaluations, and do not keep the rest of the input
+	// they were evaluated on alive.
+	Copy func(results []interface{}, annotation interface{}) ([]interface{}, interface{})
+
+	// Hit, if set, is called with the cached annotation on cache hits.
+	Hit func(annotation interface{})
+}
+
+// copy returns copies of results and annotation, if the key copies them.
+func (k CacheKey) copy(results []interface{}, annotation interface{}) ([]interface{}, interface{}) {
+	if k.Copy == nil {
+		return results, annotation
+	}
+	return k.Copy(results, annotation)
+}
+
+// CacheStats counts the cache hits and misses of a CachedEvaluator.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+type cachedResults struct {
+	results    []interface{}
+	annotation interface{}
+	expires    time.Time
+}
+
+type cacheKeyContextKey struct{}
+
+// WithCacheKey returns a context under which evaluations are cached by a
+// CachedEvaluator under key.
+func WithCacheKey(ctx context.Context, key CacheKey) context.Context {
+	return context.WithValue(ctx, cacheKeyContextKey{}, key)
+}
+
+// NewCachedEvaluator returns a new evaluator caching up to size results, each
+// for at most ttl, unless ttl is 0.
+func NewCachedEvaluator(evaluator Evaluator, size int, ttl time.Duration) (*CachedEvaluator, error) {
+	lruCache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &CachedEvaluator{
+		evaluator: evaluator,
+		cache:     lruCache,
+		ttl:       ttl,
+	}, nil
+}
+
+// Evaluate evaluates a raw query without caching, as there is no cache key.
+func (e *CachedEvaluator) Evaluate(rawQuery string, input interface{}) ([]interface{}, error) {
+	return e.evaluator.Evaluate(rawQuery, input)
+}
+
+// Stream returns the cached results of the query, if ctx carries a cache key.
+// Otherwise, it evaluates the query, and caches the results once all were
+// produced without error.
+func (e *CachedEvaluator) Stream(ctx context.Context, rawQuery string, input interface{}) (Iterator, error) {
+	cacheKey, ok := ctx.Value(cacheKeyContextKey{}).(CacheKey)
+	if _, withInputs := inputsFromContext(ctx); !ok || withInputs {
+		return Stream(ctx, e.evaluator, rawQuery, input)
+	}
+
+	key := resultsKey(ctx, NormalizeQuery(rawQuery), cacheKey.Input)
+	if value, found := e.cache.Get(key); found {
+		cached := value.(*cachedResults)
+		if cached.expires.IsZero() || time.Now().Before(cached.expires) {
+			atomic.AddUint64(&e.hits, 1)
+			results, annotation := cacheKey.copy(cached.results, cached.annotation)
+			if cacheKey.Hit != nil {
+				cacheKey.Hit(annotation)
+			}
+			return NewSliceIterator(results), nil
+		}
+		e.cache.Remove(key)
+	}
+	atomic.AddUint64(&e.misses, 1)
+
+	iterator, err := Stream(ctx, e.evaluator, rawQuery, input)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingIterator{iterator: iterator, evaluator: e, key: key, cacheKey: cacheKey}, nil
+}
+
+// StreamEach evaluates a raw query lazily on each of inputs. Results of
+// streamed inputs are not cached.
+func (e *CachedEvaluator) StreamEach(ctx context.Context, rawQuery string, inputs Iterator) (Iterator, error) {
+	return StreamEach(ctx, e.evaluator, rawQuery, inputs)
+}
+
+// Stats returns the number of cache hits and misses so far.
+func (e *CachedEvaluator) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&e.hits),
+		Misses: atomic.LoadUint64(&e.misses),
+	}
+}
+
+func (e *CachedEvaluator) wrapped() Evaluator {
+	return e.evaluator
+}
+
+// resultsKey identifies the results of a query on an input, given the
+// variable values ctx carries.
+func resultsKey(ctx context.Context, query string, input string) string {
+	variables, _ := json.Marshal(variableValues(ctx))
+	return query + "\x00" + input + "\x00" + string(variables)
+}
+
+// cachingIterator records results, and caches them once exhausted.
+type cachingIterator struct {
+	iterator  Iterator
+	evaluator *CachedEvaluator
+	key       string
+	cacheKey  CacheKey
+	results   []interface{}
+	// done is set once the results were cached, or evaluation failed.
+	done bool
+}
+
+func (i *cachingIterator) Next() (interface{}, error) {
+	result, err := i.iterator.Next()
+	if err == io.EOF && !i.done {
+		i.done = true
+		results, annotation := i.cacheKey.copy(i.results, i.cacheKey.Annotation)
+		cached := &cachedResults{results: results, annotation: annotation}
+		if i.evaluator.ttl > 0 {
+			cached.expires = time.Now().Add(i.evaluator.ttl)
+		}
+		i.evaluator.cache.Add(i.key, cached)
+		return nil, err
+	}
+	if err != nil {
+		i.done = true
+		return nil, err
+	}
+	i.results = append(i.results, result)
+	return result, nil
+}
@@ -0,0 +1,135 @@
+package jq
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// countingEvaluator counts evaluations of the wrapped evaluator.
+type countingEvaluator struct {
+	evaluator Evaluator
+	count     int
+}
+
+func (e *countingEvaluator) Evaluate(rawQuery string, input interface{}) ([]interface{}, error) {
+	e.count++
+	return e.evaluator.Evaluate(rawQuery, input)
+}
+
+func (e *countingEvaluator) Stream(ctx context.Context, rawQuery string, input interface{}) (Iterator, error) {
+	e.count++
+	return Stream(ctx, e.evaluator, rawQuery, input)
+}
+
+func TestCachedEvaluator(t *testing.T) {
+	counting := &countingEvaluator{evaluator: NewQueryEvaluator(QueryCompiler)}
+	evaluator, _ := NewCachedEvaluator(counting, 8, 0)
+	input := map[string]interface{}{"a": 1}
+
+	evaluate := func(ctx context.Context, rawQuery string) []interface{} {
+		iterator, err := evaluator.Stream(ctx, rawQuery, input)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		results, err := Collect(iterator)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return results
+	}
+
+	var annotation interface{}
+	key := CacheKey{Input: "hash", Annotation: "order", Hit: func(cached interface{}) { annotation = cached }}
+	ctx := WithCacheKey(context.Background(), key)
+	for _, test := range []struct {
+		ctx      context.Context
+		rawQuery string
+		count    int
+	}{
+		{ctx, ".a", 1},
+		{ctx, ".a", 1},
+		{ctx, " .a # comment", 1},
+		{ctx, ".a + 1", 2},
+		{WithVariables(ctx, map[string]interface{}{"$status": 404}), ".a", 3},
+		{WithCacheKey(context.Background(), CacheKey{Input: "other"}), ".a", 4},
+		{context.Background(), ".a", 5},
+		{context.Background(), ".a", 6},
+	} {
+		evaluate(test.ctx, test.rawQuery)
+		if counting.count != test.count {
+			t.Errorf("Unexpected evaluation count %d for %q; expected %d", counting.count, test.rawQuery, test.count)
+		}
+	}
+
+	annotation = nil
+	if results := evaluate(ctx, ".a"); !reflect.DeepEqual(results, []interface{}{1}) {
+		t.Errorf("Unexpected cached results %v", results)
+	}
+	if annotation != "order" {
+		t.Errorf("Unexpected annotation %v", annotation)
+	}
+	if actual, expected := evaluator.Stats(), (CacheStats{Hits: 3, Misses: 4}); actual != expected {
+		t.Errorf("Unexpected stats %+v; expected %+v", actual, expected)
+	}
+}
+
+func TestCachedEvaluatorCopy(t *testing.T) {
+	evaluator, _ := NewCachedEvaluator(NewQueryEvaluator(QueryCompiler), 8, 0)
+	copies := 0
+	ctx := WithCacheKey(context.Background(), CacheKey{
+		Input: "hash",
+		Copy: func(results []interface{}, annotation interface{}) ([]interface{}, interface{}) {
+			copies++
+			copied := make([]interface{}, len(results))
+			for i, result := range results {
+				copied[i] = map[string]interface{}{"b": result.(map[string]interface{})["b"]}
+			}
+			return copied, annotation
+		},
+	})
+	input := map[string]interface{}{"a": map[string]interface{}{"b": 1}}
+	var results [][]interface{}
+	for i := 0; i < 3; i++ {
+		iterator, _ := evaluator.Stream(ctx, ".a", input)
+		result, _ := Collect(iterator)
+		results = append(results, result)
+	}
+	if copies != 3 {
+		t.Errorf("Unexpected copy count %d", copies)
+	}
+	results[1][0].(map[string]interface{})["b"] = 2
+	if actual := results[2][0].(map[string]interface{})["b"]; actual != 1 {
+		t.Errorf("Cached results were shared: %v", actual)
+	}
+}
+
+func TestCachedEvaluatorError(t *testing.T) {
+	counting := &countingEvaluator{evaluator: NewQueryEvaluator(QueryCompiler)}
+	evaluator, _ := NewCachedEvaluator(counting, 8, 0)
+	ctx := WithCacheKey(context.Background(), CacheKey{Input: "hash"})
+	for i := 0; i < 2; i++ {
+		iterator, _ := evaluator.Stream(ctx, "1, error(2)", nil)
+		if _, err := Collect(iterator); err == nil {
+			t.Errorf("Evaluation did not fail")
+		}
+	}
+	if counting.count != 2 {
+		t.Errorf("Failed evaluation was cached")
+	}
+}
+
+func TestCachedEvaluatorTTL(t *testing.T) {
+	counting := &countingEvaluator{evaluator: NewQueryEvaluator(QueryCompiler)}
+	evaluator, _ := NewCachedEvaluator(counting, 8, time.Millisecond)
+	ctx := WithCacheKey(context.Background(), CacheKey{Input: "hash"})
+	for i := 0; i < 2; i++ {
+		iterator, _ := evaluator.Stream(ctx, ".", nil)
+		Collect(iterator)
+		time.Sleep(2 * time.Millisecond)
+	}
+	if counting.count != 2 {
+		t.Errorf("Expired results were returned")
+	}
+}
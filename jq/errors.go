@@ -1,8 +1,10 @@
 package jq
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 )
 
 // Evaluation errors.
@@ -10,14 +12,112 @@ var (
 	// ErrEvaluationTimeout signals that evaluating a query exceeded the
 	// evaluation timeout.
 	ErrEvaluationTimeout = errors.New("query evaluation timed out")
+
+	// ErrResultLimitExceeded signals that a query produced more results than
+	// allowed.
+	ErrResultLimitExceeded = errors.New("query result count limit exceeded")
+
+	// ErrOutputLimitExceeded signals that the results of a query exceeded the
+	// maximum output size.
+	ErrOutputLimitExceeded = errors.New("query output size limit exceeded")
+
+	// ErrEvaluatorSaturated signals that all evaluation slots were taken, and
+	// the evaluation could not be queued or waited too long for a slot.
+	ErrEvaluatorSaturated = errors.New("query evaluator is saturated")
 )
 
-// QueryEvaluationError signals that a query was malformed.
+// QueryEvaluationError signals that a query was malformed or failed. It wraps
+// a CompileError, RuntimeError or UserError.
 type QueryEvaluationError struct {
 	Err error
 }
 
 // Error returns the wrapped error message.
 func (e *QueryEvaluationError) Error() string {
+	var compileError *CompileError
+	if errors.As(e.Err, &compileError) {
+		return fmt.Sprintf("query compilation failed: %s", e.Err.Error())
+	}
 	return fmt.Sprintf("query evaluation failed: %s", e.Err.Error())
 }
+
+// Unwrap returns the wrapped error.
+func (e *QueryEvaluationError) Unwrap() error {
+	return e.Err
+}
+
+// CompileError signals that a query failed to parse or compile.
+type CompileError struct {
+	Err error
+}
+
+// Error returns the wrapped error message.
+func (e *CompileError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// RuntimeError signals that evaluating a query failed, e.g. on a type error.
+type RuntimeError struct {
+	Err error
+}
+
+// Error returns the wrapped error message.
+func (e *RuntimeError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// UserError signals that a query raised an error with error or halt_error.
+type UserError struct {
+	// Value is the object the error was raised with, or else the error
+	// message.
+	Value interface{}
+	Err   error
+}
+
+// Error returns the wrapped error message.
+func (e *UserError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e *UserError) Unwrap() error {
+	return e.Err
+}
+
+// evaluationError classifies an error gojq yielded during evaluation.
+func evaluationError(err error) error {
+	// gojq raises errors of an unexported type, which exposes the raised value
+	// only through its message.
+	if _, ok := err.(interface{ ExitCode() int }); ok {
+		return &UserError{Value: userErrorValue(err), Err: err}
+	}
+	return &RuntimeError{Err: err}
+}
+
+// userErrorValue recovers the raised value from the message "error: V", where
+// V is a string verbatim or else JSON. Only objects are recovered, as strings
+// cannot be told apart from other JSON values, e.g. error("404") from
+// error(404). Any other value is returned as the message string.
+func userErrorValue(err error) interface{} {
+	message := strings.TrimPrefix(err.Error(), "error: ")
+	if !strings.HasPrefix(message, "{") {
+		return message
+	}
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+	var value map[string]interface{}
+	if decoder.Decode(&value) != nil || decoder.More() {
+		return message
+	}
+	return value
+}
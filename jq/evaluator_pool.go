@@ -0,0 +1,187 @@
+package jq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PoolOptions configure the limits of an EvaluatorPool.
+type PoolOptions struct {
+	// MaxConcurrent is the maximum number of concurrent evaluations.
+	MaxConcurrent int
+
+	// MaxQueue is the maximum number of evaluations waiting for a slot. Setting
+	// it to 0 rejects evaluations once all slots are taken.
+	MaxQueue int
+
+	// QueueTimeout is how long evaluations wait for a slot. Setting it to 0
+	// waits until the context of the evaluation is done.
+	QueueTimeout time.Duration
+}
+
+// PoolStats describe the usage of an EvaluatorPool.
+type PoolStats struct {
+	Active   int    `json:"active"`
+	Queued   int    `json:"queued"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// EvaluatorPool wraps an evaluator and bounds the number of concurrent
+// evaluations. Evaluations beyond the limit wait in a bounded queue, and fail
+// with ErrEvaluatorSaturated if the queue is full or they waited too long.
+type EvaluatorPool struct {
+	evaluator Evaluator
+	options   PoolOptions
+	slots     chan struct{}
+
+	mu       sync.Mutex
+	queued   int
+	rejected uint64
+}
+
+// NewEvaluatorPool returns a new evaluator limited as options configure.
+func NewEvaluatorPool(evaluator Evaluator, options PoolOptions) *EvaluatorPool {
+	return &EvaluatorPool{
+		evaluator: evaluator,
+		options:   options,
+		slots:     make(chan struct{}, options.MaxConcurrent),
+	}
+}
+
+// Evaluate evaluates a raw query once a slot is free.
+func (p *EvaluatorPool) Evaluate(rawQuery string, input interface{}) ([]interface{}, error) {
+	if err := p.acquire(context.Background()); err != nil {
+		return nil, err
+	}
+	defer p.release()
+	return p.evaluator.Evaluate(rawQuery, input)
+}
+
+// Stream evaluates a raw query lazily once a slot is free. The slot is taken
+// until all results were produced, or ctx is done, so iterators must be
+// exhausted unless ctx is canceled eventually.
+func (p *EvaluatorPool) Stream(ctx context.Context, rawQuery string, input interface{}) (Iterator, error) {
+	if err := p.acquire(ctx); err != nil {
+		return nil, err
+	}
+	iterator, err := Stream(ctx, p.evaluator, rawQuery, input)
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	return p.pooled(ctx, iterator), nil
+}
+
+// StreamEach evaluates a raw query lazily on each of inputs once a slot is
+// free. All inputs are evaluated in the one slot, which is taken as Stream
+// takes it.
+func (p *EvaluatorPool) StreamEach(ctx context.Context, rawQuery string, inputs Iterator) (Iterator, error) {
+	if err := p.acquire(ctx); err != nil {
+		return nil, err
+	}
+	iterator, err := StreamEach(ctx, p.evaluator, rawQuery, inputs)
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	return p.pooled(ctx, iterator), nil
+}
+
+// pooled returns an iterator giving back its slot once all results of
+// iterator were produced, or ctx is done.
+func (p *EvaluatorPool) pooled(ctx context.Context, iterator Iterator) Iterator {
+	pooled := &pooledIterator{iterator: iterator, done: make(chan struct{})}
+	pooled.release = func() {
+		close(pooled.done)
+		p.release()
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			pooled.once.Do(pooled.release)
+		case <-pooled.done:
+		}
+	}()
+	return pooled
+}
+
+// Stats returns the number of active and queued evaluations, and of
+// evaluations rejected so far.
+func (p *EvaluatorPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{
+		Active:   len(p.slots),
+		Queued:   p.queued,
+		Rejected: p.rejected,
+	}
+}
+
+func (p *EvaluatorPool) wrapped() Evaluator {
+	return p.evaluator
+}
+
+// acquire takes a slot, waiting in the queue if all are taken.
+func (p *EvaluatorPool) acquire(ctx context.Context) error {
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	p.mu.Lock()
+	if p.queued >= p.options.MaxQueue {
+		p.rejected++
+		p.mu.Unlock()
+		return ErrEvaluatorSaturated
+	}
+	p.queued++
+	p.mu.Unlock()
+	err := p.wait(ctx)
+	p.mu.Lock()
+	p.queued--
+	if err == ErrEvaluatorSaturated {
+		p.rejected++
+	}
+	p.mu.Unlock()
+	return err
+}
+
+// wait waits for a slot until the queue timeout elapses or ctx is done.
+func (p *EvaluatorPool) wait(ctx context.Context) error {
+	var timeout <-chan time.Time
+	if p.options.QueueTimeout > 0 {
+		timer := time.NewTimer(p.options.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return ErrEvaluatorSaturated
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *EvaluatorPool) release() {
+	<-p.slots
+}
+
+// pooledIterator gives back its slot once all results were produced.
+type pooledIterator struct {
+	iterator Iterator
+	once     sync.Once
+	release  func()
+	done     chan struct{}
+}
+
+func (i *pooledIterator) Next() (interface{}, error) {
+	result, err := i.iterator.Next()
+	if err != nil {
+		i.once.Do(i.release)
+	}
+	return result, err
+}
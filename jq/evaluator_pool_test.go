@@ -0,0 +1,143 @@
+package jq
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// blockingEvaluator blocks evaluations until unblocked.
+type blockingEvaluator struct {
+	unblock chan struct{}
+}
+
+func (e *blockingEvaluator) Evaluate(rawQuery string, input interface{}) ([]interface{}, error) {
+	<-e.unblock
+	return []interface{}{input}, nil
+}
+
+func waitForActive(t *testing.T, pool *EvaluatorPool, active int, queued int) {
+	for i := 0; i < 1000; i++ {
+		if stats := pool.Stats(); stats.Active == active && stats.Queued == queued {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expected %d active and %d queued evaluations, got %+v", active, queued, pool.Stats())
+}
+
+func TestEvaluatorPoolSaturated(t *testing.T) {
+	evaluator := &blockingEvaluator{unblock: make(chan struct{})}
+	pool := NewEvaluatorPool(evaluator, PoolOptions{MaxConcurrent: 1})
+	done := make(chan error)
+	go func() {
+		_, err := pool.Evaluate(".", 1)
+		done <- err
+	}()
+	waitForActive(t, pool, 1, 0)
+
+	if _, err := pool.Evaluate(".", 2); err != ErrEvaluatorSaturated {
+		t.Errorf("Expected ErrEvaluatorSaturated, got %v", err)
+	}
+	close(evaluator.unblock)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if stats := pool.Stats(); stats != (PoolStats{Rejected: 1}) {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestEvaluatorPoolQueue(t *testing.T) {
+	evaluator := &blockingEvaluator{unblock: make(chan struct{})}
+	pool := NewEvaluatorPool(evaluator, PoolOptions{MaxConcurrent: 1, MaxQueue: 1})
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := pool.Evaluate(".", 1)
+			done <- err
+		}()
+	}
+	waitForActive(t, pool, 1, 1)
+
+	if _, err := pool.Evaluate(".", 2); err != ErrEvaluatorSaturated {
+		t.Errorf("Expected ErrEvaluatorSaturated with full queue, got %v", err)
+	}
+	close(evaluator.unblock)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}
+}
+
+func TestEvaluatorPoolQueueTimeout(t *testing.T) {
+	evaluator := &blockingEvaluator{unblock: make(chan struct{})}
+	defer close(evaluator.unblock)
+	pool := NewEvaluatorPool(evaluator, PoolOptions{MaxConcurrent: 1, MaxQueue: 1, QueueTimeout: 10 * time.Millisecond})
+	go pool.Evaluate(".", 1)
+	waitForActive(t, pool, 1, 0)
+
+	start := time.Now()
+	if _, err := pool.Evaluate(".", 2); err != ErrEvaluatorSaturated {
+		t.Errorf("Expected ErrEvaluatorSaturated after queue timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("Rejected after %s, before the queue timeout", elapsed)
+	}
+}
+
+func TestEvaluatorPoolStream(t *testing.T) {
+	pool := NewEvaluatorPool(NewQueryEvaluator(QueryCompiler), PoolOptions{MaxConcurrent: 1})
+	iterator, err := pool.Stream(context.Background(), ".[]", []interface{}{1, 2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := pool.Stream(context.Background(), ".", nil); err != ErrEvaluatorSaturated {
+		t.Errorf("Slot not taken until all results were produced")
+	}
+	Collect(iterator)
+	waitForActive(t, pool, 0, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	iterator, _ = pool.Stream(ctx, ".[]", []interface{}{1, 2})
+	iterator.Next()
+	cancel()
+	waitForActive(t, pool, 0, 0)
+	iterator.Next()
+	iterator.Next()
+	if stats := pool.Stats(); stats.Active != 0 {
+		t.Errorf("Slot released twice: %+v", stats)
+	}
+}
+
+func TestEvaluatorPoolStreamEach(t *testing.T) {
+	observer := &recordingObserver{}
+	evaluator := NewStatsEvaluator(NewQueryEvaluator(QueryCompiler), observer)
+	pool := NewEvaluatorPool(evaluator, PoolOptions{MaxConcurrent: 1})
+	inputs := NewSliceIterator([]interface{}{1.0, 2.0, 3.0})
+	iterator, err := StreamEach(context.Background(), pool, ".", inputs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// All inputs are evaluated in one slot, and observed once.
+	for i := 0; i < 3; i++ {
+		if result, err := iterator.Next(); err != nil || result != float64(i+1) {
+			t.Fatalf("Unexpected result %v: %v", result, err)
+		}
+		if stats := pool.Stats(); stats.Active != 1 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+	}
+	if _, err := iterator.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+	if stats := pool.Stats(); stats != (PoolStats{}) {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if len(observer.evaluations) != 1 {
+		t.Errorf("Expected 1 evaluation, got %d", len(observer.evaluations))
+	}
+}
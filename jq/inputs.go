@@ -0,0 +1,50 @@
+package jq
+
+import (
+	"context"
+	"github.com/itchyny/gojq"
+	"io"
+)
+
+type inputsContextKey struct{}
+
+// WithInputs returns a context under which queries read the values of inputs
+// with the input and inputs functions, like jq --null-input does.
+func WithInputs(ctx context.Context, inputs Iterator) context.Context {
+	return context.WithValue(ctx, inputsContextKey{}, inputs)
+}
+
+func inputsFromContext(ctx context.Context) (Iterator, bool) {
+	inputs, ok := ctx.Value(inputsContextKey{}).(Iterator)
+	return inputs, ok
+}
+
+// compileWithInputs compiles rawQuery to read from inputs. gojq binds inputs at
+// compile time and rejects the input functions without them, so the query is
+// parsed and compiled for each evaluation, bypassing any compile cache.
+func compileWithInputs(rawQuery string, inputs *inputIter) (*gojq.Code, error) {
+	query, err := gojq.Parse(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	return gojq.Compile(query, gojq.WithVariables(Variables), gojq.WithInputIter(inputs))
+}
+
+// inputIter adapts an Iterator to gojq. Errors reading inputs are kept, so that
+// they are returned as is rather than as evaluation errors.
+type inputIter struct {
+	inputs Iterator
+	err    error
+}
+
+func (i *inputIter) Next() (interface{}, bool) {
+	input, err := i.inputs.Next()
+	if err == io.EOF {
+		return nil, false
+	}
+	if err != nil {
+		i.err = err
+		return err, true
+	}
+	return input, true
+}
@@ -0,0 +1,112 @@
+package jq
+
+import (
+	"context"
+	"io"
+)
+
+// Iterator yields query results one at a time. Once all results are
+// exhausted, Next returns io.EOF.
+type Iterator interface {
+	Next() (interface{}, error)
+}
+
+// Streamer evaluates jq queries lazily.
+type Streamer interface {
+	Stream(context.Context, string, interface{}) (Iterator, error)
+}
+
+// EachStreamer evaluates jq queries lazily on each of a stream of inputs, as
+// one evaluation.
+type EachStreamer interface {
+	StreamEach(context.Context, string, Iterator) (Iterator, error)
+}
+
+// Stream evaluates rawQuery on input. If evaluator is a Streamer, results are
+// produced lazily. Otherwise, the eagerly evaluated results are iterated.
+func Stream(ctx context.Context, evaluator Evaluator, rawQuery string, input interface{}) (Iterator, error) {
+	if streamer, ok := evaluator.(Streamer); ok {
+		return streamer.Stream(ctx, rawQuery, input)
+	}
+	results, err := evaluator.Evaluate(rawQuery, input)
+	if err != nil {
+		return nil, err
+	}
+	return NewSliceIterator(results), nil
+}
+
+// StreamEach evaluates rawQuery on each value of inputs, yielding the
+// concatenated results. If evaluator is an EachStreamer, the inputs are
+// evaluated as one evaluation. Otherwise, each input is streamed on its own.
+func StreamEach(ctx context.Context, evaluator Evaluator, rawQuery string, inputs Iterator) (Iterator, error) {
+	if streamer, ok := evaluator.(EachStreamer); ok {
+		return streamer.StreamEach(ctx, rawQuery, inputs)
+	}
+	return &eachIterator{ctx: ctx, evaluator: evaluator, rawQuery: rawQuery, inputs: inputs}, nil
+}
+
+// eachIterator streams rawQuery on each of inputs in turn.
+type eachIterator struct {
+	ctx       context.Context
+	evaluator Evaluator
+	rawQuery  string
+	inputs    Iterator
+	results   Iterator
+}
+
+func (i *eachIterator) Next() (interface{}, error) {
+	for {
+		if i.results != nil {
+			result, err := i.results.Next()
+			if err != io.EOF {
+				return result, err
+			}
+			i.results = nil
+		}
+
+		input, err := i.inputs.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		i.results, err = Stream(i.ctx, i.evaluator, i.rawQuery, input)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Collect exhausts iterator and returns all results.
+func Collect(iterator Iterator) ([]interface{}, error) {
+	var results []interface{}
+	for {
+		result, err := iterator.Next()
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+}
+
+// SliceIterator iterates a slice of results.
+type SliceIterator struct {
+	results []interface{}
+}
+
+// NewSliceIterator returns an iterator over results.
+func NewSliceIterator(results []interface{}) *SliceIterator {
+	return &SliceIterator{results: results}
+}
+
+// Next returns the next result.
+func (i *SliceIterator) Next() (interface{}, error) {
+	if len(i.results) == 0 {
+		return nil, io.EOF
+	}
+	result := i.results[0]
+	i.results = i.results[1:]
+	return result, nil
+}
@@ -0,0 +1,62 @@
+package jq
+
+import (
+	"math/big"
+	"strconv"
+)
+
+// Limits bound the results of a single evaluation. Zero values disable the
+// respective limit. Results are checked as they are emitted, so the memory
+// used while building a single result is not bounded.
+type Limits struct {
+	// MaxResults is the maximum number of results.
+	MaxResults int
+
+	// MaxOutputSize is the maximum total size of results in bytes, as
+	// estimated from their JSON encoding.
+	MaxOutputSize int64
+}
+
+// encodedSize estimates the length of the JSON encoding of v without encoding
+// it. Escape sequences in strings are not accounted for.
+func encodedSize(v interface{}) int64 {
+	switch v := v.(type) {
+	case nil:
+		return 4
+	case bool:
+		if v {
+			return 4
+		}
+		return 5
+	case int:
+		return int64(len(strconv.Itoa(v)))
+	case float64:
+		return int64(len(strconv.FormatFloat(v, 'g', -1, 64)))
+	case *big.Int:
+		return int64(len(v.String()))
+	case string:
+		return int64(len(v)) + 2
+	case []interface{}:
+		size := int64(2)
+		for i, element := range v {
+			if i > 0 {
+				size++
+			}
+			size += encodedSize(element)
+		}
+		return size
+	case map[string]interface{}:
+		size := int64(2)
+		first := true
+		for key, value := range v {
+			if !first {
+				size++
+			}
+			first = false
+			size += int64(len(key)) + 3 + encodedSize(value)
+		}
+		return size
+	default:
+		return 0
+	}
+}
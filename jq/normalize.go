@@ -0,0 +1,158 @@
+package jq
+
+import "strings"
+
+// NormalizeQuery returns a canonical spelling of rawQuery, so that spellings
+// differing only in insignificant whitespace and comments are equal. Runs of
+// whitespace and comments outside of string literals become a single space.
+// The query is not parsed, so this is cheap enough for cache keys.
+func NormalizeQuery(rawQuery string) string {
+	var normalized strings.Builder
+	// parens holds, for each string interpolation the scanner is in, the
+	// depth of parentheses within it.
+	var parens []int
+	inString := false
+	space := false
+
+	for i := 0; i < len(rawQuery); i++ {
+		c := rawQuery[i]
+
+		if inString {
+			normalized.WriteByte(c)
+			switch c {
+			case '\\':
+				if i+1 < len(rawQuery) {
+					i++
+					normalized.WriteByte(rawQuery[i])
+					if rawQuery[i] == '(' {
+						parens = append(parens, 1)
+						inString = false
+					}
+				}
+			case '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			space = true
+			continue
+		case '#':
+			for i+1 < len(rawQuery) && rawQuery[i+1] != '\n' {
+				i++
+			}
+			space = true
+			continue
+		}
+		if space && normalized.Len() > 0 {
+			normalized.WriteByte(' ')
+		}
+		space = false
+		normalized.WriteByte(c)
+
+		switch c {
+		case '"':
+			inString = true
+		case '(':
+			if len(parens) > 0 {
+				parens[len(parens)-1]++
+			}
+		case ')':
+			if len(parens) > 0 {
+				parens[len(parens)-1]--
+				if parens[len(parens)-1] == 0 {
+					parens = parens[:len(parens)-1]
+					inString = true
+				}
+			}
+		}
+	}
+	return normalized.String()
+}
+
+// Fingerprint returns the shape of rawQuery, so that queries differing only in
+// literals are equal. Besides normalizing the spelling, string and number
+// literals are replaced by a question mark.
+func Fingerprint(rawQuery string) string {
+	query := NormalizeQuery(rawQuery)
+	var fingerprint strings.Builder
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '"':
+			i = skipString(query, i) - 1
+			fingerprint.WriteByte('?')
+		case isDigit(c) && (i == 0 || !isIdentifier(query[i-1])):
+			i = skipNumber(query, i) - 1
+			fingerprint.WriteByte('?')
+		default:
+			fingerprint.WriteByte(c)
+		}
+	}
+	return fingerprint.String()
+}
+
+// skipString returns the index after the string literal starting at i,
+// skipping any interpolated expressions.
+func skipString(query string, i int) int {
+	for i++; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if i+1 < len(query) && query[i+1] == '(' {
+				i = skipInterpolation(query, i+2) - 1
+			} else {
+				i++
+			}
+		case '"':
+			return i + 1
+		}
+	}
+	return i
+}
+
+// skipInterpolation returns the index after the closing parenthesis of the
+// interpolated expression starting at i.
+func skipInterpolation(query string, i int) int {
+	depth := 1
+	for ; i < len(query); i++ {
+		switch query[i] {
+		case '"':
+			i = skipString(query, i) - 1
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return i
+}
+
+// skipNumber returns the index after the number literal starting at i.
+func skipNumber(query string, i int) int {
+	for i < len(query) && (isDigit(query[i]) || query[i] == '.') {
+		i++
+	}
+	if i < len(query) && (query[i] == 'e' || query[i] == 'E') {
+		i++
+		if i < len(query) && (query[i] == '+' || query[i] == '-') {
+			i++
+		}
+		for i < len(query) && isDigit(query[i]) {
+			i++
+		}
+	}
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifier(c byte) bool {
+	return isDigit(c) || c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
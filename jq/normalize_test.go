@@ -0,0 +1,43 @@
+package jq
+
+import "testing"
+
+func TestNormalizeQuery(t *testing.T) {
+	for rawQuery, expected := range map[string]string{
+		".":                              ".",
+		"  .foo  |\n\t.bar ":             ".foo | .bar",
+		".foo # comment\n| .bar":         ".foo | .bar",
+		"# comment only":                 "",
+		`"a  b # c"`:                     `"a  b # c"`,
+		`"a \"  b\" # c"  |  .`:          `"a \"  b\" # c" | .`,
+		`"x\( .a  |  "y  z" )  w"  ,  .`: `"x\( .a | "y  z" )  w" , .`,
+		`"\(("a  b"))  c"`:               `"\(("a  b"))  c"`,
+		`"\( "\( .a  ) b  " )  "  #  x`:  `"\( "\( .a ) b  " )  "`,
+	} {
+		if actual := NormalizeQuery(rawQuery); actual != expected {
+			t.Errorf("Unexpected normalized query %q for %q; expected %q", actual, rawQuery, expected)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	for rawQuery, expected := range map[string]string{
+		".":                                 ".",
+		".[0]  | .a1":                       ".[?] | .a1",
+		`select(.id == 42.5e-3)`:            `select(.id == ?)`,
+		`{"a": 1, b: "x\("y" + .c)z"}`:      `{?: ?, b: ?}`,
+		`.a | map(. * 2) # 3`:               `.a | map(. * ?)`,
+		`$__loc__ | @base64d | .[-1:2]`:     `$__loc__ | @base64d | .[-?:?]`,
+		`"\(("a)"))" | limit(3; .[])`:       `? | limit(?; .[])`,
+		`if .x then "a" else "b" end`:       `if .x then ? else ? end`,
+		`def f($a1): $a1 + 1; f(2)`:         `def f($a1): $a1 + ?; f(?)`,
+		`.["key"]`:                          `.[?]`,
+		`"unterminated`:                     `?`,
+		`"a\"b" + .`:                        `? + .`,
+		`{"x": "\(1 + 2)"} | .x | tostring`: `{?: ?} | .x | tostring`,
+	} {
+		if actual := Fingerprint(rawQuery); actual != expected {
+			t.Errorf("Unexpected fingerprint %q for %q; expected %q", actual, rawQuery, expected)
+		}
+	}
+}
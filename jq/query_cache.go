@@ -0,0 +1,179 @@
+package jq
+
+import (
+	"container/list"
+	"errors"
+	"github.com/itchyny/gojq"
+	"sync"
+	"time"
+)
+
+// queryEntryOverhead is the estimated size in bytes of a compiled query,
+// besides the size proportional to the query length.
+const queryEntryOverhead = 512
+
+// queryCache is an LRU cache of compiled queries, bounded by the number of
+// queries and their estimated size in bytes. Queries expire a fixed time after
+// they were compiled, and once they were not used for some time.
+type queryCache struct {
+	mu       sync.Mutex
+	size     int
+	maxBytes int64
+	ttl      time.Duration
+	idleTTL  time.Duration
+	bytes    int64
+	entries  map[string]*list.Element
+	lru      *list.List
+	hits     uint64
+	misses   uint64
+	now      func() time.Time
+}
+
+type queryEntry struct {
+	query    string
+	code     *gojq.Code
+	bytes    int64
+	hits     uint64
+	created  time.Time
+	lastUsed time.Time
+}
+
+// CacheSnapshot describes the contents of a compiled query cache.
+type CacheSnapshot struct {
+	// Entries are the cached queries, most recently used first.
+	Entries []CacheEntry `json:"entries"`
+	// Bytes is the estimated size of all cached queries in bytes.
+	Bytes  int64  `json:"bytes"`
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// CacheEntry describes a cached query.
+type CacheEntry struct {
+	// Query is the normalized query.
+	Query string `json:"query"`
+	// Bytes is the estimated size of the compiled query in bytes.
+	Bytes    int64     `json:"bytes"`
+	Hits     uint64    `json:"hits"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+func newQueryCache(size int, options CacheOptions) (*queryCache, error) {
+	if size <= 0 {
+		return nil, errors.New("must provide a positive size")
+	}
+	return &queryCache{
+		size:     size,
+		maxBytes: options.MaxBytes,
+		ttl:      options.TTL,
+		idleTTL:  options.IdleTTL,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+		now:      time.Now,
+	}, nil
+}
+
+// queryBytes estimates the size of the compiled query in bytes from its length.
+func queryBytes(query string) int64 {
+	return int64(queryEntryOverhead + 4*len(query))
+}
+
+func (c *queryCache) get(query string) (*gojq.Code, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[query]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	entry := element.Value.(*queryEntry)
+	now := c.now()
+	if c.expired(entry, now) {
+		c.remove(element)
+		c.misses++
+		return nil, false
+	}
+	entry.hits++
+	entry.lastUsed = now
+	c.hits++
+	c.lru.MoveToFront(element)
+	return entry.code, true
+}
+
+func (c *queryCache) expired(entry *queryEntry, now time.Time) bool {
+	if c.ttl > 0 && now.Sub(entry.created) >= c.ttl {
+		return true
+	}
+	return c.idleTTL > 0 && now.Sub(entry.lastUsed) >= c.idleTTL
+}
+
+func (c *queryCache) add(query string, code *gojq.Code) {
+	bytes := queryBytes(query)
+	if c.maxBytes > 0 && bytes > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[query]; ok {
+		c.remove(element)
+	}
+	now := c.now()
+	entry := &queryEntry{query: query, code: code, bytes: bytes, created: now, lastUsed: now}
+	c.entries[query] = c.lru.PushFront(entry)
+	c.bytes += bytes
+	for len(c.entries) > c.size || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *queryCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*queryEntry)
+	delete(c.entries, entry.query)
+	c.bytes -= entry.bytes
+}
+
+// delete removes query, and reports whether it was cached.
+func (c *queryCache) delete(query string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[query]
+	if ok {
+		c.remove(element)
+	}
+	return ok
+}
+
+// purge removes all queries, and returns their count.
+func (c *queryCache) purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count := len(c.entries)
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.bytes = 0
+	return count
+}
+
+// snapshot returns the unexpired cached queries.
+func (c *queryCache) snapshot() CacheSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	snapshot := CacheSnapshot{Entries: []CacheEntry{}, Hits: c.hits, Misses: c.misses}
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*queryEntry)
+		if c.expired(entry, now) {
+			continue
+		}
+		snapshot.Entries = append(snapshot.Entries, CacheEntry{
+			Query:    entry.query,
+			Bytes:    entry.bytes,
+			Hits:     entry.hits,
+			Created:  entry.created,
+			LastUsed: entry.lastUsed,
+		})
+		snapshot.Bytes += entry.bytes
+	}
+	return snapshot
+}
@@ -0,0 +1,74 @@
+package jq
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryCacheMaxBytes(t *testing.T) {
+	cache, _ := newQueryCache(8, CacheOptions{MaxBytes: 2 * queryBytes(".a")})
+	code, _ := QueryCompiler(".")
+	for _, query := range []string{".a", ".b", ".c"} {
+		cache.add(query, code)
+	}
+	if _, ok := cache.get(".a"); ok {
+		t.Errorf("Least recently used query not evicted")
+	}
+	if _, ok := cache.get(".c"); !ok {
+		t.Errorf("Most recently used query evicted")
+	}
+
+	cache.add(strings.Repeat(" ", 1000), code)
+	if len(cache.entries) != 2 {
+		t.Errorf("Query larger than the cache was cached")
+	}
+}
+
+func TestQueryCacheExpiry(t *testing.T) {
+	now := time.Now()
+	cache, _ := newQueryCache(8, CacheOptions{TTL: time.Hour, IdleTTL: time.Minute})
+	cache.now = func() time.Time { return now }
+	code, _ := QueryCompiler(".")
+	cache.add(".a", code)
+	cache.add(".b", code)
+
+	// Used queries expire after the TTL.
+	for elapsed := 50 * time.Second; elapsed < time.Hour; elapsed += 50 * time.Second {
+		now = now.Add(50 * time.Second)
+		if _, ok := cache.get(".a"); !ok {
+			t.Fatalf("Query expired after %s", elapsed)
+		}
+	}
+	now = now.Add(50 * time.Second)
+	if _, ok := cache.get(".a"); ok {
+		t.Errorf("Query not expired after TTL")
+	}
+
+	// Unused queries expire after the idle TTL.
+	if _, ok := cache.get(".b"); ok {
+		t.Errorf("Idle query not expired")
+	}
+}
+
+func TestQueryCacheSnapshot(t *testing.T) {
+	now := time.Date(2021, 3, 5, 12, 0, 0, 0, time.UTC)
+	cache, _ := newQueryCache(8, CacheOptions{})
+	cache.now = func() time.Time { return now }
+	code, _ := QueryCompiler(".")
+	cache.add(".a", code)
+	cache.add(".b", code)
+	now = now.Add(time.Second)
+	cache.get(".a")
+	cache.get(".a")
+	cache.get(".c")
+
+	snapshot := cache.snapshot()
+	if len(snapshot.Entries) != 2 || snapshot.Hits != 2 || snapshot.Misses != 1 || snapshot.Bytes != 2*queryBytes(".a") {
+		t.Fatalf("Unexpected snapshot %+v", snapshot)
+	}
+	entry := snapshot.Entries[0]
+	if entry.Query != ".a" || entry.Hits != 2 || !entry.LastUsed.Equal(now) || !entry.Created.Equal(now.Add(-time.Second)) {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+}
@@ -11,7 +11,7 @@ func QueryCompiler(rawQuery string) (*gojq.Code, error) {
 	if err != nil {
 		return nil, err
 	}
-	code, err := gojq.Compile(query)
+	code, err := gojq.Compile(query, gojq.WithVariables(Variables))
 	if err != nil {
 		return nil, err
 	}
@@ -1,5 +1,11 @@
 package jq
 
+import (
+	"context"
+	"github.com/itchyny/gojq"
+	"io"
+)
+
 // Evaluator evaluates jq queries.
 type Evaluator interface {
 	Evaluate(string, interface{}) ([]interface{}, error)
@@ -8,12 +14,20 @@ type Evaluator interface {
 // QueryEvaluator compiles queries and evaluates JSON input.
 type QueryEvaluator struct {
 	compiler Compiler
+	limits   Limits
 }
 
 // NewQueryEvaluator returns a new QueryEvaluator using compiler.
 func NewQueryEvaluator(compiler Compiler) *QueryEvaluator {
+	return NewLimitedQueryEvaluator(compiler, Limits{})
+}
+
+// NewLimitedQueryEvaluator returns a new QueryEvaluator using compiler, whose
+// evaluations error once they exceed limits.
+func NewLimitedQueryEvaluator(compiler Compiler, limits Limits) *QueryEvaluator {
 	return &QueryEvaluator{
 		compiler: compiler,
+		limits:   limits,
 	}
 }
 
@@ -21,21 +35,71 @@ func NewQueryEvaluator(compiler Compiler) *QueryEvaluator {
 // It returns a slice of evaluation results.
 // If the query fails to compile, or input fails to evaluate, it errors.
 func (e *QueryEvaluator) Evaluate(rawQuery string, input interface{}) ([]interface{}, error) {
-	code, err := e.compiler(rawQuery)
+	iterator, err := e.Stream(context.Background(), rawQuery, input)
+	if err != nil {
+		return nil, err
+	}
+	return Collect(iterator)
+}
+
+// Stream compiles the raw query string rawQuery and evaluates input lazily.
+// If the query fails to compile, it errors. Evaluation errors are returned by
+// the iterator. Evaluation stops once ctx is done. If ctx carries inputs, the
+// query reads them with the input and inputs functions. Variables are set to
+// the values ctx carries.
+func (e *QueryEvaluator) Stream(ctx context.Context, rawQuery string, input interface{}) (Iterator, error) {
+	var code *gojq.Code
+	var inputs *inputIter
+	var err error
+	if iterator, ok := inputsFromContext(ctx); ok {
+		inputs = &inputIter{inputs: iterator}
+		code, err = compileWithInputs(rawQuery, inputs)
+	} else {
+		code, err = e.compiler(rawQuery)
+	}
 	if err != nil {
-		return nil, &QueryEvaluationError{Err: err}
-	}
-	var results []interface{}
-	iter := code.Run(input)
-	for {
-		result, ok := iter.Next()
-		if !ok {
-			break
+		return nil, &QueryEvaluationError{Err: &CompileError{Err: err}}
+	}
+	return &codeIterator{iter: code.RunWithContext(ctx, input, variableValues(ctx)...), inputs: inputs, limits: e.limits}, nil
+}
+
+type codeIterator struct {
+	iter       gojq.Iter
+	inputs     *inputIter
+	limits     Limits
+	results    int
+	outputSize int64
+}
+
+func (i *codeIterator) Next() (interface{}, error) {
+	result, ok := i.iter.Next()
+	if !ok {
+		// The inputs function of gojq ends silently on some errors.
+		if i.inputs != nil && i.inputs.err != nil {
+			return nil, i.inputs.err
+		}
+		return nil, io.EOF
+	}
+	if err, ok := result.(error); ok {
+		if err == context.DeadlineExceeded || err == context.Canceled {
+			return nil, err
 		}
-		if err, ok := result.(error); ok {
-			return nil, &QueryEvaluationError{Err: err}
+		if i.inputs != nil && i.inputs.err != nil {
+			return nil, i.inputs.err
 		}
-		results = append(results, result)
+		return nil, &QueryEvaluationError{Err: evaluationError(err)}
 	}
-	return results, nil
+
+	i.results++
+	if i.limits.MaxResults > 0 && i.results > i.limits.MaxResults {
+		return nil, ErrResultLimitExceeded
+	}
+	if i.limits.MaxOutputSize > 0 {
+		i.outputSize += encodedSize(result)
+		if i.outputSize > i.limits.MaxOutputSize {
+			return nil, ErrOutputLimitExceeded
+		}
+	}
+
+	return result, nil
 }
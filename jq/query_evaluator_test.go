@@ -2,10 +2,15 @@ package jq
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/big"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestEvaluatorMultipleResults(t *testing.T) {
@@ -78,3 +83,194 @@ func TestEvaluatorInvalidQuery(t *testing.T) {
 		t.Errorf("Unexpected results returned: %q\n", results)
 	}
 }
+
+func TestEvaluatorStream(t *testing.T) {
+	evaluator := NewQueryEvaluator(QueryCompiler)
+	rawQuery := ".[] | if . < 3 then . else error(\"too large\") end"
+	input := []interface{}{1, 2, 3}
+	iterator, err := evaluator.Stream(context.Background(), rawQuery, input)
+	if err != nil {
+		t.Fatalf("Compilation failed")
+	}
+	for _, expected := range []interface{}{1, 2} {
+		result, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if result != expected {
+			t.Errorf("Unexpected result %v; expected %v", result, expected)
+		}
+	}
+	_, err = iterator.Next()
+	var e *QueryEvaluationError
+	if !errors.As(err, &e) {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestEvaluatorStreamInvalidQuery(t *testing.T) {
+	evaluator := NewQueryEvaluator(QueryCompiler)
+	iterator, err := evaluator.Stream(context.Background(), "{!id}", nil)
+	if err == nil {
+		t.Errorf("Compilation did not fail")
+	}
+	if iterator != nil {
+		t.Errorf("Unexpected iterator returned")
+	}
+}
+
+func TestEvaluatorResultLimit(t *testing.T) {
+	evaluator := NewLimitedQueryEvaluator(QueryCompiler, Limits{MaxResults: 2})
+	results, err := evaluator.Evaluate("range(3)", nil)
+	if err != ErrResultLimitExceeded {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if results != nil {
+		t.Errorf("Unexpected results returned: %q\n", results)
+	}
+}
+
+func TestEvaluatorOutputLimit(t *testing.T) {
+	evaluator := NewLimitedQueryEvaluator(QueryCompiler, Limits{MaxOutputSize: 15})
+	results, err := evaluator.Evaluate(`{"id": 1}, {"id": 2}`, nil)
+	if err != ErrOutputLimitExceeded {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if results != nil {
+		t.Errorf("Unexpected results returned: %q\n", results)
+	}
+}
+
+func TestEvaluatorWithinLimits(t *testing.T) {
+	evaluator := NewLimitedQueryEvaluator(QueryCompiler, Limits{MaxResults: 2, MaxOutputSize: 16})
+	results, err := evaluator.Evaluate(`{"id": 1}, 2`, nil)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if len(results) != 2 {
+		t.Errorf("Unexpected results returned: %q\n", results)
+	}
+}
+
+// A single huge result is built before it is checked against the limits, so
+// only the evaluation timeout bounds it.
+func TestEvaluatorLimitsHugeResult(t *testing.T) {
+	limited := NewLimitedQueryEvaluator(QueryCompiler, Limits{MaxResults: 1, MaxOutputSize: 1024})
+	evaluator := NewTimeoutEvaluator(limited, 50*time.Millisecond)
+	iterator, err := evaluator.Stream(context.Background(), "[range(1e9)]", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := iterator.Next(); err != ErrEvaluationTimeout {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestEvaluatorLargeIntegers(t *testing.T) {
+	evaluator := NewQueryEvaluator(QueryCompiler)
+	input := map[string]interface{}{
+		"id":  json.Number("9007199254740993"),
+		"big": json.Number("123456789012345678901234567890"),
+	}
+	results, err := evaluator.Evaluate(".id + 1, .big", input)
+	if err != nil {
+		t.Fatalf("Evaluation failed: %s", err)
+	}
+	if fmt.Sprint(results[0]) != "9007199254740994" {
+		t.Errorf("Unexpected result: %v\n", results[0])
+	}
+	big, ok := results[1].(*big.Int)
+	if !ok || big.String() != "123456789012345678901234567890" {
+		t.Errorf("Unexpected result: %v\n", results[1])
+	}
+}
+
+type failingIterator struct {
+	err error
+}
+
+func (i *failingIterator) Next() (interface{}, error) {
+	return nil, i.err
+}
+
+func TestEvaluatorInputs(t *testing.T) {
+	evaluator := NewQueryEvaluator(QueryCompiler)
+	ctx := WithInputs(context.Background(), NewSliceIterator([]interface{}{1, 2, 3}))
+	iterator, err := evaluator.Stream(ctx, "[., input, [inputs]]", nil)
+	if err != nil {
+		t.Fatalf("Compilation failed: %s", err)
+	}
+	results, err := Collect(iterator)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []interface{}{[]interface{}{nil, 1, []interface{}{2, 3}}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Unexpected results %v", results)
+	}
+}
+
+func TestEvaluatorInputsError(t *testing.T) {
+	inputsErr := errors.New("invalid input")
+	evaluator := NewQueryEvaluator(QueryCompiler)
+	ctx := WithInputs(context.Background(), &failingIterator{err: inputsErr})
+	iterator, _ := evaluator.Stream(ctx, "[inputs]", nil)
+	if _, err := iterator.Next(); err != inputsErr {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestEvaluatorVariables(t *testing.T) {
+	evaluator := NewQueryEvaluator(QueryCompiler)
+	for _, c := range []struct {
+		ctx      context.Context
+		expected interface{}
+	}{
+		{WithVariables(context.Background(), map[string]interface{}{"$status": 404}), 404},
+		{context.Background(), nil},
+	} {
+		iterator, err := evaluator.Stream(c.ctx, "$status", nil)
+		if err != nil {
+			t.Fatalf("Compilation failed: %s", err)
+		}
+		result, err := iterator.Next()
+		if err != nil || result != c.expected {
+			t.Errorf("Unexpected result %v, error %v", result, err)
+		}
+	}
+}
+
+func TestEvaluatorErrorKinds(t *testing.T) {
+	evaluator := NewQueryEvaluator(QueryCompiler)
+
+	_, err := evaluator.Evaluate("{!id}", nil)
+	var compileError *CompileError
+	if !errors.As(err, &compileError) {
+		t.Errorf("Unexpected compile error: %v", err)
+	}
+
+	_, err = evaluator.Evaluate(".foo", []interface{}{})
+	var runtimeError *RuntimeError
+	if !errors.As(err, &runtimeError) {
+		t.Errorf("Unexpected runtime error: %v", err)
+	}
+
+	for rawQuery, expected := range map[string]string{
+		`error("boom")`:                `"boom"`,
+		`error({status: 404, a: [1]})`: `{"a":[1],"status":404}`,
+		`error(null)`:                  `"null"`,
+		`error(404)`:                   `"404"`,
+		`error("404")`:                 `"404"`,
+		`error([1])`:                   `"[1]"`,
+	} {
+		_, err = evaluator.Evaluate(rawQuery, nil)
+		var userError *UserError
+		if !errors.As(err, &userError) {
+			t.Fatalf("Unexpected user error for %s: %v", rawQuery, err)
+		}
+		value, _ := json.Marshal(userError.Value)
+		if actual := string(value); actual != expected {
+			t.Errorf("Unexpected user error value %s for %s; expected %s", actual, rawQuery, expected)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package jq
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// ReadQueries reads queries from a JSON array of strings, or else one query
+// per line. Blank lines and lines of comments only are skipped.
+func ReadQueries(reader io.Reader) ([]string, error) {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	var queries []string
+	if json.Unmarshal(content, &queries) == nil {
+		return queries, nil
+	}
+	queries = nil
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		if line := scanner.Text(); NormalizeQuery(line) != "" {
+			queries = append(queries, line)
+		}
+	}
+	return queries, scanner.Err()
+}
+
+// WriteQueries writes queries as a JSON array of strings, which ReadQueries
+// reads back.
+func WriteQueries(writer io.Writer, queries []string) error {
+	if queries == nil {
+		queries = []string{}
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(queries)
+}
+
+// Warm compiles queries into the cache. It returns the errors of queries that
+// failed to compile.
+func (c *CachedCompiler) Warm(queries []string) []error {
+	var errs []error
+	for _, query := range queries {
+		if _, err := c.Compiler(query); err != nil {
+			errs = append(errs, fmt.Errorf("query %q: %w", query, err))
+		}
+	}
+	return errs
+}
+
+// Hottest returns up to n cached queries, most often used first.
+func (c *CachedCompiler) Hottest(n int) []string {
+	entries := c.Snapshot().Entries
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Hits > entries[j].Hits
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	queries := make([]string, len(entries))
+	for i, entry := range entries {
+		queries[i] = entry.Query
+	}
+	return queries
+}
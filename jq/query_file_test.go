@@ -0,0 +1,59 @@
+package jq
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadQueries(t *testing.T) {
+	for input, expected := range map[string][]string{
+		`[".a", ".b | .c"]`:          {".a", ".b | .c"},
+		".a\n\n# comment\n.b | .c\n": {".a", ".b | .c"},
+		"":                           nil,
+	} {
+		queries, err := ReadQueries(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(queries, expected) {
+			t.Errorf("Expected %q, got %q", expected, queries)
+		}
+	}
+}
+
+func TestWriteQueries(t *testing.T) {
+	var buffer bytes.Buffer
+	queries := []string{".a", `.b | select(. == "<&>")`}
+	if err := WriteQueries(&buffer, queries); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	read, _ := ReadQueries(&buffer)
+	if !reflect.DeepEqual(read, queries) {
+		t.Errorf("Expected %q, got %q", queries, read)
+	}
+}
+
+func TestCachedCompilerWarm(t *testing.T) {
+	compiler := mockCompiler{}
+	cachedCompiler, _ := NewCachedCompiler(compiler.Compiler, 8)
+	errs := cachedCompiler.Warm([]string{".a", ".b |", ".c"})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `".b |"`) {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+	cachedCompiler.Compiler(".a")
+	if compiler.Calls != 3 {
+		t.Errorf("Expected 3 compilations, got %d", compiler.Calls)
+	}
+}
+
+func TestCachedCompilerHottest(t *testing.T) {
+	cachedCompiler, _ := NewCachedCompiler(QueryCompiler, 8)
+	for _, query := range []string{".a", ".b", ".b", ".c", ".c", ".c"} {
+		cachedCompiler.Compiler(query)
+	}
+	if hottest := cachedCompiler.Hottest(2); !reflect.DeepEqual(hottest, []string{".c", ".b"}) {
+		t.Errorf("Unexpected hottest queries: %q", hottest)
+	}
+}
@@ -0,0 +1,328 @@
+package jq
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// durationSamples is the number of most recent durations kept per query
+// fingerprint to estimate percentiles from.
+const durationSamples = 256
+
+// Evaluation describes a finished evaluation.
+type Evaluation struct {
+	Query       string
+	Fingerprint string
+	Duration    time.Duration
+	// InputSize is the size of the input in bytes, if known.
+	InputSize int64
+	// OutputSize is the size of the results in bytes, as estimated from their
+	// JSON encoding.
+	OutputSize int64
+	Err        error
+}
+
+// Observer is notified of finished evaluations, along with the context they
+// were evaluated under.
+type Observer interface {
+	Observe(context.Context, Evaluation)
+}
+
+type inputSizeContextKey struct{}
+
+// WithInputSize returns a context under which evaluations report the input
+// size that size returns once they finished.
+func WithInputSize(ctx context.Context, size func() int64) context.Context {
+	return context.WithValue(ctx, inputSizeContextKey{}, size)
+}
+
+// QueryStats aggregates evaluations by query fingerprint. Once it tracks its
+// maximum number of fingerprints, the least evaluated one makes room for new
+// ones.
+type QueryStats struct {
+	mu           sync.Mutex
+	size         int
+	fingerprints map[string]*fingerprintStats
+}
+
+type fingerprintStats struct {
+	QueryStat
+	// durations are the most recent durations, written round-robin.
+	durations []time.Duration
+	next      int
+}
+
+// QueryStat are the aggregated evaluations of a query fingerprint. Durations
+// are in nanoseconds, and percentiles are estimated from recent evaluations.
+type QueryStat struct {
+	Fingerprint string        `json:"fingerprint"`
+	Count       uint64        `json:"count"`
+	Errors      uint64        `json:"errors"`
+	TotalTime   time.Duration `json:"total_time"`
+	P50         time.Duration `json:"p50"`
+	P95         time.Duration `json:"p95"`
+	Max         time.Duration `json:"max"`
+	InputBytes  int64         `json:"input_bytes"`
+	OutputBytes int64         `json:"output_bytes"`
+}
+
+// NewQueryStats returns statistics tracking up to size query fingerprints.
+func NewQueryStats(size int) *QueryStats {
+	return &QueryStats{size: size, fingerprints: map[string]*fingerprintStats{}}
+}
+
+// Observe records an evaluation.
+func (s *QueryStats) Observe(ctx context.Context, evaluation Evaluation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats, ok := s.fingerprints[evaluation.Fingerprint]
+	if !ok {
+		if len(s.fingerprints) >= s.size {
+			s.evict()
+		}
+		stats = &fingerprintStats{QueryStat: QueryStat{Fingerprint: evaluation.Fingerprint}}
+		s.fingerprints[evaluation.Fingerprint] = stats
+	}
+	stats.Count++
+	stats.TotalTime += evaluation.Duration
+	stats.InputBytes += evaluation.InputSize
+	stats.OutputBytes += evaluation.OutputSize
+	if evaluation.Err != nil {
+		stats.Errors++
+	}
+	if evaluation.Duration > stats.Max {
+		stats.Max = evaluation.Duration
+	}
+	if len(stats.durations) < durationSamples {
+		stats.durations = append(stats.durations, evaluation.Duration)
+	} else {
+		stats.durations[stats.next] = evaluation.Duration
+		stats.next = (stats.next + 1) % durationSamples
+	}
+}
+
+// evict forgets the least evaluated fingerprint.
+func (s *QueryStats) evict() {
+	var least *fingerprintStats
+	for _, stats := range s.fingerprints {
+		if least == nil || stats.Count < least.Count {
+			least = stats
+		}
+	}
+	if least != nil {
+		delete(s.fingerprints, least.Fingerprint)
+	}
+}
+
+// stat returns the aggregated evaluations with percentiles estimated.
+func (s *fingerprintStats) stat() QueryStat {
+	stat := s.QueryStat
+	durations := append([]time.Duration(nil), s.durations...)
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+	stat.P50 = percentile(durations, 50)
+	stat.P95 = percentile(durations, 95)
+	return stat
+}
+
+// percentile returns the nearest-rank percentile p of sorted durations.
+func percentile(durations []time.Duration, p int) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	rank := (p*len(durations) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return durations[rank-1]
+}
+
+// TopByCount returns up to n fingerprints, most often evaluated first.
+func (s *QueryStats) TopByCount(n int) []QueryStat {
+	return s.top(n, func(a, b QueryStat) bool {
+		return a.Count > b.Count
+	})
+}
+
+// TopByTime returns up to n fingerprints, most total time spent evaluating
+// them first.
+func (s *QueryStats) TopByTime(n int) []QueryStat {
+	return s.top(n, func(a, b QueryStat) bool {
+		return a.TotalTime > b.TotalTime
+	})
+}
+
+func (s *QueryStats) top(n int, before func(a, b QueryStat) bool) []QueryStat {
+	s.mu.Lock()
+	stats := make([]QueryStat, 0, len(s.fingerprints))
+	for _, fingerprint := range s.fingerprints {
+		stats = append(stats, fingerprint.stat())
+	}
+	s.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		if before(stats[i], stats[j]) != before(stats[j], stats[i]) {
+			return before(stats[i], stats[j])
+		}
+		return stats[i].Fingerprint < stats[j].Fingerprint
+	})
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// StatsEvaluator wraps an evaluator and notifies observers of its
+// evaluations.
+type StatsEvaluator struct {
+	evaluator Evaluator
+	observers []Observer
+}
+
+// NewStatsEvaluator returns a new evaluator notifying observers of
+// evaluations.
+func NewStatsEvaluator(evaluator Evaluator, observers ...Observer) *StatsEvaluator {
+	return &StatsEvaluator{evaluator: evaluator, observers: observers}
+}
+
+// Evaluate evaluates a raw query and notifies the observers.
+func (e *StatsEvaluator) Evaluate(rawQuery string, input interface{}) ([]interface{}, error) {
+	start := time.Now()
+	results, err := e.evaluator.Evaluate(rawQuery, input)
+	var outputSize int64
+	for _, result := range results {
+		outputSize += encodedSize(result)
+	}
+	e.observe(context.Background(), rawQuery, time.Since(start), outputSize, err)
+	return results, err
+}
+
+// Stream evaluates a raw query lazily, and notifies the observers once all
+// results were produced, or once ctx is done if the caller abandons the
+// iterator before. Only time spent producing results is counted, not time
+// spent by the caller between results.
+func (e *StatsEvaluator) Stream(ctx context.Context, rawQuery string, input interface{}) (Iterator, error) {
+	return e.stream(ctx, rawQuery, func() (Iterator, error) {
+		return Stream(ctx, e.evaluator, rawQuery, input)
+	})
+}
+
+// StreamEach evaluates a raw query lazily on each of inputs, and notifies the
+// observers once of all inputs, as Stream does.
+func (e *StatsEvaluator) StreamEach(ctx context.Context, rawQuery string, inputs Iterator) (Iterator, error) {
+	return e.stream(ctx, rawQuery, func() (Iterator, error) {
+		return StreamEach(ctx, e.evaluator, rawQuery, inputs)
+	})
+}
+
+func (e *StatsEvaluator) stream(ctx context.Context, rawQuery string, evaluate func() (Iterator, error)) (Iterator, error) {
+	start := time.Now()
+	iterator, err := evaluate()
+	if err != nil {
+		e.observe(ctx, rawQuery, time.Since(start), 0, err)
+		return nil, err
+	}
+	stats := &statsIterator{
+		ctx:       ctx,
+		iterator:  iterator,
+		evaluator: e,
+		query:     rawQuery,
+		elapsed:   time.Since(start),
+		done:      make(chan struct{}),
+	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				stats.mu.Lock()
+				stats.finish(nil)
+				stats.mu.Unlock()
+			case <-stats.done:
+			}
+		}()
+	}
+	return stats, nil
+}
+
+func (e *StatsEvaluator) wrapped() Evaluator {
+	return e.evaluator
+}
+
+// Observes reports whether evaluator, or an evaluator it wraps, notifies
+// observer of evaluations.
+func Observes(evaluator Evaluator, observer Observer) bool {
+	for {
+		if stats, ok := evaluator.(*StatsEvaluator); ok {
+			for _, o := range stats.observers {
+				if o == observer {
+					return true
+				}
+			}
+		}
+		wrapper, ok := evaluator.(interface{ wrapped() Evaluator })
+		if !ok {
+			return false
+		}
+		evaluator = wrapper.wrapped()
+	}
+}
+
+func (e *StatsEvaluator) observe(ctx context.Context, rawQuery string, elapsed time.Duration, outputSize int64, err error) {
+	evaluation := Evaluation{
+		Query:       rawQuery,
+		Fingerprint: Fingerprint(rawQuery),
+		Duration:    elapsed,
+		OutputSize:  outputSize,
+		Err:         err,
+	}
+	if size, ok := ctx.Value(inputSizeContextKey{}).(func() int64); ok {
+		evaluation.InputSize = size()
+	}
+	for _, observer := range e.observers {
+		observer.Observe(ctx, evaluation)
+	}
+}
+
+// statsIterator notifies the observers exactly once, when the results ran
+// out or the evaluation failed, or else when its context is done.
+type statsIterator struct {
+	// mu is held while producing a result, so that an abandoned evaluation
+	// is observed with the time of its last result counted.
+	mu         sync.Mutex
+	once       sync.Once
+	done       chan struct{}
+	ctx        context.Context
+	iterator   Iterator
+	evaluator  *StatsEvaluator
+	query      string
+	elapsed    time.Duration
+	outputSize int64
+}
+
+func (i *statsIterator) Next() (interface{}, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	start := time.Now()
+	result, err := i.iterator.Next()
+	i.elapsed += time.Since(start)
+	if err == nil {
+		i.outputSize += encodedSize(result)
+	} else if err == io.EOF {
+		i.finish(nil)
+	} else {
+		i.finish(err)
+	}
+	return result, err
+}
+
+// finish notifies the observers unless they were already. It must be called
+// with mu held.
+func (i *statsIterator) finish(err error) {
+	i.once.Do(func() {
+		close(i.done)
+		i.evaluator.observe(i.ctx, i.query, i.elapsed, i.outputSize, err)
+	})
+}
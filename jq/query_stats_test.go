@@ -0,0 +1,147 @@
+package jq
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func observe(stats *QueryStats, rawQuery string, elapsed time.Duration, err error) {
+	stats.Observe(context.Background(), Evaluation{
+		Query:       rawQuery,
+		Fingerprint: Fingerprint(rawQuery),
+		Duration:    elapsed,
+		Err:         err,
+	})
+}
+
+func TestQueryStatsTop(t *testing.T) {
+	stats := NewQueryStats(8)
+	observe(stats, ".a", 1*time.Millisecond, nil)
+	observe(stats, ".a", 1*time.Millisecond, nil)
+	observe(stats, " .a", 1*time.Millisecond, ErrEvaluationTimeout)
+	observe(stats, ".b", 10*time.Millisecond, nil)
+
+	byCount := stats.TopByCount(1)
+	if len(byCount) != 1 || byCount[0].Fingerprint != ".a" || byCount[0].Count != 3 || byCount[0].Errors != 1 {
+		t.Errorf("Unexpected top queries by count: %v", byCount)
+	}
+	byTime := stats.TopByTime(8)
+	if len(byTime) != 2 || byTime[0].Fingerprint != ".b" || byTime[1].TotalTime != 3*time.Millisecond {
+		t.Errorf("Unexpected top queries by time: %v", byTime)
+	}
+}
+
+func TestQueryStatsFingerprints(t *testing.T) {
+	stats := NewQueryStats(8)
+	for i := 1; i <= 100; i++ {
+		observe(stats, ".["+strconv.Itoa(i)+"]", time.Duration(i)*time.Millisecond, nil)
+	}
+	top := stats.TopByCount(8)
+	if len(top) != 1 || top[0].Fingerprint != ".[?]" {
+		t.Fatalf("Queries not aggregated by fingerprint: %v", top)
+	}
+	if top[0].P50 != 50*time.Millisecond || top[0].P95 != 95*time.Millisecond || top[0].Max != 100*time.Millisecond {
+		t.Errorf("Unexpected percentiles: %v", top[0])
+	}
+}
+
+func TestQueryStatsPercentileSamples(t *testing.T) {
+	stats := NewQueryStats(8)
+	observe(stats, ".", time.Hour, nil)
+	for i := 0; i < durationSamples; i++ {
+		observe(stats, ".", time.Millisecond, nil)
+	}
+	top := stats.TopByCount(1)
+	if top[0].P95 != time.Millisecond || top[0].Max != time.Hour {
+		t.Errorf("Percentiles not estimated from recent evaluations: %v", top[0])
+	}
+}
+
+func TestQueryStatsEviction(t *testing.T) {
+	stats := NewQueryStats(2)
+	observe(stats, ".a", 0, nil)
+	observe(stats, ".a", 0, nil)
+	observe(stats, ".b", 0, nil)
+	observe(stats, ".c", 0, nil)
+	top := stats.TopByCount(8)
+	if len(top) != 2 || top[0].Fingerprint != ".a" || top[1].Fingerprint != ".c" {
+		t.Errorf("Unexpected queries after eviction: %v", top)
+	}
+}
+
+type recordingObserver struct {
+	evaluations []Evaluation
+}
+
+func (o *recordingObserver) Observe(ctx context.Context, evaluation Evaluation) {
+	o.evaluations = append(o.evaluations, evaluation)
+}
+
+func TestStatsEvaluatorStream(t *testing.T) {
+	observer := &recordingObserver{}
+	evaluator := NewStatsEvaluator(NewQueryEvaluator(QueryCompiler), observer)
+	ctx := WithInputSize(context.Background(), func() int64 { return 7 })
+	iterator, err := evaluator.Stream(ctx, ".[]", []interface{}{1, "ab"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(observer.evaluations) != 0 {
+		t.Errorf("Evaluation observed before all results were produced")
+	}
+	Collect(iterator)
+	iterator.Next()
+	if len(observer.evaluations) != 1 {
+		t.Fatalf("Expected 1 evaluation, got %d", len(observer.evaluations))
+	}
+	evaluation := observer.evaluations[0]
+	if evaluation.Fingerprint != ".[]" || evaluation.InputSize != 7 || evaluation.OutputSize != 5 || evaluation.Err != nil {
+		t.Errorf("Unexpected evaluation: %+v", evaluation)
+	}
+
+	evaluator.Stream(context.Background(), ".[", nil)
+	if len(observer.evaluations) != 2 || observer.evaluations[1].Err == nil {
+		t.Errorf("Failed evaluation not observed: %+v", observer.evaluations)
+	}
+}
+
+type channelObserver chan Evaluation
+
+func (o channelObserver) Observe(ctx context.Context, evaluation Evaluation) {
+	o <- evaluation
+}
+
+func TestStatsEvaluatorStreamAbandoned(t *testing.T) {
+	observer := make(channelObserver, 2)
+	evaluator := NewStatsEvaluator(NewQueryEvaluator(QueryCompiler), observer)
+	ctx, cancel := context.WithCancel(context.Background())
+	iterator, _ := evaluator.Stream(ctx, ".[]", []interface{}{1, 2})
+	iterator.Next()
+	cancel()
+	select {
+	case evaluation := <-observer:
+		if evaluation.OutputSize != 1 || evaluation.Err != nil {
+			t.Errorf("Unexpected evaluation: %+v", evaluation)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Abandoned evaluation not observed")
+	}
+	Collect(iterator)
+	time.Sleep(10 * time.Millisecond)
+	if len(observer) != 0 {
+		t.Errorf("Evaluation observed more than once")
+	}
+}
+
+func TestObserves(t *testing.T) {
+	observer, other := &recordingObserver{}, &recordingObserver{}
+	stats := NewStatsEvaluator(NewQueryEvaluator(QueryCompiler), observer)
+	cached, _ := NewCachedEvaluator(NewEvaluatorPool(stats, PoolOptions{MaxConcurrent: 1}), 8, 0)
+	if !Observes(cached, observer) {
+		t.Errorf("Wrapped observer not found")
+	}
+	if Observes(cached, other) || Observes(NewQueryEvaluator(QueryCompiler), observer) {
+		t.Errorf("Unexpected observer found")
+	}
+}
@@ -1,6 +1,7 @@
 package jq
 
 import (
+	"context"
 	"time"
 )
 
@@ -48,3 +49,43 @@ func (e *TimeoutEvaluator) Evaluate(rawQuery string, input interface{}) ([]inter
 
 	return results, nil
 }
+
+// Stream evaluates a raw query lazily, erroring if producing all results
+// exceeds the time limit.
+func (e *TimeoutEvaluator) Stream(ctx context.Context, rawQuery string, input interface{}) (Iterator, error) {
+	streamer, ok := e.evaluator.(Streamer)
+	if !ok {
+		results, err := e.Evaluate(rawQuery, input)
+		if err != nil {
+			return nil, err
+		}
+		return NewSliceIterator(results), nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	iterator, err := streamer.Stream(ctx, rawQuery, input)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &timeoutIterator{iterator: iterator, cancel: cancel}, nil
+}
+
+func (e *TimeoutEvaluator) wrapped() Evaluator {
+	return e.evaluator
+}
+
+type timeoutIterator struct {
+	iterator Iterator
+	cancel   context.CancelFunc
+}
+
+func (i *timeoutIterator) Next() (interface{}, error) {
+	result, err := i.iterator.Next()
+	if err == context.DeadlineExceeded {
+		return nil, ErrEvaluationTimeout
+	}
+	if err != nil {
+		i.cancel()
+	}
+	return result, err
+}
@@ -1,6 +1,7 @@
 package jq
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"testing"
@@ -59,3 +60,17 @@ func TestTimeoutEvaluatorTimeout(t *testing.T) {
 		t.Errorf("Unexpected error")
 	}
 }
+
+func TestTimeoutEvaluatorStreamTimeout(t *testing.T) {
+	evaluator := NewTimeoutEvaluator(NewQueryEvaluator(QueryCompiler), 100*time.Millisecond)
+	iterator, err := evaluator.Stream(context.Background(), "0, last(range(1e10))", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result, err := iterator.Next(); result != 0 || err != nil {
+		t.Errorf("Unexpected result")
+	}
+	if _, err := iterator.Next(); err != ErrEvaluationTimeout {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,27 @@
+package jq
+
+import (
+	"context"
+)
+
+// Variables are the names of the variables all queries are compiled with.
+// Variables without a value are null.
+var Variables = []string{"$status"}
+
+type variablesContextKey struct{}
+
+// WithVariables returns a context under which queries are evaluated with the
+// given variable values, keyed by names like "$status".
+func WithVariables(ctx context.Context, values map[string]interface{}) context.Context {
+	return context.WithValue(ctx, variablesContextKey{}, values)
+}
+
+// variableValues returns the values of Variables in order.
+func variableValues(ctx context.Context) []interface{} {
+	values, _ := ctx.Value(variablesContextKey{}).(map[string]interface{})
+	ordered := make([]interface{}, len(Variables))
+	for i, name := range Variables {
+		ordered[i] = values[name]
+	}
+	return ordered
+}
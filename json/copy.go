@@ -0,0 +1,34 @@
+package json
+
+// Copy returns a deep copy of the decoded value v, along with the key order of
+// the copied objects, as recorded for v by order. Queries may modify their
+// inputs in place, so values shared between evaluations are copied first.
+func Copy(v interface{}, order *KeyOrder) (interface{}, *KeyOrder) {
+	if order == nil {
+		return deepCopy(v, nil, nil), nil
+	}
+	copied := &KeyOrder{}
+	return deepCopy(v, order, copied), copied
+}
+
+func deepCopy(v interface{}, order *KeyOrder, copied *KeyOrder) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			object[key] = deepCopy(value, order, copied)
+		}
+		if keys, ok := order.Keys(v); ok {
+			copied.record(object, keys)
+		}
+		return object
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, value := range v {
+			array[i] = deepCopy(value, order, copied)
+		}
+		return array
+	default:
+		return v
+	}
+}
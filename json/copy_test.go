@@ -0,0 +1,28 @@
+package json
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	value, order, err := ParseOrdered(strings.NewReader(`{"b": [{"d": 1, "c": 2}], "a": null}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	copied, copiedOrder := Copy(value, order)
+	if !reflect.DeepEqual(copied, value) {
+		t.Fatalf("Unexpected copy: %v", copied)
+	}
+
+	value.(map[string]interface{})["b"].([]interface{})[0].(map[string]interface{})["c"] = 3
+	if actual := copied.(map[string]interface{})["b"].([]interface{})[0].(map[string]interface{})["c"]; actual == 3 {
+		t.Errorf("Copy shares objects with the original")
+	}
+
+	body, _ := Marshal(copied, Format{}, copiedOrder)
+	if actual, expected := string(body), `{"b":[{"d":1,"c":2}],"a":null}`; actual != expected {
+		t.Errorf("Unexpected key order %s; expected %s", actual, expected)
+	}
+}
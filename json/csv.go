@@ -0,0 +1,62 @@
+package json
+
+import (
+	"encoding/csv"
+	"io"
+)
+
+// ParseCSV decodes CSV with a header row into an array of objects, one per
+// record, keyed by the header fields in their order. All values are strings.
+func ParseCSV(reader io.Reader) (interface{}, *KeyOrder, error) {
+	stream := NewCSVStream(reader)
+	records := make([]interface{}, 0)
+	for {
+		record, err := stream.Next()
+		if err == io.EOF {
+			return records, stream.order, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// CSVStream decodes the records of CSV with a header row one at a time, like
+// the elements of the array ParseCSV returns.
+type CSVStream struct {
+	reader *csv.Reader
+	header []string
+	order  *KeyOrder
+}
+
+// NewCSVStream returns a new CSVStream reading from reader.
+func NewCSVStream(reader io.Reader) *CSVStream {
+	return &CSVStream{reader: csv.NewReader(reader), order: &KeyOrder{}}
+}
+
+// Next returns the next record as an object.
+func (s *CSVStream) Next() (interface{}, error) {
+	if s.header == nil {
+		header, err := s.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		s.header = header
+		s.reader.ReuseRecord = true
+	}
+	fields, err := s.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	record := make(map[string]interface{}, len(fields))
+	var keys []string
+	for i, field := range fields {
+		if _, ok := record[s.header[i]]; !ok {
+			keys = append(keys, s.header[i])
+		}
+		record[s.header[i]] = field
+	}
+	s.order.record(record, keys)
+	return record, nil
+}
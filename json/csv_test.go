@@ -0,0 +1,23 @@
+package json
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCSV(t *testing.T) {
+	result, order, err := ParseCSV(strings.NewReader("name,id\nfoo,1\n\"b,ar\",2\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	text, _ := Marshal(result, Format{}, order)
+	if actual, expected := string(text), `[{"name":"foo","id":"1"},{"name":"b,ar","id":"2"}]`; actual != expected {
+		t.Errorf("Unexpected result: %s\n", actual)
+	}
+}
+
+func TestParseCSVFieldCount(t *testing.T) {
+	if _, _, err := ParseCSV(strings.NewReader("name,id\nfoo\n")); err == nil {
+		t.Errorf("Expected error")
+	}
+}
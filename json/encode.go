@@ -0,0 +1,235 @@
+package json
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Format controls how values are encoded. The zero value encodes compactly
+// without HTML escaping.
+type Format struct {
+	// Indent is the number of spaces to indent with. Zero encodes compactly.
+	Indent int
+
+	// Tab indents with one tab per level instead of spaces.
+	Tab bool
+
+	// SortKeys sorts object keys, even if their decoding order is known.
+	SortKeys bool
+
+	// ASCII escapes all non-ASCII characters.
+	ASCII bool
+
+	// EscapeHTML escapes <, > and & in strings.
+	EscapeHTML bool
+}
+
+func (f Format) indented() bool {
+	return f.Tab || f.Indent > 0
+}
+
+// Marshal returns the JSON encoding of v according to format. Objects whose
+// key order was recorded in order are encoded in that order, others with
+// sorted keys.
+func Marshal(v interface{}, format Format, order *KeyOrder) ([]byte, error) {
+	e := encoder{format: format, order: order}
+	if err := e.encode(v, 0); err != nil {
+		return nil, err
+	}
+	return e.buffer.Bytes(), nil
+}
+
+type encoder struct {
+	buffer bytes.Buffer
+	format Format
+	order  *KeyOrder
+}
+
+func (e *encoder) encode(v interface{}, depth int) error {
+	switch v := v.(type) {
+	case nil:
+		e.buffer.WriteString("null")
+	case bool:
+		e.buffer.WriteString(strconv.FormatBool(v))
+	case int:
+		e.buffer.WriteString(strconv.Itoa(v))
+	case float64:
+		e.encodeFloat(v)
+	case *big.Int:
+		e.buffer.WriteString(v.String())
+	case json.Number:
+		e.buffer.WriteString(v.String())
+	case string:
+		e.encodeString(v)
+	case []interface{}:
+		return e.encodeArray(v, depth)
+	case map[string]interface{}:
+		return e.encodeObject(v, depth)
+	default:
+		return e.encodeOther(v, depth)
+	}
+	return nil
+}
+
+// encodeFloat formats like encoding/json, but encodes NaN as null and
+// truncates infinities like jq does.
+func (e *encoder) encodeFloat(f float64) {
+	if math.IsNaN(f) {
+		e.buffer.WriteString("null")
+		return
+	}
+	if math.IsInf(f, 0) {
+		f = math.Copysign(math.MaxFloat64, f)
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	b := strconv.AppendFloat(nil, f, format, -1, 64)
+	if format == 'e' {
+		// Clean up e-09 to e-9.
+		n := len(b)
+		if n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	e.buffer.Write(b)
+}
+
+const hex = "0123456789abcdef"
+
+func (e *encoder) encodeString(s string) {
+	e.buffer.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '"' || r == '\\':
+			e.buffer.WriteByte('\\')
+			e.buffer.WriteByte(byte(r))
+		case r == '\n':
+			e.buffer.WriteString(`\n`)
+		case r == '\r':
+			e.buffer.WriteString(`\r`)
+		case r == '\t':
+			e.buffer.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			e.writeUnicodeEscape(r)
+		case e.format.EscapeHTML && (r == '<' || r == '>' || r == '&'):
+			e.writeUnicodeEscape(r)
+		case r == utf8.RuneError && size == 1:
+			e.buffer.WriteString(`\ufffd`)
+		case r == '\u2028' || r == '\u2029':
+			e.writeUnicodeEscape(r)
+		case e.format.ASCII && r >= utf8.RuneSelf:
+			if r > 0xffff {
+				r -= 0x10000
+				e.writeUnicodeEscape(0xd800 + (r>>10)&0x3ff)
+				e.writeUnicodeEscape(0xdc00 + r&0x3ff)
+			} else {
+				e.writeUnicodeEscape(r)
+			}
+		default:
+			e.buffer.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	e.buffer.WriteByte('"')
+}
+
+func (e *encoder) writeUnicodeEscape(r rune) {
+	e.buffer.WriteString(`\u`)
+	for shift := 12; shift >= 0; shift -= 4 {
+		e.buffer.WriteByte(hex[(r>>uint(shift))&0xf])
+	}
+}
+
+func (e *encoder) encodeArray(array []interface{}, depth int) error {
+	if len(array) == 0 {
+		e.buffer.WriteString("[]")
+		return nil
+	}
+	e.buffer.WriteByte('[')
+	for i, element := range array {
+		if i > 0 {
+			e.buffer.WriteByte(',')
+		}
+		e.writeNewline(depth + 1)
+		if err := e.encode(element, depth+1); err != nil {
+			return err
+		}
+	}
+	e.writeNewline(depth)
+	e.buffer.WriteByte(']')
+	return nil
+}
+
+func (e *encoder) encodeObject(object map[string]interface{}, depth int) error {
+	if len(object) == 0 {
+		e.buffer.WriteString("{}")
+		return nil
+	}
+	keys, ok := e.order.Keys(object)
+	if !ok || e.format.SortKeys {
+		keys = make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+	e.buffer.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			e.buffer.WriteByte(',')
+		}
+		e.writeNewline(depth + 1)
+		e.encodeString(key)
+		e.buffer.WriteByte(':')
+		if e.format.indented() {
+			e.buffer.WriteByte(' ')
+		}
+		if err := e.encode(object[key], depth+1); err != nil {
+			return err
+		}
+	}
+	e.writeNewline(depth)
+	e.buffer.WriteByte('}')
+	return nil
+}
+
+// encodeOther encodes values of types gojq does not emit with encoding/json.
+func (e *encoder) encodeOther(v interface{}, depth int) error {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(e.format.EscapeHTML)
+	if err := encoder.Encode(v); err != nil {
+		return err
+	}
+	text := bytes.TrimRight(buffer.Bytes(), "\n")
+	if !e.format.indented() {
+		e.buffer.Write(text)
+		return nil
+	}
+	return json.Indent(&e.buffer, text, e.indentation(depth), e.indentation(1))
+}
+
+func (e *encoder) writeNewline(depth int) {
+	if !e.format.indented() {
+		return
+	}
+	e.buffer.WriteByte('\n')
+	e.buffer.WriteString(e.indentation(depth))
+}
+
+func (e *encoder) indentation(depth int) string {
+	if e.format.Tab {
+		return strings.Repeat("\t", depth)
+	}
+	return strings.Repeat(" ", depth*e.format.Indent)
+}
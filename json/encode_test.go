@@ -0,0 +1,70 @@
+package json
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarshalPreservesKeyOrder(t *testing.T) {
+	input, order, err := ParseOrdered(strings.NewReader(`{"b": 1, "a": {"z": [true, null], "y": "x"}}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	result, err := Marshal(input, Format{}, order)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if actual, expected := string(result), `{"b":1,"a":{"z":[true,null],"y":"x"}}`; actual != expected {
+		t.Errorf("Unexpected result: %s\n", actual)
+	}
+}
+
+func TestMarshalSortKeys(t *testing.T) {
+	input, order, _ := ParseOrdered(strings.NewReader(`{"b": 1, "a": 2}`))
+	result, _ := Marshal(input, Format{SortKeys: true}, order)
+	if actual, expected := string(result), `{"a":2,"b":1}`; actual != expected {
+		t.Errorf("Unexpected result: %s\n", actual)
+	}
+}
+
+func TestMarshalUnknownOrder(t *testing.T) {
+	result, _ := Marshal(map[string]interface{}{"b": 1, "a": 2}, Format{}, nil)
+	if actual, expected := string(result), `{"a":2,"b":1}`; actual != expected {
+		t.Errorf("Unexpected result: %s\n", actual)
+	}
+}
+
+func TestMarshalIndent(t *testing.T) {
+	value := map[string]interface{}{"a": []interface{}{1, map[string]interface{}{}}}
+	result, _ := Marshal(value, Format{Indent: 2}, nil)
+	if actual, expected := string(result), "{\n  \"a\": [\n    1,\n    {}\n  ]\n}"; actual != expected {
+		t.Errorf("Unexpected result: %q\n", actual)
+	}
+	result, _ = Marshal(value, Format{Tab: true}, nil)
+	if actual, expected := string(result), "{\n\t\"a\": [\n\t\t1,\n\t\t{}\n\t]\n}"; actual != expected {
+		t.Errorf("Unexpected result: %q\n", actual)
+	}
+}
+
+func TestMarshalEscaping(t *testing.T) {
+	value := "<a & b> é 😀"
+	result, _ := Marshal(value, Format{}, nil)
+	if actual, expected := string(result), `"<a & b> é 😀"`; actual != expected {
+		t.Errorf("Unexpected result: %s\n", actual)
+	}
+	result, _ = Marshal(value, Format{EscapeHTML: true}, nil)
+	if actual, expected := string(result), `"\u003ca \u0026 b\u003e é 😀"`; actual != expected {
+		t.Errorf("Unexpected result: %s\n", actual)
+	}
+	result, _ = Marshal(value, Format{ASCII: true}, nil)
+	if actual, expected := string(result), `"<a & b> \u00e9 \ud83d\ude00"`; actual != expected {
+		t.Errorf("Unexpected result: %s\n", actual)
+	}
+}
+
+func TestMarshalFloats(t *testing.T) {
+	result, _ := Marshal([]interface{}{1.5, 1e21, 1.5e-7, 100.0}, Format{}, nil)
+	if actual, expected := string(result), `[1.5,1e+21,1.5e-7,100]`; actual != expected {
+		t.Errorf("Unexpected result: %s\n", actual)
+	}
+}
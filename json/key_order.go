@@ -0,0 +1,44 @@
+package json
+
+import (
+	"reflect"
+)
+
+// KeyOrder records the key order of decoded objects. gojq represents objects
+// as maps, but passes decoded maps through evaluation unchanged unless a query
+// modifies them, so their original key order can be looked up when encoding
+// results. The zero value records nothing, and a nil KeyOrder is valid.
+type KeyOrder struct {
+	objects map[uintptr]orderedObject
+}
+
+type orderedObject struct {
+	// object keeps the map alive, so that its address is not reused.
+	object map[string]interface{}
+	keys   []string
+}
+
+func (o *KeyOrder) record(object map[string]interface{}, keys []string) {
+	if o.objects == nil {
+		o.objects = make(map[uintptr]orderedObject)
+	}
+	o.objects[reflect.ValueOf(object).Pointer()] = orderedObject{object: object, keys: keys}
+}
+
+// Keys returns the keys of object in decoding order. If object was not decoded
+// or its keys changed since, it returns false.
+func (o *KeyOrder) Keys(object map[string]interface{}) ([]string, bool) {
+	if o == nil || o.objects == nil {
+		return nil, false
+	}
+	entry, ok := o.objects[reflect.ValueOf(object).Pointer()]
+	if !ok || len(entry.keys) != len(object) {
+		return nil, false
+	}
+	for _, key := range entry.keys {
+		if _, ok := object[key]; !ok {
+			return nil, false
+		}
+	}
+	return entry.keys, true
+}
@@ -0,0 +1,45 @@
+package json
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ParseNDJSON decodes a sequence of top-level JSON values, such as
+// newline-delimited JSON, into an array like jq --slurp.
+func ParseNDJSON(reader io.Reader) (interface{}, *KeyOrder, error) {
+	stream := NewValueStream(reader)
+	values := make([]interface{}, 0)
+	for {
+		value, err := stream.Next()
+		if err == io.EOF {
+			return values, stream.order, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		values = append(values, value)
+	}
+}
+
+// ValueStream decodes a sequence of top-level JSON values, such as
+// newline-delimited JSON or concatenated JSON, one at a time.
+type ValueStream struct {
+	decoder *json.Decoder
+	order   *KeyOrder
+}
+
+// NewValueStream returns a new ValueStream reading from reader.
+func NewValueStream(reader io.Reader) *ValueStream {
+	return &ValueStream{decoder: newDecoder(reader), order: &KeyOrder{}}
+}
+
+// Next returns the next value.
+func (s *ValueStream) Next() (interface{}, error) {
+	return decodeOrdered(s.decoder, s.order)
+}
+
+// KeyOrder returns the key order of the objects decoded so far.
+func (s *ValueStream) KeyOrder() *KeyOrder {
+	return s.order
+}
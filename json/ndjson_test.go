@@ -0,0 +1,46 @@
+package json
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseNDJSON(t *testing.T) {
+	result, order, err := ParseNDJSON(strings.NewReader("{\"b\":1,\"a\":2}\n\n3\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	text, _ := Marshal(result, Format{}, order)
+	if actual, expected := string(text), `[{"b":1,"a":2},3]`; actual != expected {
+		t.Errorf("Unexpected result: %s\n", actual)
+	}
+}
+
+func TestValueStream(t *testing.T) {
+	stream := NewValueStream(strings.NewReader("1\n[2]\n"))
+	var count int
+	for {
+		_, err := stream.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %s\n", err)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Errorf("Unexpected value count: %d\n", count)
+	}
+}
+
+func TestValueStreamTruncated(t *testing.T) {
+	stream := NewValueStream(strings.NewReader(`{"a":1} {"a":`))
+	if _, err := stream.Next(); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if _, err := stream.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+}
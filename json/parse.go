@@ -21,9 +21,10 @@ var (
 // Parse returns parsed JSON. It decodes the first JSON data structure from
 // reader. If there is more than one structure in reader, it errors. If the data
 // structure is a primitive type, i.e. not an object or array, it errors.
+// Numbers are decoded losslessly as json.Number.
 func Parse(reader io.Reader) (interface{}, error) {
 	var result interface{}
-	decoder := json.NewDecoder(reader)
+	decoder := newDecoder(reader)
 	err := decoder.Decode(&result)
 	if err != nil {
 		return nil, err
@@ -40,3 +41,86 @@ func Parse(reader io.Reader) (interface{}, error) {
 	}
 	return result, nil
 }
+
+// newDecoder returns a decoder that decodes numbers as json.Number, which
+// gojq converts to int, float64 or *big.Int without loss of integer precision.
+func newDecoder(reader io.Reader) *json.Decoder {
+	decoder := json.NewDecoder(reader)
+	decoder.UseNumber()
+	return decoder
+}
+
+// ParseOrdered is like Parse, but additionally records the key order of the
+// decoded objects.
+func ParseOrdered(reader io.Reader) (interface{}, *KeyOrder, error) {
+	decoder := newDecoder(reader)
+	order := &KeyOrder{}
+	result, err := decodeOrdered(decoder, order)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch result.(type) {
+	case []interface{}, map[string]interface{}:
+	default:
+		return nil, nil, ErrPrimitiveRootType
+	}
+	if decoder.More() {
+		return nil, nil, ErrMultipleRoots
+	}
+	return result, order, nil
+}
+
+func decodeOrdered(decoder *json.Decoder, order *KeyOrder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		object := make(map[string]interface{})
+		var keys []string
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			value, err := decodeOrdered(decoder, order)
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			if _, ok := object[key.(string)]; !ok {
+				keys = append(keys, key.(string))
+			}
+			object[key.(string)] = value
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		order.record(object, keys)
+		return object, nil
+	case json.Delim('['):
+		array := make([]interface{}, 0)
+		for decoder.More() {
+			value, err := decodeOrdered(decoder, order)
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			array = append(array, value)
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return array, nil
+	default:
+		return token, nil
+	}
+}
+
+// unexpectedEOF reports the end of input within a value as an error, so that
+// it is not mistaken for the end of a sequence of values.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
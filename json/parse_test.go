@@ -1,6 +1,7 @@
 package json
 
 import (
+	"encoding/json"
 	"reflect"
 	"strings"
 	"testing"
@@ -53,3 +54,21 @@ func TestParsePrimitiveRoot(t *testing.T) {
 		t.Errorf("Unexpected result: %v\n", result)
 	}
 }
+
+func TestParseNumbers(t *testing.T) {
+	input := `[9007199254740993, 123456789012345678901234567890, 1.10, 1e3]`
+	reader := strings.NewReader(input)
+	result, err := Parse(reader)
+	if err != nil {
+		t.Errorf("Unexpected error: %s\n", err)
+	}
+	expected := []interface{}{
+		json.Number("9007199254740993"),
+		json.Number("123456789012345678901234567890"),
+		json.Number("1.10"),
+		json.Number("1e3"),
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Unexpected result: %v\n", result)
+	}
+}
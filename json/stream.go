@@ -0,0 +1,163 @@
+package json
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// ErrNotArray signals that a root data structure was expected to be an array.
+var ErrNotArray = errors.New("root type is not an array")
+
+// Stream yields JSON values decoded incrementally from a reader. Once the
+// reader is exhausted, Next returns io.EOF.
+type Stream interface {
+	Next() (interface{}, error)
+}
+
+// EventStream tokenizes JSON incrementally into [path, leaf] events like
+// jq --stream. Closing a non-empty array or object yields a [path] event, where
+// path points at its last element.
+type EventStream struct {
+	decoder *json.Decoder
+	frames  []*frame
+}
+
+type frame struct {
+	array     bool
+	index     int
+	key       string
+	expectKey bool
+}
+
+// NewEventStream returns a new EventStream reading from reader.
+func NewEventStream(reader io.Reader) *EventStream {
+	return &EventStream{decoder: newDecoder(reader)}
+}
+
+// Next returns the next event.
+func (s *EventStream) Next() (interface{}, error) {
+	for {
+		token, err := s.decoder.Token()
+		if err != nil {
+			if err == io.EOF && len(s.frames) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			s.beginValue()
+			if !s.decoder.More() {
+				// Consume the closing delimiter of the empty container.
+				if _, err := s.decoder.Token(); err != nil {
+					return nil, err
+				}
+				event := []interface{}{s.path(), emptyContainer(token)}
+				s.endValue()
+				return event, nil
+			}
+			array := token == json.Delim('[')
+			s.frames = append(s.frames, &frame{array: array, index: -1, expectKey: !array})
+		case json.Delim('}'), json.Delim(']'):
+			event := []interface{}{s.path()}
+			s.frames = s.frames[:len(s.frames)-1]
+			s.endValue()
+			return event, nil
+		default:
+			if top := s.top(); top != nil && top.expectKey {
+				top.key = token.(string)
+				top.expectKey = false
+				continue
+			}
+			s.beginValue()
+			event := []interface{}{s.path(), token}
+			s.endValue()
+			return event, nil
+		}
+	}
+}
+
+func (s *EventStream) top() *frame {
+	if len(s.frames) == 0 {
+		return nil
+	}
+	return s.frames[len(s.frames)-1]
+}
+
+func (s *EventStream) beginValue() {
+	if top := s.top(); top != nil && top.array {
+		top.index++
+	}
+}
+
+func (s *EventStream) endValue() {
+	if top := s.top(); top != nil && !top.array {
+		top.expectKey = true
+	}
+}
+
+func (s *EventStream) path() []interface{} {
+	path := make([]interface{}, 0, len(s.frames))
+	for _, f := range s.frames {
+		if f.array {
+			path = append(path, f.index)
+		} else {
+			path = append(path, f.key)
+		}
+	}
+	return path
+}
+
+func emptyContainer(delim json.Token) interface{} {
+	if delim == json.Delim('[') {
+		return []interface{}{}
+	}
+	return map[string]interface{}{}
+}
+
+// ElementStream decodes the elements of a top-level array one at a time.
+type ElementStream struct {
+	decoder *json.Decoder
+	started bool
+	done    bool
+}
+
+// NewElementStream returns a new ElementStream reading from reader.
+func NewElementStream(reader io.Reader) *ElementStream {
+	return &ElementStream{decoder: newDecoder(reader)}
+}
+
+// Next returns the next array element. If the root data structure is not an
+// array, it errors.
+func (s *ElementStream) Next() (interface{}, error) {
+	if s.done {
+		return nil, io.EOF
+	}
+	if !s.started {
+		token, err := s.decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if token != json.Delim('[') {
+			return nil, ErrNotArray
+		}
+		s.started = true
+	}
+	if !s.decoder.More() {
+		if _, err := s.decoder.Token(); err != nil {
+			return nil, err
+		}
+		s.done = true
+		if s.decoder.More() {
+			return nil, ErrMultipleRoots
+		}
+		return nil, io.EOF
+	}
+	var element interface{}
+	if err := s.decoder.Decode(&element); err != nil {
+		return nil, err
+	}
+	return element, nil
+}
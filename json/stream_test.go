@@ -0,0 +1,80 @@
+package json
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func collect(t *testing.T, stream Stream) []interface{} {
+	var values []interface{}
+	for {
+		value, err := stream.Next()
+		if err == io.EOF {
+			return values
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %s\n", err)
+		}
+		values = append(values, value)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	input := `{"a": [1, {"b": null}], "c": [], "d": "e"}`
+	events := collect(t, NewEventStream(strings.NewReader(input)))
+	expected := []interface{}{
+		[]interface{}{[]interface{}{"a", 0}, json.Number("1")},
+		[]interface{}{[]interface{}{"a", 1, "b"}, nil},
+		[]interface{}{[]interface{}{"a", 1, "b"}},
+		[]interface{}{[]interface{}{"a", 1}},
+		[]interface{}{[]interface{}{"c"}, []interface{}{}},
+		[]interface{}{[]interface{}{"d"}, "e"},
+		[]interface{}{[]interface{}{"d"}},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Unexpected events: %v\n", events)
+	}
+}
+
+func TestEventStreamPrimitiveRoot(t *testing.T) {
+	events := collect(t, NewEventStream(strings.NewReader(`"foobar"`)))
+	expected := []interface{}{[]interface{}{[]interface{}{}, "foobar"}}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Unexpected events: %v\n", events)
+	}
+}
+
+func TestEventStreamTruncated(t *testing.T) {
+	stream := NewEventStream(strings.NewReader(`[1, 2`))
+	var err error
+	for err == nil {
+		_, err = stream.Next()
+	}
+	if err == io.EOF {
+		t.Errorf("Truncated input not detected")
+	}
+}
+
+func TestElementStream(t *testing.T) {
+	input := `[{"id": 1}, 2, [3]]`
+	elements := collect(t, NewElementStream(strings.NewReader(input)))
+	expected := []interface{}{
+		map[string]interface{}{"id": json.Number("1")},
+		json.Number("2"),
+		[]interface{}{json.Number("3")},
+	}
+	if !reflect.DeepEqual(elements, expected) {
+		t.Errorf("Unexpected elements: %v\n", elements)
+	}
+}
+
+func TestElementStreamObjectRoot(t *testing.T) {
+	stream := NewElementStream(strings.NewReader(`{"id": 1}`))
+	_, err := stream.Next()
+	if err != ErrNotArray {
+		t.Errorf("Unexpected error: %s\n", err)
+	}
+}
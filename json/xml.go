@@ -0,0 +1,106 @@
+package json
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// ParseXML decodes an XML document into an object with the root element's
+// name as its only key. Elements are mapped as follows, ignoring namespaces:
+//
+//   - An element without attributes and child elements maps to its text.
+//   - Any other element maps to an object. Attributes map to keys prefixed
+//     with "@", child elements to keys named after them, and non-blank text
+//     to the "#text" key.
+//   - Repeated child elements of the same name map to an array.
+//
+// All values are strings, and text is trimmed of surrounding whitespace.
+func ParseXML(reader io.Reader) (interface{}, *KeyOrder, error) {
+	decoder := xml.NewDecoder(reader)
+	order := &KeyOrder{}
+	var root map[string]interface{}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if root != nil {
+			return nil, nil, ErrMultipleRoots
+		}
+		value, err := decodeElement(decoder, start, order)
+		if err != nil {
+			return nil, nil, err
+		}
+		root = map[string]interface{}{start.Name.Local: value}
+		order.record(root, []string{start.Name.Local})
+	}
+	if root == nil {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return root, order, nil
+}
+
+func decodeElement(decoder *xml.Decoder, start xml.StartElement, order *KeyOrder) (interface{}, error) {
+	object := make(map[string]interface{})
+	var keys []string
+	set := func(key string, value interface{}) {
+		if _, ok := object[key]; !ok {
+			keys = append(keys, key)
+		}
+		object[key] = value
+	}
+
+	for _, attr := range start.Attr {
+		if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+			continue
+		}
+		set("@"+attr.Name.Local, attr.Value)
+	}
+
+	var text strings.Builder
+	repeated := make(map[string]bool)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			value, err := decodeElement(decoder, token, order)
+			if err != nil {
+				return nil, err
+			}
+			name := token.Name.Local
+			existing, ok := object[name]
+			switch {
+			case !ok:
+				set(name, value)
+			case repeated[name]:
+				object[name] = append(existing.([]interface{}), value)
+			default:
+				object[name] = []interface{}{existing, value}
+				repeated[name] = true
+			}
+		case xml.CharData:
+			text.Write(token)
+		case xml.EndElement:
+			trimmed := strings.TrimSpace(text.String())
+			if len(object) == 0 {
+				return trimmed, nil
+			}
+			if trimmed != "" {
+				set("#text", trimmed)
+			}
+			order.record(object, keys)
+			return object, nil
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package json
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseXML(t *testing.T) {
+	input := `<?xml version="1.0"?>
+<feed xmlns="http://www.w3.org/2005/Atom" lang="en">
+  <title>News</title>
+  <entry id="2"><title>b</title></entry>
+  <entry id="1">a<empty/></entry>
+</feed>`
+	result, order, err := ParseXML(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	text, _ := Marshal(result, Format{}, order)
+	expected := `{"feed":{"@lang":"en","title":"News","entry":[{"@id":"2","title":"b"},{"@id":"1","empty":"","#text":"a"}]}}`
+	if actual := string(text); actual != expected {
+		t.Errorf("Unexpected result: %s\n", actual)
+	}
+}
+
+func TestParseXMLEmpty(t *testing.T) {
+	if _, _, err := ParseXML(strings.NewReader(`<?xml version="1.0"?>`)); err == nil {
+		t.Errorf("Expected error")
+	}
+}
@@ -0,0 +1,136 @@
+package json
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"time"
+)
+
+// ParseYAML decodes a YAML document, recording the key order of mappings.
+// Like Parse, it errors on primitive root types and multiple documents.
+// Mapping keys are converted to strings and timestamps to RFC 3339 strings.
+// Aliases are resolved, and merge keys merged in place.
+func ParseYAML(reader io.Reader) (interface{}, *KeyOrder, error) {
+	decoder := yaml.NewDecoder(reader)
+	var document yaml.Node
+	if err := decoder.Decode(&document); err != nil {
+		if err == io.EOF {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	root := resolveYAML(&document)
+	if root.Kind != yaml.MappingNode && root.Kind != yaml.SequenceNode {
+		return nil, nil, ErrPrimitiveRootType
+	}
+	var next yaml.Node
+	if err := decoder.Decode(&next); err != io.EOF {
+		return nil, nil, ErrMultipleRoots
+	}
+	order := &KeyOrder{}
+	result, err := fromYAML(root, order)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, order, nil
+}
+
+// resolveYAML returns the node a document or alias node stands for.
+func resolveYAML(node *yaml.Node) *yaml.Node {
+	for {
+		switch {
+		case node.Kind == yaml.DocumentNode && len(node.Content) == 1:
+			node = node.Content[0]
+		case node.Kind == yaml.AliasNode && node.Alias != nil:
+			node = node.Alias
+		default:
+			return node
+		}
+	}
+}
+
+func fromYAML(node *yaml.Node, order *KeyOrder) (interface{}, error) {
+	node = resolveYAML(node)
+	switch node.Kind {
+	case yaml.SequenceNode:
+		array := make([]interface{}, 0, len(node.Content))
+		for _, element := range node.Content {
+			value, err := fromYAML(element, order)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	case yaml.MappingNode:
+		object := make(map[string]interface{}, len(node.Content)/2)
+		var keys []string
+		if err := addYAMLPairs(node, object, &keys, order, false); err != nil {
+			return nil, err
+		}
+		order.record(object, keys)
+		return object, nil
+	}
+	var value interface{}
+	if err := node.Decode(&value); err != nil {
+		return nil, err
+	}
+	return fromYAMLScalar(value), nil
+}
+
+// addYAMLPairs adds the key-value pairs of a mapping node to object, in order.
+// Merged pairs do not override existing keys.
+func addYAMLPairs(node *yaml.Node, object map[string]interface{}, keys *[]string, order *KeyOrder, merged bool) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		if keyNode.Kind == yaml.ScalarNode && keyNode.Tag == "!!merge" {
+			if err := mergeYAML(valueNode, object, keys, order); err != nil {
+				return err
+			}
+			continue
+		}
+		var rawKey interface{}
+		if err := keyNode.Decode(&rawKey); err != nil {
+			return err
+		}
+		key := fmt.Sprint(fromYAMLScalar(rawKey))
+		if _, ok := object[key]; ok && merged {
+			continue
+		}
+		value, err := fromYAML(valueNode, order)
+		if err != nil {
+			return err
+		}
+		if _, ok := object[key]; !ok {
+			*keys = append(*keys, key)
+		}
+		object[key] = value
+	}
+	return nil
+}
+
+// mergeYAML merges the mapping, or sequence of mappings, of a merge key into
+// object.
+func mergeYAML(node *yaml.Node, object map[string]interface{}, keys *[]string, order *KeyOrder) error {
+	node = resolveYAML(node)
+	switch node.Kind {
+	case yaml.MappingNode:
+		return addYAMLPairs(node, object, keys, order, true)
+	case yaml.SequenceNode:
+		for _, element := range node.Content {
+			if err := mergeYAML(element, object, keys, order); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("yaml: line %d: map merge requires map or sequence of maps as the value", node.Line)
+}
+
+func fromYAMLScalar(value interface{}) interface{} {
+	if t, ok := value.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	return value
+}
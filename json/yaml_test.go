@@ -0,0 +1,42 @@
+package json
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	input := "items:\n  - id: 1\n    1: one\n    at: 2021-03-05T10:00:00Z\n"
+	result, _, err := ParseYAML(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	expected := map[string]interface{}{"items": []interface{}{
+		map[string]interface{}{"id": 1, "1": "one", "at": "2021-03-05T10:00:00Z"},
+	}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Unexpected result: %v\n", result)
+	}
+}
+
+func TestParseYAMLRoots(t *testing.T) {
+	if _, _, err := ParseYAML(strings.NewReader("42\n")); err != ErrPrimitiveRootType {
+		t.Errorf("Unexpected error: %s\n", err)
+	}
+	if _, _, err := ParseYAML(strings.NewReader("a: 1\n---\nb: 2\n")); err != ErrMultipleRoots {
+		t.Errorf("Unexpected error: %s\n", err)
+	}
+}
+
+func TestParseYAMLKeyOrder(t *testing.T) {
+	input := "base: &base {z: 1, y: 2}\nitem:\n  b: 1\n  <<: *base\n  y: 3\n  a: 4\n"
+	result, order, err := ParseYAML(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	encoded, _ := Marshal(result, Format{}, order)
+	if actual, expected := string(encoded), `{"base":{"z":1,"y":2},"item":{"b":1,"z":1,"y":3,"a":4}}`; actual != expected {
+		t.Errorf("Unexpected encoding %s; expected %s\n", actual, expected)
+	}
+}
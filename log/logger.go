@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
 )
 
 // Level is a log level.
@@ -31,9 +32,35 @@ const (
 	Error
 )
 
+// ParseLevel returns the level named value, i.e. "debug", "info" or "error".
+func ParseLevel(value string) (Level, bool) {
+	switch value {
+	case "debug":
+		return Debug, true
+	case "info":
+		return Info, true
+	case "error":
+		return Error, true
+	}
+	return Error, false
+}
+
+// Name returns the name of the level as parsed by ParseLevel.
+func (l Level) Name() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	default:
+		return "error"
+	}
+}
+
 // Logger is a levelled logger.
 type Logger struct {
 	logger *log.Logger
+	mu     sync.RWMutex
 	Level
 }
 
@@ -60,8 +87,22 @@ func (l *Logger) Error(msg string) {
 	l.log(Error, msg)
 }
 
+// SetLevel changes the level of a logger in use.
+func (l *Logger) SetLevel(level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Level = level
+}
+
+// CurrentLevel returns the level of a logger in use.
+func (l *Logger) CurrentLevel() Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.Level
+}
+
 func (l *Logger) log(level Level, msg string) {
-	if level < l.Level {
+	if level < l.CurrentLevel() {
 		return
 	}
 	l.logger.Printf(fmt.Sprintf("[%s] %s", level, msg))
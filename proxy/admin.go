@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/bauerd/jqrp/log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultTopQueries is the number of queries listed by the query statistics
+// endpoint, unless the limit parameter says otherwise.
+const defaultTopQueries = 10
+
+// Admin is the admin API of a running jqrp, which inspects and purges its
+// caches, shows its configuration, changes its log level and lists its top
+// queries and evaluation load. Requests must carry the admin token as bearer
+// token.
+type Admin struct {
+	config     *Config
+	components *Components
+	logger     *log.Logger
+	mux        *http.ServeMux
+}
+
+// NewAdmin returns the admin API of the proxy configured by config, which uses
+// the given components.
+func NewAdmin(config *Config, components *Components, logger *log.Logger) *Admin {
+	admin := &Admin{config: config, components: components, logger: logger, mux: http.NewServeMux()}
+	admin.mux.HandleFunc("/queries", admin.queries)
+	admin.mux.HandleFunc("/responses", admin.responses)
+	admin.mux.HandleFunc("/config", admin.settings)
+	admin.mux.HandleFunc("/log-level", admin.logLevel)
+	admin.mux.HandleFunc("/stats/queries", admin.queryStats)
+	admin.mux.HandleFunc("/stats/evaluations", admin.evaluationStats)
+	return admin
+}
+
+// ServeHTTP serves the admin API to authorized requests.
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="jqrp admin"`)
+		writeProblem(w, 401, "Missing or invalid admin token")
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *Admin) authorized(r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return a.config.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(a.config.AdminToken)) == 1
+}
+
+// queries lists the compiled query cache on GET, and purges it on DELETE,
+// or only the query given as query parameter.
+func (a *Admin) queries(w http.ResponseWriter, r *http.Request) {
+	cache := a.components.QueryCache
+	if cache == nil {
+		writeProblem(w, 404, "Query cache is disabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, cache.Snapshot())
+	case http.MethodDelete:
+		if query, ok := r.URL.Query()["query"]; ok {
+			if !cache.Purge(query[0]) {
+				writeProblem(w, 404, "Query is not cached")
+				return
+			}
+			a.logger.Info(fmt.Sprintf("Purged query %q from query cache", query[0]))
+			writeJSON(w, map[string]int{"purged": 1})
+			return
+		}
+		purged := cache.PurgeAll()
+		a.logger.Info(fmt.Sprintf("Purged %d queries from query cache", purged))
+		writeJSON(w, map[string]int{"purged": purged})
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// responses purges the responses to requests whose URL starts with the prefix
+// query parameter from the response cache.
+func (a *Admin) responses(w http.ResponseWriter, r *http.Request) {
+	cache := a.components.ResponseCache
+	if cache == nil {
+		writeProblem(w, 404, "Response cache is disabled")
+		return
+	}
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodDelete)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	purged := cache.Purge(prefix)
+	a.logger.Info(fmt.Sprintf("Purged %d responses with prefix %q from response cache", purged, prefix))
+	writeJSON(w, map[string]int{"purged": purged})
+}
+
+// settings shows the effective configuration.
+func (a *Admin) settings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	settings := a.config.Settings()
+	settings["LOG_LEVEL"] = a.logger.CurrentLevel().Name()
+	writeJSON(w, settings)
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// logLevel shows the log level on GET, and changes it on PUT.
+func (a *Admin) logLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body logLevel
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeProblem(w, 400, err.Error())
+			return
+		}
+		level, ok := log.ParseLevel(body.Level)
+		if !ok {
+			writeProblem(w, 400, fmt.Sprintf("Unknown log level %q", body.Level))
+			return
+		}
+		a.logger.SetLevel(level)
+		a.logger.Info(fmt.Sprintf("Changed log level to %s", level.Name()))
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut)
+		return
+	}
+	writeJSON(w, logLevel{Level: a.logger.CurrentLevel().Name()})
+}
+
+// queryStats lists the top queries by count, or by total evaluation time if
+// the by parameter is "time".
+func (a *Admin) queryStats(w http.ResponseWriter, r *http.Request) {
+	stats := a.components.QueryStats
+	if stats == nil {
+		writeProblem(w, 404, "Query statistics are disabled")
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	limit := defaultTopQueries
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeProblem(w, 400, fmt.Sprintf("Invalid limit %q", value))
+			return
+		}
+	}
+	switch by := r.URL.Query().Get("by"); by {
+	case "", "count":
+		writeJSON(w, map[string]interface{}{"queries": stats.TopByCount(limit)})
+	case "time":
+		writeJSON(w, map[string]interface{}{"queries": stats.TopByTime(limit)})
+	default:
+		writeProblem(w, 400, fmt.Sprintf("Invalid order %q", by))
+	}
+}
+
+// evaluationStats shows the active, queued and rejected evaluations.
+func (a *Admin) evaluationStats(w http.ResponseWriter, r *http.Request) {
+	pool := a.components.EvaluatorPool
+	if pool == nil {
+		writeProblem(w, 404, "Evaluation limit is disabled")
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, pool.Stats())
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeProblem(w, 405, "")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeProblem(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/bauerd/jqrp/log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminRequest(admin *Admin, method string, target string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	admin := NewAdmin(&Config{AdminToken: "secret"}, &Components{}, log.New(log.Error))
+	for _, authorization := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest("GET", "/config", nil)
+		req.Header.Set("Authorization", authorization)
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, req)
+		if recorder.Code != 401 || recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Expected 401 for %q, got %d", authorization, recorder.Code)
+		}
+	}
+
+	admin = NewAdmin(&Config{}, &Components{}, log.New(log.Error))
+	req := httptest.NewRequest("GET", "/config", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, req)
+	if recorder.Code != 401 {
+		t.Errorf("Expected 401 without admin token configured, got %d", recorder.Code)
+	}
+}
+
+func TestAdminQueries(t *testing.T) {
+	config := &Config{CacheSize: 8, QueryStatsSize: 8, AdminToken: "secret"}
+	components, _ := config.Build()
+	for _, query := range []string{".a", ".a", ".b"} {
+		components.Evaluator.Evaluate(query, map[string]interface{}{})
+	}
+	admin := NewAdmin(config, components, log.New(log.Error))
+
+	recorder := adminRequest(admin, "GET", "/queries", "")
+	if recorder.Code != 200 || !strings.Contains(recorder.Body.String(), `"query":".a"`) {
+		t.Errorf("Unexpected query cache listing %d: %s", recorder.Code, recorder.Body)
+	}
+
+	recorder = adminRequest(admin, "GET", "/stats/queries?by=count&limit=1", "")
+	var stats struct {
+		Queries []struct {
+			Fingerprint string
+			Count       int
+		}
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &stats)
+	if len(stats.Queries) != 1 || stats.Queries[0].Fingerprint != ".a" || stats.Queries[0].Count != 2 {
+		t.Errorf("Unexpected query statistics: %s", recorder.Body)
+	}
+	if recorder = adminRequest(admin, "GET", "/stats/queries?by=size", ""); recorder.Code != 400 {
+		t.Errorf("Expected 400 for invalid order, got %d", recorder.Code)
+	}
+
+	if recorder = adminRequest(admin, "DELETE", "/queries?query=.c", ""); recorder.Code != 404 {
+		t.Errorf("Expected 404 for uncached query, got %d", recorder.Code)
+	}
+	if recorder = adminRequest(admin, "DELETE", "/queries?query=.a", ""); recorder.Code != 200 {
+		t.Errorf("Expected 200 for cached query, got %d", recorder.Code)
+	}
+	recorder = adminRequest(admin, "DELETE", "/queries", "")
+	if recorder.Body.String() != `{"purged":1}` {
+		t.Errorf("Unexpected purge response: %s", recorder.Body)
+	}
+	if recorder = adminRequest(admin, "POST", "/queries", ""); recorder.Code != 405 {
+		t.Errorf("Expected 405, got %d", recorder.Code)
+	}
+}
+
+func TestAdminResponses(t *testing.T) {
+	admin := NewAdmin(&Config{AdminToken: "secret"}, &Components{}, log.New(log.Error))
+	if recorder := adminRequest(admin, "DELETE", "/responses", ""); recorder.Code != 404 {
+		t.Errorf("Expected 404 with response cache disabled, got %d", recorder.Code)
+	}
+
+	config := &Config{ResponseCacheSize: 1000, AdminToken: "secret"}
+	components, _ := config.Build()
+	components.ResponseCache.add(&cachedResponse{key: "GET http://upstream/a", header: http.Header{}})
+	admin = NewAdmin(config, components, log.New(log.Error))
+	recorder := adminRequest(admin, "DELETE", "/responses?prefix=/a", "")
+	if recorder.Body.String() != `{"purged":1}` {
+		t.Errorf("Unexpected purge response: %s", recorder.Body)
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	admin := NewAdmin(&Config{AdminToken: "secret", Port: 8989}, &Components{}, log.New(log.Info))
+	recorder := adminRequest(admin, "GET", "/config", "")
+	var settings map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &settings)
+	if settings["ADMIN_TOKEN"] != "REDACTED" || settings["PORT"] != float64(8989) || settings["LOG_LEVEL"] != "info" {
+		t.Errorf("Unexpected configuration: %s", recorder.Body)
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	logger := log.New(log.Error)
+	admin := NewAdmin(&Config{AdminToken: "secret"}, &Components{}, logger)
+	recorder := adminRequest(admin, "PUT", "/log-level", `{"level": "debug"}`)
+	if recorder.Body.String() != `{"level":"debug"}` || logger.CurrentLevel() != log.Debug {
+		t.Errorf("Log level not changed: %s", recorder.Body)
+	}
+	if recorder = adminRequest(admin, "PUT", "/log-level", `{"level": "verbose"}`); recorder.Code != 400 {
+		t.Errorf("Expected 400 for unknown level, got %d", recorder.Code)
+	}
+	if recorder = adminRequest(admin, "GET", "/log-level", ""); recorder.Body.String() != `{"level":"debug"}` {
+		t.Errorf("Unexpected log level: %s", recorder.Body)
+	}
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"io"
+)
+
+// limitedBody reads from an upstream response body, erroring with
+// ErrResponseBodyTooLarge once more than limit bytes are read.
+type limitedBody struct {
+	reader io.Reader
+	limit  int64
+}
+
+// limitBody returns body limited to limit bytes, or body itself if limit is 0.
+func limitBody(body io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return body
+	}
+	return &limitedBody{reader: body, limit: limit}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.limit < 0 {
+		return 0, ErrResponseBodyTooLarge
+	}
+	// Read one byte past the limit to tell exhausted bodies from oversized.
+	if int64(len(p)) > b.limit+1 {
+		p = p[:b.limit+1]
+	}
+	n, err := b.reader.Read(p)
+	b.limit -= int64(n)
+	if b.limit < 0 {
+		return n + int(b.limit), ErrResponseBodyTooLarge
+	}
+	return n, err
+}
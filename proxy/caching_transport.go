@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// CachingTransport serves GET requests with a query from a response cache,
+// and caches the upstream responses it fetches. Other requests are passed
+// through, as the cache is meant to save fetching and parsing inputs, not to
+// be a general HTTP cache.
+type CachingTransport struct {
+	transport http.RoundTripper
+	cache     *ResponseCache
+}
+
+// NewCachingTransport returns a transport that caches the responses of the
+// given transport.
+func NewCachingTransport(transport http.RoundTripper, cache *ResponseCache) *CachingTransport {
+	return &CachingTransport{transport: transport, cache: cache}
+}
+
+// RoundTrip answers req from the cache, or else fetches the response.
+func (t *CachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" || req.Header.Get("Range") != "" || req.Context().Value(RawQueryContextKey) == nil {
+		return t.transport.RoundTrip(req)
+	}
+	if !noCache(req) {
+		if entry, ok := t.cache.get(req); ok {
+			return entry.response(req, t.cache.now()), nil
+		}
+	}
+
+	res, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	ttl, ok := t.cache.freshness(req, res)
+	if !ok {
+		return res, nil
+	}
+
+	// Bodies too large to be cached are passed on unread.
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, t.cache.maxSize+1))
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > t.cache.maxSize {
+		res.Body = readCloser{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return res, nil
+	}
+	res.Body.Close()
+
+	now := t.cache.now()
+	hash := sha256.Sum256(body)
+	vary := varyNames(res)
+	entry := &cachedResponse{
+		key:        variantKey(cacheKey(req), req, vary),
+		statusCode: res.StatusCode,
+		header:     res.Header,
+		body:       body,
+		hash:       hex.EncodeToString(hash[:]),
+		vary:       vary,
+		stored:     now,
+		expires:    now.Add(ttl),
+	}
+	t.cache.add(entry)
+	return entry.response(req, now), nil
+}
+
+// noCache reports whether req asks for a response fetched from upstream.
+func noCache(req *http.Request) bool {
+	if _, ok := cacheControl(req.Header)["no-cache"]; ok {
+		return true
+	}
+	return req.Header.Get("Pragma") == "no-cache"
+}
+
+// varyNames returns the canonical names of the request headers named by the
+// response's Vary header, sorted.
+func varyNames(res *http.Response) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, value := range res.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readCloser reads from one reader, and closes another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientContextKey is the context key the identity of the client is stored
+// under on requests.
+const clientContextKey contextKey = "CLIENT"
+
+// client identifies a client request in logs.
+type client struct {
+	RequestID string
+	Address   string
+}
+
+// clientOf identifies the client of r by its address as the trusted proxies
+// report it.
+func clientOf(r *http.Request, trusted []*net.IPNet) client {
+	return client{RequestID: r.Header.Get("X-Request-ID"), Address: trustedAddress(r, trusted)}
+}
+
+// identifyClient stores the identity of the client on requests before passing
+// them on to h.
+func identifyClient(h http.Handler, trusted []*net.IPNet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientContextKey, clientOf(r, trusted))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// remoteAddress returns the host of the remote address of r.
+func remoteAddress(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// trustedAddress returns the address of the client of r as the trusted
+// proxies in front of jqrp report it. Starting from the remote address,
+// X-Forwarded-For is walked from the right for as long as the address it was
+// received from is trusted, so that addresses the client prepended itself are
+// ignored.
+func trustedAddress(r *http.Request, trusted []*net.IPNet) string {
+	address := remoteAddress(r)
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && trustedProxy(address, trusted); i-- {
+		next := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(next) == nil {
+			break
+		}
+		address = next
+	}
+	return address
+}
+
+// trustedProxy reports whether address is in one of the trusted networks.
+func trustedProxy(address string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(address)
+	for _, network := range trusted {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientFromContext(ctx context.Context) client {
+	c, _ := ctx.Value(clientContextKey).(client)
+	return c
+}
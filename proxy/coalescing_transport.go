@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// coalescedHeaders are the request headers that commonly select between
+// representations, and so distinguish requests to be coalesced. Headers named
+// by the response's Vary header are compared once it arrives.
+var coalescedHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Authorization",
+	"Cookie",
+	"Range",
+	"If-None-Match",
+	"If-Modified-Since",
+}
+
+// CoalescingTransport coalesces concurrent identical GET and HEAD requests
+// into one upstream round trip, whose response body is fanned out to each
+// request.
+type CoalescingTransport struct {
+	transport     http.RoundTripper
+	maxBufferSize int64
+	mu            sync.Mutex
+	calls         map[string]*coalescedCall
+}
+
+// NewCoalescingTransport returns a transport that coalesces requests sent by
+// the given transport. Shared response bodies are buffered up to
+// maxBufferSize bytes, unless 0, until all requests have read them, and
+// requests falling further behind are detached. Bodies known to be larger are
+// not shared, and the other requests are sent separately.
+func NewCoalescingTransport(transport http.RoundTripper, maxBufferSize int64) *CoalescingTransport {
+	return &CoalescingTransport{
+		transport:     transport,
+		maxBufferSize: maxBufferSize,
+		calls:         map[string]*coalescedCall{},
+	}
+}
+
+// coalescedCall is an upstream round trip shared by several requests.
+type coalescedCall struct {
+	req  *http.Request
+	done chan struct{}
+	res  *http.Response
+	// body fans out the response body, if there is more than one reader.
+	body *sharedBody
+	err  error
+	// waiting counts the requests waiting for the response.
+	waiting int
+	// abandoned counts the requests no longer waiting for the response.
+	abandoned int
+	// counted is set once the waiting requests were counted as readers.
+	counted bool
+	// exclusive is set if the response body is too large to be shared, and
+	// goes to the first reader only.
+	exclusive bool
+	taken     bool
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+}
+
+// RoundTrip sends req upstream, unless an identical request is in flight, in
+// which case it shares that request's response.
+func (t *CoalescingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (req.Method != "GET" && req.Method != "HEAD") || (req.Body != nil && req.Body != http.NoBody) {
+		return t.transport.RoundTrip(req)
+	}
+
+	key := coalescingKey(req)
+	t.mu.Lock()
+	if call, ok := t.calls[key]; ok {
+		call.waiting++
+		t.mu.Unlock()
+		return t.wait(key, call, req)
+	}
+	// The shared round trip outlives any single request, and is canceled only
+	// once all requests are gone.
+	ctx, cancel := context.WithCancel(context.Background())
+	call := &coalescedCall{req: req, done: make(chan struct{}), waiting: 1, cancel: cancel}
+	t.calls[key] = call
+	t.mu.Unlock()
+
+	go t.roundTrip(key, call, req.Clone(ctx))
+	return t.wait(key, call, req)
+}
+
+// roundTrip sends the shared request, and hands the response to all requests
+// that joined until then.
+func (t *CoalescingTransport) roundTrip(key string, call *coalescedCall, req *http.Request) {
+	res, err := t.transport.RoundTrip(req)
+
+	t.mu.Lock()
+	if t.calls[key] == call {
+		delete(t.calls, key)
+	}
+	readers := call.waiting - call.abandoned
+	call.counted = true
+	t.mu.Unlock()
+
+	call.res, call.err = res, err
+	switch {
+	case err != nil:
+		call.cancel()
+	case readers == 0:
+		res.Body.Close()
+		call.cancel()
+	case readers == 1:
+		res.Body = &cancelingBody{res.Body, call.cancel}
+	case t.maxBufferSize > 0 && res.ContentLength > t.maxBufferSize:
+		res.Body = &cancelingBody{res.Body, call.cancel}
+		call.exclusive = true
+	default:
+		call.body = newSharedBody(&cancelingBody{res.Body, call.cancel}, readers, int(t.maxBufferSize))
+	}
+	close(call.done)
+}
+
+// wait waits for the shared response, and returns a copy of it to req. The
+// shared round trip is canceled once all requests stopped waiting for it.
+func (t *CoalescingTransport) wait(key string, call *coalescedCall, req *http.Request) (*http.Response, error) {
+	select {
+	case <-call.done:
+	case <-req.Context().Done():
+		t.mu.Lock()
+		if call.counted {
+			// The response arrived, and req was counted as a reader.
+			t.mu.Unlock()
+			<-call.done
+			if call.err == nil {
+				if body, ok := call.reader(); ok {
+					body.Close()
+				}
+			}
+		} else {
+			call.abandoned++
+			if call.abandoned == call.waiting {
+				if t.calls[key] == call {
+					delete(t.calls, key)
+				}
+				call.cancel()
+			}
+			t.mu.Unlock()
+		}
+		return nil, req.Context().Err()
+	}
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	body, ok := call.reader()
+	if !ok {
+		return t.transport.RoundTrip(req)
+	}
+	if !sameVariant(call.req, req, call.res) {
+		body.Close()
+		return t.transport.RoundTrip(req)
+	}
+	res := *call.res
+	res.Header = call.res.Header.Clone()
+	res.Trailer = call.res.Trailer.Clone()
+	res.Body = body
+	res.Request = req
+	return &res, nil
+}
+
+// reader returns a reader of the response body, unless the body is not shared
+// and was taken by another request, or the request fell behind the others
+// before reading it.
+func (c *coalescedCall) reader() (io.ReadCloser, bool) {
+	if c.exclusive {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.taken {
+			return nil, false
+		}
+		c.taken = true
+		return c.res.Body, true
+	}
+	if c.body == nil {
+		return c.res.Body, true
+	}
+	return c.body.reader()
+}
+
+// coalescingKey identifies the requests that may share a response.
+func coalescingKey(req *http.Request) string {
+	var key strings.Builder
+	key.WriteString(req.Method + " " + req.URL.String())
+	for _, name := range coalescedHeaders {
+		key.WriteString("\x00" + strings.Join(req.Header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// sameVariant reports whether the response to req would have been selected for
+// other too, as far as the response's Vary header tells.
+func sameVariant(req *http.Request, other *http.Request, res *http.Response) bool {
+	for _, value := range res.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return req == other
+			}
+			if strings.Join(req.Header.Values(name), ",") != strings.Join(other.Header.Values(name), ",") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// cancelingBody cancels the context of its request once closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingTransport counts round trips, and responds once released, unless
+// the request is canceled before.
+type blockingTransport struct {
+	mu       sync.Mutex
+	requests int
+	release  chan struct{}
+	header   http.Header
+	// length is the Content-Length of responses, if known.
+	length int64
+}
+
+func (t *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requests++
+	t.mu.Unlock()
+	select {
+	case <-t.release:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	length := t.length
+	if length == 0 {
+		length = -1
+	}
+	return &http.Response{
+		StatusCode:    200,
+		Header:        t.header.Clone(),
+		Body:          ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 100000))),
+		ContentLength: length,
+		Request:       req,
+	}, nil
+}
+
+// waitForWaiting waits until n requests wait for the response to req.
+func waitForWaiting(t *testing.T, transport *CoalescingTransport, req *http.Request, n int) {
+	for i := 0; i < 1000; i++ {
+		transport.mu.Lock()
+		call, ok := transport.calls[coalescingKey(req)]
+		waiting := ok && call.waiting == n
+		transport.mu.Unlock()
+		if waiting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Requests did not coalesce")
+}
+
+func TestCoalescingTransport(t *testing.T) {
+	for _, test := range []struct {
+		header        http.Header
+		length        int64
+		maxBufferSize int64
+		tenants       []string
+		requests      int
+	}{
+		{http.Header{}, 0, 0, []string{"a", "a", "a", "b"}, 1},
+		{http.Header{"Vary": {"X-Tenant"}}, 0, 0, []string{"a", "a", "a", "b"}, 2},
+		{http.Header{"Vary": {"*"}}, 0, 0, []string{"a", "a", "a", "a"}, 4},
+		{http.Header{}, 0, 1000, []string{"a", "a", "a"}, 1},
+		{http.Header{}, 100000, 100000, []string{"a", "a", "a"}, 1},
+		{http.Header{}, 100000, 1000, []string{"a", "a", "a"}, 3},
+	} {
+		upstream := &blockingTransport{release: make(chan struct{}), header: test.header, length: test.length}
+		transport := NewCoalescingTransport(upstream, test.maxBufferSize)
+		var wg sync.WaitGroup
+		for i, tenant := range test.tenants {
+			req := httptest.NewRequest("GET", "http://upstream/reports", nil)
+			req.Header.Set("X-Tenant", tenant)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := transport.RoundTrip(req)
+				if err != nil {
+					t.Errorf("Unexpected error: %s", err)
+					return
+				}
+				body, _ := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				if len(body) != 100000 || res.Request != req {
+					t.Errorf("Unexpected response of %d bytes", len(body))
+				}
+			}()
+			waitForWaiting(t, transport, req, i+1)
+		}
+		close(upstream.release)
+		wg.Wait()
+		if upstream.requests != test.requests {
+			t.Errorf("Unexpected upstream request count %d for %v; expected %d", upstream.requests, test.header, test.requests)
+		}
+	}
+}
+
+func TestCoalescingTransportDistinctRequests(t *testing.T) {
+	upstream := &blockingTransport{release: make(chan struct{})}
+	close(upstream.release)
+	transport := NewCoalescingTransport(upstream, 0)
+	first := httptest.NewRequest("GET", "http://upstream/reports", nil)
+	second := httptest.NewRequest("GET", "http://upstream/reports", nil)
+	second.Header.Set("Accept-Language", "de")
+	if coalescingKey(first) == coalescingKey(second) {
+		t.Errorf("Requests for different languages coalesce")
+	}
+	post := httptest.NewRequest("POST", "http://upstream/reports", strings.NewReader("{}"))
+	for i := 0; i < 2; i++ {
+		res, _ := transport.RoundTrip(post)
+		res.Body.Close()
+	}
+	if upstream.requests != 2 {
+		t.Errorf("POST requests coalesced")
+	}
+}
+
+func TestCoalescingTransportAbandoned(t *testing.T) {
+	upstream := &blockingTransport{release: make(chan struct{})}
+	transport := NewCoalescingTransport(upstream, 0)
+	req := httptest.NewRequest("GET", "http://upstream/reports", nil)
+	ctx, cancel := context.WithCancel(req.Context())
+
+	canceled := make(chan struct{})
+	go func() {
+		if _, err := transport.RoundTrip(req.WithContext(ctx)); err != context.Canceled {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		close(canceled)
+	}()
+	waitForWaiting(t, transport, req, 1)
+
+	done := make(chan struct{})
+	go func() {
+		res, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		} else if body, _ := ioutil.ReadAll(res.Body); len(body) != 100000 {
+			t.Errorf("Unexpected response of %d bytes", len(body))
+		}
+		close(done)
+	}()
+	waitForWaiting(t, transport, req, 2)
+
+	// The first request is gone, but its round trip goes on for the second.
+	cancel()
+	<-canceled
+	close(upstream.release)
+	<-done
+	if upstream.requests != 1 {
+		t.Errorf("Unexpected upstream request count %d", upstream.requests)
+	}
+}
+
+func TestCoalescingTransportAllAbandoned(t *testing.T) {
+	upstream := &blockingTransport{release: make(chan struct{})}
+	transport := NewCoalescingTransport(upstream, 0)
+	req := httptest.NewRequest("GET", "http://upstream/reports", nil)
+	ctx, cancel := context.WithCancel(req.Context())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := transport.RoundTrip(req.WithContext(ctx)); err != context.Canceled {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+		waitForWaiting(t, transport, req, i+1)
+	}
+	transport.mu.Lock()
+	call := transport.calls[coalescingKey(req)]
+	transport.mu.Unlock()
+
+	// Both requests are gone, so the shared round trip is canceled without
+	// being released.
+	cancel()
+	wg.Wait()
+	<-call.done
+	if call.err != context.Canceled {
+		t.Errorf("Unexpected round trip error: %v", call.err)
+	}
+	transport.mu.Lock()
+	calls := len(transport.calls)
+	transport.mu.Unlock()
+	if calls != 0 {
+		t.Errorf("Abandoned round trip still shared")
+	}
+}
+
+func TestCoalescingTransportSlowReader(t *testing.T) {
+	upstream := &blockingTransport{release: make(chan struct{})}
+	transport := NewCoalescingTransport(upstream, 1000)
+	req := httptest.NewRequest("GET", "http://upstream/reports", nil)
+
+	responses := make(chan *http.Response, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			res, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+			responses <- res
+		}()
+		waitForWaiting(t, transport, req, i+1)
+	}
+	close(upstream.release)
+	fast, slow := <-responses, <-responses
+	if fast == nil || slow == nil {
+		t.FailNow()
+	}
+
+	// The fast reader is not held up by the slow one, which is detached.
+	if body, err := ioutil.ReadAll(fast.Body); err != nil || len(body) != 100000 {
+		t.Errorf("Unexpected response of %d bytes: %v", len(body), err)
+	}
+	if _, err := ioutil.ReadAll(slow.Body); err != errSlowReader {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	fast.Body.Close()
+	slow.Body.Close()
+}
@@ -1,12 +1,15 @@
 package proxy
 
 import (
+	"fmt"
 	"github.com/bauerd/jqrp/jq"
 	"github.com/bauerd/jqrp/log"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,6 +17,40 @@ import (
 type Config struct {
 	Port                  int
 	CacheSize             int
+	CacheMaxBytes         int64
+	CacheTTL              time.Duration
+	CacheIdleTTL          time.Duration
+	ErrorCacheSize        int
+	ErrorCacheTTL         time.Duration
+	QueryFile             string
+	QueryFileStrict       bool
+	QueryDumpFile         string
+	QueryDumpInterval     time.Duration
+	QueryDumpSize         int
+	ResponseCacheSize     int64
+	ResponseCacheTTL      time.Duration
+	ResultCacheSize       int
+	ResultCacheTTL        time.Duration
+	CoalesceRequests      bool
+	CoalesceBufferSize    int64
+	MaxEvaluations        int
+	EvaluationQueue       int
+	QueueTimeout          time.Duration
+	RetryAfter            time.Duration
+	RateLimitKey          string
+	RateLimitRequests     int
+	RateLimitBurst        int
+	RateLimitEvalTime     int
+	RateLimitEvalBurst    int
+	RateLimitClients      int
+	TrustedProxies        string
+	JWTSecret             string
+	JWTVerified           bool
+	QueryStatsSize        int
+	SlowQueryThreshold    time.Duration
+	SlowQueryLogFile      string
+	AdminPort             int
+	AdminToken            string
 	EvaluationTimeout     time.Duration
 	ReadTimeout           time.Duration
 	WriteTimeout          time.Duration
@@ -22,14 +59,85 @@ type Config struct {
 	TLSHandshakeTimeout   time.Duration
 	ResponseHeaderTimeout time.Duration
 	ExpectContinueTimeout time.Duration
+	EmptyResult           EmptyMode
+	TransformStatus       StatusSet
+	SuccessStatus         SuccessStatus
+	UserErrorStatus       StatusSet
+	MaxBodySize           int64
+	MaxOutputSize         int64
+	MaxResults            int
+	MaxQueryLength        int
+	RoutesFile            string
+	Routes                Routes
 	Level                 log.Level
 }
 
+// Components are the evaluator built from a configuration, and the caches,
+// statistics and limiters it shares with the proxy and the admin API. Fields
+// are nil if disabled.
+type Components struct {
+	Evaluator jq.Evaluator
+
+	// QueryCache is the compiled query cache of the evaluator.
+	QueryCache *jq.CachedCompiler
+
+	// EvaluatorPool bounds the concurrent evaluations.
+	EvaluatorPool *jq.EvaluatorPool
+
+	// QueryStats are the statistics recorded by the evaluator.
+	QueryStats *jq.QueryStats
+
+	// ResponseCache is the upstream response cache.
+	ResponseCache *ResponseCache
+
+	// RateLimiter limits the requests and evaluation time of clients, which
+	// the evaluator reports to it.
+	RateLimiter *RateLimiter
+
+	// TrustedProxies are the networks of the proxies in front of jqrp, whose
+	// X-Forwarded-For addresses identify clients.
+	TrustedProxies []*net.IPNet
+}
+
 // NewConfig returns a configuration read from environment variables.
 func NewConfig() *Config {
 	return &Config{
 		Port:                  intFromEnvironment("PORT", 8989),
 		CacheSize:             intFromEnvironment("CACHE_SIZE", 512),
+		CacheMaxBytes:         sizeFromEnvironment("CACHE_MAX_BYTES", 0),
+		CacheTTL:              durationFromEnvironment("CACHE_TTL", 0),
+		CacheIdleTTL:          durationFromEnvironment("CACHE_IDLE_TTL", 0),
+		ErrorCacheSize:        intFromEnvironment("ERROR_CACHE_SIZE", 128),
+		ErrorCacheTTL:         durationFromEnvironment("ERROR_CACHE_TTL", 60000),
+		QueryFile:             os.Getenv("QUERY_FILE"),
+		QueryFileStrict:       boolFromEnvironment("QUERY_FILE_STRICT", false),
+		QueryDumpFile:         os.Getenv("QUERY_DUMP_FILE"),
+		QueryDumpInterval:     durationFromEnvironment("QUERY_DUMP_INTERVAL", 0),
+		QueryDumpSize:         intFromEnvironment("QUERY_DUMP_SIZE", 100),
+		ResponseCacheSize:     sizeFromEnvironment("RESPONSE_CACHE_SIZE", 0),
+		ResponseCacheTTL:      durationFromEnvironment("RESPONSE_CACHE_TTL", 0),
+		ResultCacheSize:       intFromEnvironment("RESULT_CACHE_SIZE", 0),
+		ResultCacheTTL:        durationFromEnvironment("RESULT_CACHE_TTL", 0),
+		CoalesceRequests:      boolFromEnvironment("COALESCE_REQUESTS", false),
+		CoalesceBufferSize:    sizeFromEnvironment("COALESCE_BUFFER_SIZE", 8388608),
+		MaxEvaluations:        intFromEnvironment("MAX_EVALUATIONS", 0),
+		EvaluationQueue:       intFromEnvironment("EVAL_QUEUE_SIZE", 64),
+		QueueTimeout:          durationFromEnvironment("EVAL_QUEUE_TIMEOUT", 1000),
+		RetryAfter:            durationFromEnvironment("RETRY_AFTER", 1000),
+		RateLimitKey:          rateLimitKeyFromEnvironment("RATE_LIMIT_KEY", "ip"),
+		RateLimitRequests:     intFromEnvironment("RATE_LIMIT_REQUESTS", 0),
+		RateLimitBurst:        intFromEnvironment("RATE_LIMIT_BURST", 0),
+		RateLimitEvalTime:     intFromEnvironment("RATE_LIMIT_EVAL_TIME", 0),
+		RateLimitEvalBurst:    intFromEnvironment("RATE_LIMIT_EVAL_BURST", 0),
+		RateLimitClients:      intFromEnvironment("RATE_LIMIT_CLIENTS", 10000),
+		TrustedProxies:        os.Getenv("TRUSTED_PROXIES"),
+		JWTSecret:             os.Getenv("JWT_SECRET"),
+		JWTVerified:           boolFromEnvironment("JWT_VERIFIED", false),
+		QueryStatsSize:        intFromEnvironment("QUERY_STATS_SIZE", 0),
+		SlowQueryThreshold:    durationFromEnvironment("SLOW_QUERY_THRESHOLD", 0),
+		SlowQueryLogFile:      os.Getenv("SLOW_QUERY_LOG"),
+		AdminPort:             intFromEnvironment("ADMIN_PORT", 0),
+		AdminToken:            os.Getenv("ADMIN_TOKEN"),
 		EvaluationTimeout:     durationFromEnvironment("EVAL_TIMEOUT", 0),
 		ReadTimeout:           durationFromEnvironment("READ_TIMEOUT", 0),
 		WriteTimeout:          durationFromEnvironment("WRITE_TIMEOUT", 0),
@@ -38,6 +146,15 @@ func NewConfig() *Config {
 		TLSHandshakeTimeout:   durationFromEnvironment("TLS_HANDSHAKE_TIMEOUT", 0),
 		ResponseHeaderTimeout: durationFromEnvironment("RESPONSE_HEADER_TIMEOUT", 0),
 		ExpectContinueTimeout: durationFromEnvironment("EXPECT_CONTINUE_TIMEOUT", 0),
+		EmptyResult:           emptyModeFromEnvironment("EMPTY_RESULT", EmptyAuto),
+		TransformStatus:       statusSetFromEnvironment("TRANSFORM_STATUS", ""),
+		SuccessStatus:         successStatusFromEnvironment("SUCCESS_STATUS", SuccessNonAuthoritative),
+		UserErrorStatus:       statusSetFromEnvironment("USER_ERROR_STATUS", "4xx,5xx"),
+		MaxBodySize:           sizeFromEnvironment("MAX_BODY_SIZE", 0),
+		MaxOutputSize:         sizeFromEnvironment("MAX_OUTPUT_SIZE", 0),
+		MaxResults:            intFromEnvironment("MAX_RESULTS", 0),
+		MaxQueryLength:        intFromEnvironment("MAX_QUERY_LENGTH", 0),
+		RoutesFile:            os.Getenv("ROUTES_FILE"),
 	}
 }
 
@@ -52,24 +169,121 @@ func intFromEnvironment(key string, fallback int) int {
 	return fallback
 }
 
+func boolFromEnvironment(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fallback
+		}
+		return b
+	}
+	return fallback
+}
+
+func sizeFromEnvironment(key string, fallback int64) int64 {
+	if value, ok := os.LookupEnv(key); ok {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fallback
+		}
+		return i
+	}
+	return fallback
+}
+
 func durationFromEnvironment(key string, fallback int) time.Duration {
 	return time.Duration(intFromEnvironment(key, fallback)) * time.Millisecond
 }
 
 func levelFromEnvironment(key string, fallback log.Level) log.Level {
 	if value, ok := os.LookupEnv(key); ok {
-		switch value {
-		case "debug":
-			return log.Debug
-		case "info":
-			return log.Info
-		case "error":
-			return log.Error
+		if level, ok := log.ParseLevel(value); ok {
+			return level
 		}
 	}
 	return fallback
 }
 
+func emptyModeFromEnvironment(key string, fallback EmptyMode) EmptyMode {
+	if value, ok := os.LookupEnv(key); ok {
+		if mode, ok := ParseEmptyMode(value); ok {
+			return mode
+		}
+	}
+	return fallback
+}
+
+func statusSetFromEnvironment(key string, fallback string) StatusSet {
+	if value, ok := os.LookupEnv(key); ok {
+		if set, ok := ParseStatusSet(value); ok {
+			return set
+		}
+	}
+	if set, ok := ParseStatusSet(fallback); ok {
+		return set
+	}
+	return StatusSet{}
+}
+
+func rateLimitKeyFromEnvironment(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && validRateLimitKey(value) {
+		return value
+	}
+	return fallback
+}
+
+func successStatusFromEnvironment(key string, fallback SuccessStatus) SuccessStatus {
+	if value, ok := os.LookupEnv(key); ok {
+		if status, ok := ParseSuccessStatus(value); ok {
+			return status
+		}
+	}
+	return fallback
+}
+
+// Options returns the default transformation options.
+func (c *Config) Options() Options {
+	return Options{
+		Empty:           c.EmptyResult,
+		Status:          c.TransformStatus,
+		SuccessStatus:   c.SuccessStatus,
+		UserErrorStatus: c.UserErrorStatus,
+		MaxBodySize:     c.MaxBodySize,
+		MaxQueryLength:  c.MaxQueryLength,
+		RetryAfter:      c.RetryAfter,
+	}
+}
+
+// ProxyOptions returns the options of a proxy using the given components,
+// if any.
+func (c *Config) ProxyOptions(components *Components) ProxyOptions {
+	options := ProxyOptions{
+		Options:            c.Options(),
+		Routes:             c.Routes,
+		CoalesceRequests:   c.CoalesceRequests,
+		CoalesceBufferSize: c.CoalesceBufferSize,
+	}
+	if components != nil {
+		options.ResponseCache = components.ResponseCache
+		options.RateLimiter = components.RateLimiter
+		options.TrustedProxies = components.TrustedProxies
+	}
+	return options
+}
+
+// LoadRoutes reads the routes from the routes file, if any.
+func (c *Config) LoadRoutes() error {
+	if c.RoutesFile == "" {
+		return nil
+	}
+	routes, err := LoadRoutes(c.RoutesFile)
+	if err != nil {
+		return err
+	}
+	c.Routes = routes
+	return nil
+}
+
 // Transport returns an HTTP transport with timeouts set.
 func (c *Config) Transport() *http.Transport {
 	return &http.Transport{
@@ -83,29 +297,245 @@ func (c *Config) Transport() *http.Transport {
 	}
 }
 
-// Evaluator returns a configured evaluator.
+// responseCache returns a new upstream response cache, or nil if disabled.
+func (c *Config) responseCache() *ResponseCache {
+	if c.ResponseCacheSize <= 0 {
+		return nil
+	}
+	return NewResponseCache(c.ResponseCacheSize, c.ResponseCacheTTL)
+}
+
+// RateLimit returns the default rate limit.
+func (c *Config) RateLimit() RateLimit {
+	return RateLimit{
+		Key:             c.RateLimitKey,
+		Requests:        c.RateLimitRequests,
+		Burst:           c.RateLimitBurst,
+		EvaluationTime:  c.RateLimitEvalTime,
+		EvaluationBurst: c.RateLimitEvalBurst,
+	}
+}
+
+// rateLimiter returns a new rate limiter of clients, or nil if neither the
+// default rate limit nor any route limits clients.
+func (c *Config) rateLimiter(trustedProxies []*net.IPNet) (*RateLimiter, error) {
+	defaults := c.RateLimit()
+	limited := defaults.Requests > 0 || defaults.EvaluationTime > 0
+	for _, route := range c.Routes {
+		limited = limited || route.RateLimit != nil
+	}
+	if !limited {
+		return nil, nil
+	}
+	return NewRateLimiter(defaults, c.Routes, RateLimiterOptions{
+		Clients:        c.RateLimitClients,
+		TrustedProxies: trustedProxies,
+		JWTSecret:      []byte(c.JWTSecret),
+		JWTVerified:    c.JWTVerified,
+	})
+}
+
+// parseNetworks parses a comma-separated list of IP addresses and networks in
+// CIDR notation.
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Evaluator returns a configured evaluator. Use Build to share its caches and
+// limiters with a proxy and the admin API.
 func (c *Config) Evaluator() (jq.Evaluator, error) {
-	compiler, err := c.compiler()
+	components, err := c.Build()
+	if err != nil {
+		return nil, err
+	}
+	return components.Evaluator, nil
+}
+
+// Build returns new components as configured.
+func (c *Config) Build() (*Components, error) {
+	trustedProxies, err := parseNetworks(c.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	components := &Components{ResponseCache: c.responseCache(), TrustedProxies: trustedProxies}
+	compiler, err := c.compiler(components)
+	if err != nil {
+		return nil, err
+	}
+	limits := jq.Limits{MaxResults: c.MaxResults, MaxOutputSize: c.MaxOutputSize}
+	var evaluator jq.Evaluator = jq.NewLimitedQueryEvaluator(compiler, limits)
+	if c.EvaluationTimeout > 0 {
+		evaluator = jq.NewTimeoutEvaluator(evaluator, c.EvaluationTimeout)
+	}
+	observers, err := c.observers(components)
+	if err != nil {
+		return nil, err
+	}
+	if len(observers) > 0 {
+		evaluator = jq.NewStatsEvaluator(evaluator, observers...)
+	}
+	// Time spent queueing for a slot and rejected evaluations are not
+	// observed.
+	if c.MaxEvaluations > 0 {
+		components.EvaluatorPool = jq.NewEvaluatorPool(evaluator, jq.PoolOptions{
+			MaxConcurrent: c.MaxEvaluations,
+			MaxQueue:      c.EvaluationQueue,
+			QueueTimeout:  c.QueueTimeout,
+		})
+		evaluator = components.EvaluatorPool
+	}
+	// Results served from the result cache are not observed.
+	if c.ResultCacheSize > 0 {
+		if evaluator, err = jq.NewCachedEvaluator(evaluator, c.ResultCacheSize, c.ResultCacheTTL); err != nil {
+			return nil, err
+		}
+	}
+	components.Evaluator = evaluator
+	return components, nil
+}
+
+// observers returns the observers of evaluations, i.e. the rate limiter, the
+// query statistics and the slow query log, if enabled, and adds them to
+// components.
+func (c *Config) observers(components *Components) ([]jq.Observer, error) {
+	var observers []jq.Observer
+	limiter, err := c.rateLimiter(components.TrustedProxies)
 	if err != nil {
 		return nil, err
 	}
-	if c.EvaluationTimeout <= 0 {
-		return jq.NewQueryEvaluator(compiler), nil
+	if limiter != nil {
+		components.RateLimiter = limiter
+		observers = append(observers, limiter)
+	}
+	if c.QueryStatsSize > 0 {
+		components.QueryStats = jq.NewQueryStats(c.QueryStatsSize)
+		observers = append(observers, components.QueryStats)
+	}
+	if c.SlowQueryThreshold > 0 {
+		var writer io.Writer = os.Stdout
+		if c.SlowQueryLogFile != "" {
+			file, err := os.OpenFile(c.SlowQueryLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return nil, err
+			}
+			writer = file
+		}
+		observers = append(observers, NewSlowQueryLog(writer, c.SlowQueryThreshold))
 	}
-	return jq.NewTimeoutEvaluator(jq.NewQueryEvaluator(compiler), c.EvaluationTimeout), nil
+	return observers, nil
 }
 
-func (c *Config) compiler() (jq.Compiler, error) {
+func (c *Config) compiler(components *Components) (jq.Compiler, error) {
 	if c.CacheSize <= 0 {
 		return jq.QueryCompiler, nil
 	}
-	cachedCompiler, err := jq.NewCachedCompiler(jq.QueryCompiler, c.CacheSize)
+	options := jq.CacheOptions{
+		MaxBytes:  c.CacheMaxBytes,
+		TTL:       c.CacheTTL,
+		IdleTTL:   c.CacheIdleTTL,
+		ErrorSize: c.ErrorCacheSize,
+		ErrorTTL:  c.ErrorCacheTTL,
+	}
+	cachedCompiler, err := jq.NewCachedCompilerWithOptions(jq.QueryCompiler, c.CacheSize, options)
 	if err != nil {
 		return nil, err
 	}
+	components.QueryCache = cachedCompiler
 	return cachedCompiler.Compiler, nil
 }
 
+// Settings returns the configuration by environment variable, with secrets
+// redacted.
+func (c *Config) Settings() map[string]interface{} {
+	adminToken := ""
+	if c.AdminToken != "" {
+		adminToken = "REDACTED"
+	}
+	jwtSecret := ""
+	if c.JWTSecret != "" {
+		jwtSecret = "REDACTED"
+	}
+	return map[string]interface{}{
+		"PORT":                    c.Port,
+		"CACHE_SIZE":              c.CacheSize,
+		"CACHE_MAX_BYTES":         c.CacheMaxBytes,
+		"CACHE_TTL":               c.CacheTTL.String(),
+		"CACHE_IDLE_TTL":          c.CacheIdleTTL.String(),
+		"ERROR_CACHE_SIZE":        c.ErrorCacheSize,
+		"ERROR_CACHE_TTL":         c.ErrorCacheTTL.String(),
+		"QUERY_FILE":              c.QueryFile,
+		"QUERY_FILE_STRICT":       c.QueryFileStrict,
+		"QUERY_DUMP_FILE":         c.QueryDumpFile,
+		"QUERY_DUMP_INTERVAL":     c.QueryDumpInterval.String(),
+		"QUERY_DUMP_SIZE":         c.QueryDumpSize,
+		"RESPONSE_CACHE_SIZE":     c.ResponseCacheSize,
+		"RESPONSE_CACHE_TTL":      c.ResponseCacheTTL.String(),
+		"RESULT_CACHE_SIZE":       c.ResultCacheSize,
+		"RESULT_CACHE_TTL":        c.ResultCacheTTL.String(),
+		"COALESCE_REQUESTS":       c.CoalesceRequests,
+		"COALESCE_BUFFER_SIZE":    c.CoalesceBufferSize,
+		"MAX_EVALUATIONS":         c.MaxEvaluations,
+		"EVAL_QUEUE_SIZE":         c.EvaluationQueue,
+		"EVAL_QUEUE_TIMEOUT":      c.QueueTimeout.String(),
+		"RETRY_AFTER":             c.RetryAfter.String(),
+		"RATE_LIMIT_KEY":          c.RateLimitKey,
+		"RATE_LIMIT_REQUESTS":     c.RateLimitRequests,
+		"RATE_LIMIT_BURST":        c.RateLimitBurst,
+		"RATE_LIMIT_EVAL_TIME":    c.RateLimitEvalTime,
+		"RATE_LIMIT_EVAL_BURST":   c.RateLimitEvalBurst,
+		"RATE_LIMIT_CLIENTS":      c.RateLimitClients,
+		"TRUSTED_PROXIES":         c.TrustedProxies,
+		"JWT_SECRET":              jwtSecret,
+		"JWT_VERIFIED":            c.JWTVerified,
+		"QUERY_STATS_SIZE":        c.QueryStatsSize,
+		"SLOW_QUERY_THRESHOLD":    c.SlowQueryThreshold.String(),
+		"SLOW_QUERY_LOG":          c.SlowQueryLogFile,
+		"ADMIN_PORT":              c.AdminPort,
+		"ADMIN_TOKEN":             adminToken,
+		"EVAL_TIMEOUT":            c.EvaluationTimeout.String(),
+		"READ_TIMEOUT":            c.ReadTimeout.String(),
+		"WRITE_TIMEOUT":           c.WriteTimeout.String(),
+		"DIAL_TIMEOUT":            c.DialTimeout.String(),
+		"DIAL_KEEPALIVE":          c.DialKeepAlive.String(),
+		"TLS_HANDSHAKE_TIMEOUT":   c.TLSHandshakeTimeout.String(),
+		"RESPONSE_HEADER_TIMEOUT": c.ResponseHeaderTimeout.String(),
+		"EXPECT_CONTINUE_TIMEOUT": c.ExpectContinueTimeout.String(),
+		"EMPTY_RESULT":            c.EmptyResult,
+		"TRANSFORM_STATUS":        c.TransformStatus.String(),
+		"SUCCESS_STATUS":          c.SuccessStatus,
+		"USER_ERROR_STATUS":       c.UserErrorStatus.String(),
+		"MAX_BODY_SIZE":           c.MaxBodySize,
+		"MAX_OUTPUT_SIZE":         c.MaxOutputSize,
+		"MAX_RESULTS":             c.MaxResults,
+		"MAX_QUERY_LENGTH":        c.MaxQueryLength,
+		"ROUTES_FILE":             c.RoutesFile,
+	}
+}
+
 // Logger returns a logger with level set.
 func (c *Config) Logger() *log.Logger {
 	return log.New(levelFromEnvironment("LOG_LEVEL", log.Info))
@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"context"
 	"github.com/bauerd/jqrp/jq"
+	"net"
 	"testing"
 )
 
@@ -26,3 +28,59 @@ func TestConfigEvaluatorWithTimeout(t *testing.T) {
 		t.Error("Unexpected evaluator")
 	}
 }
+
+func TestConfigEvaluatorWithResultCache(t *testing.T) {
+	config := Config{EvaluationTimeout: 1, ResultCacheSize: 8}
+	evaluator, _ := config.Evaluator()
+	switch evaluator.(type) {
+	case *jq.CachedEvaluator:
+		return
+	default:
+		t.Error("Unexpected evaluator")
+	}
+}
+
+func TestConfigBuildResultCacheUnobserved(t *testing.T) {
+	config := Config{ResultCacheSize: 8, QueryStatsSize: 8}
+	components, _ := config.Build()
+	ctx := jq.WithCacheKey(context.Background(), jq.CacheKey{Input: "{}"})
+	for i := 0; i < 2; i++ {
+		iterator, _ := jq.Stream(ctx, components.Evaluator, ".a", map[string]interface{}{})
+		jq.Collect(iterator)
+	}
+	if stats := components.QueryStats.TopByCount(1); len(stats) != 1 || stats[0].Count != 1 {
+		t.Errorf("Expected cached results to be unobserved, got %+v", stats)
+	}
+}
+
+func TestConfigBuildSaturationUnobserved(t *testing.T) {
+	config := Config{MaxEvaluations: 1, QueryStatsSize: 8}
+	components, _ := config.Build()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jq.Stream(ctx, components.Evaluator, ".[]", []interface{}{1})
+	if _, err := jq.Stream(context.Background(), components.Evaluator, ".[]", []interface{}{1}); err != jq.ErrEvaluatorSaturated {
+		t.Fatalf("Expected saturation, got %v", err)
+	}
+	if stats := components.QueryStats.TopByCount(1); len(stats) != 0 {
+		t.Errorf("Expected rejected evaluation to be unobserved, got %+v", stats)
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks("10.0.0.0/8, 192.0.2.1,2001:db8::1")
+	if err != nil || len(networks) != 3 {
+		t.Fatalf("Unexpected networks %v, error %v", networks, err)
+	}
+	for i, address := range []string{"10.1.2.3", "192.0.2.1", "2001:db8::1"} {
+		if !networks[i].Contains(net.ParseIP(address)) {
+			t.Errorf("Network %s does not contain %s", networks[i], address)
+		}
+	}
+	if networks[1].Contains(net.ParseIP("192.0.2.2")) {
+		t.Errorf("Address parsed as network %s", networks[1])
+	}
+	if _, err := parseNetworks("10.0.0.0/33"); err == nil {
+		t.Errorf("Expected error for invalid network")
+	}
+}
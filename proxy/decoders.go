@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"github.com/bauerd/jqrp/json"
+	"io"
+	"strings"
+)
+
+// Decoder decodes upstream response bodies of some media type into query
+// inputs.
+type Decoder struct {
+	// Parse decodes a body into a single input. The key order is nil if it is
+	// not known.
+	Parse func(io.Reader) (interface{}, *json.KeyOrder, error)
+
+	// Elements decodes the elements of the array Parse would return one at a
+	// time. It is nil if the format is not decoded incrementally.
+	Elements func(io.Reader) json.Stream
+
+	// Values decodes a sequence of top-level values one at a time. It is nil
+	// if the format has no such sequence.
+	Values func(io.Reader) json.Stream
+
+	// Events tokenizes a body into jq --stream events. It is nil if the
+	// format is not tokenized incrementally.
+	Events func(io.Reader) json.Stream
+}
+
+// Decoders are the upstream response decoders by media type. Media types with
+// a +json, +xml or +yaml structured syntax suffix are decoded like JSON, XML
+// or YAML respectively.
+var Decoders = map[string]Decoder{
+	"application/json":     jsonDecoder,
+	"application/x-ndjson": ndjsonDecoder,
+	"application/jsonl":    ndjsonDecoder,
+	"application/yaml":     yamlDecoder,
+	"application/x-yaml":   yamlDecoder,
+	"text/yaml":            yamlDecoder,
+	"text/x-yaml":          yamlDecoder,
+	"text/csv":             csvDecoder,
+	"application/xml":      xmlDecoder,
+	"text/xml":             xmlDecoder,
+}
+
+var jsonDecoder = Decoder{
+	Parse:    json.ParseOrdered,
+	Elements: func(reader io.Reader) json.Stream { return json.NewElementStream(reader) },
+	Values:   func(reader io.Reader) json.Stream { return json.NewValueStream(reader) },
+	Events:   func(reader io.Reader) json.Stream { return json.NewEventStream(reader) },
+}
+
+var ndjsonDecoder = Decoder{
+	Parse:    json.ParseNDJSON,
+	Elements: func(reader io.Reader) json.Stream { return json.NewValueStream(reader) },
+	Values:   func(reader io.Reader) json.Stream { return json.NewValueStream(reader) },
+}
+
+var yamlDecoder = Decoder{
+	Parse: json.ParseYAML,
+}
+
+var csvDecoder = Decoder{
+	Parse:    json.ParseCSV,
+	Elements: func(reader io.Reader) json.Stream { return json.NewCSVStream(reader) },
+}
+
+var xmlDecoder = Decoder{
+	Parse: json.ParseXML,
+}
+
+// decoderFor returns the decoder for an upstream media type.
+func decoderFor(mediaType string) (Decoder, bool) {
+	if decoder, ok := Decoders[mediaType]; ok {
+		return decoder, true
+	}
+	for _, suffix := range []string{"json", "xml", "yaml"} {
+		if strings.HasSuffix(mediaType, "+"+suffix) {
+			decoder, ok := Decoders["application/"+suffix]
+			return decoder, ok
+		}
+	}
+	return Decoder{}, false
+}
+
+// stream returns the stream of inputs for an input mode other than the
+// document mode, or false if the format does not support it.
+func (d Decoder) stream(mode InputMode, reader io.Reader) (json.Stream, bool) {
+	var newStream func(io.Reader) json.Stream
+	switch mode {
+	case InputElements:
+		newStream = d.Elements
+	case InputStream:
+		newStream = d.Events
+	case InputValue, InputSlurp, InputInputs:
+		newStream = d.Values
+	}
+	if newStream == nil {
+		return nil, false
+	}
+	return newStream(reader), true
+}
@@ -5,11 +5,15 @@ import (
 	"net/http"
 )
 
-// Director modifies incoming client requests.
+// Director modifies incoming client requests. The query and option headers
+// are meant for jqrp only, and are not forwarded.
 func Director(super func(*http.Request), logger *log.Logger) func(*http.Request) {
 	return func(r *http.Request) {
 		super(r)
 		r.Host = r.URL.Host
+		for _, name := range optionHTTPHeaders {
+			r.Header.Del(name)
+		}
 		log.Request(logger, r)
 	}
 }
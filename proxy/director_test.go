@@ -22,3 +22,23 @@ func TestDirector(t *testing.T) {
 		t.Errorf("Mismatching host %s", req.Host)
 	}
 }
+
+func TestDirectorStripsOptionHeaders(t *testing.T) {
+	logger := log.New(log.Error)
+	req, _ := http.NewRequest("POST", "/", nil)
+	req.Header.Set(RawQueryHTTPHeader, ".")
+	req.Header.Set(RequestQueryHTTPHeader, ".")
+	req.Header.Set(InputHTTPHeader, "slurp")
+	req.Header.Set("Accept", "application/json")
+
+	Director(func(*http.Request) {}, logger)(req)
+
+	for _, name := range []string{RawQueryHTTPHeader, RequestQueryHTTPHeader, InputHTTPHeader} {
+		if value := req.Header.Get(name); value != "" {
+			t.Errorf("Forwarded %s header %q", name, value)
+		}
+	}
+	if req.Header.Get("Accept") != "application/json" {
+		t.Errorf("Stripped Accept header")
+	}
+}
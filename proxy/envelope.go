@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/bauerd/jqrp/log"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// protectedHeaders are hop-by-hop and framing headers, which are neither
+// exposed to nor changed by envelope queries.
+var protectedHeaders = map[string]bool{
+	"Connection":          true,
+	"Content-Length":      true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// envelope returns the {status, headers, body} envelope of an upstream
+// response. Header values are strings, or arrays of strings if repeated.
+func envelope(body interface{}, r *http.Response) map[string]interface{} {
+	headers := make(map[string]interface{}, len(r.Header))
+	for name, values := range r.Header {
+		if protectedHeaders[name] || len(values) == 0 {
+			continue
+		}
+		if len(values) == 1 {
+			headers[name] = values[0]
+			continue
+		}
+		array := make([]interface{}, len(values))
+		for i, value := range values {
+			array[i] = value
+		}
+		headers[name] = array
+	}
+	return map[string]interface{}{
+		"status":  r.StatusCode,
+		"headers": headers,
+		"body":    body,
+	}
+}
+
+// writeEnvelope responds with the envelope a query resulted in. Omitted
+// fields keep the status code and headers, or write an empty body.
+func writeEnvelope(results []interface{}, response *http.Response, logger *log.Logger) error {
+	if len(results) != 1 {
+		return fmt.Errorf("%w: query yielded %d results", ErrIllegalEnvelope, len(results))
+	}
+	result, ok := results[0].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: not an object", ErrIllegalEnvelope)
+	}
+	for key := range result {
+		if key != "status" && key != "headers" && key != "body" {
+			return fmt.Errorf("%w: unknown field %q", ErrIllegalEnvelope, key)
+		}
+	}
+
+	status := 0
+	if value, ok := result["status"]; ok {
+		var err error
+		if status, err = envelopeStatus(value); err != nil {
+			return err
+		}
+	}
+
+	var header http.Header
+	if value, ok := result["headers"]; ok {
+		var err error
+		if header, err = envelopeHeader(value, response.Header); err != nil {
+			return err
+		}
+	}
+
+	body := []byte{}
+	if value, ok := result["body"]; ok {
+		if bodyless(status) {
+			return fmt.Errorf("%w: status %d does not allow a body", ErrIllegalEnvelope, status)
+		}
+		var err error
+		if body, err = marshal(value, response); err != nil {
+			return err
+		}
+	}
+
+	if header != nil {
+		response.Header = header
+	}
+	if _, ok := result["body"]; ok && response.Header.Get("Content-Type") == "" {
+		setContentType(response, "application/json")
+	}
+	if err := writeRawBody(body, response, logger); err != nil {
+		return err
+	}
+	if status != 0 {
+		response.StatusCode = status
+	}
+	return nil
+}
+
+func envelopeStatus(value interface{}) (int, error) {
+	var status int
+	switch value := value.(type) {
+	case int:
+		status = value
+	case float64:
+		if value != math.Trunc(value) {
+			return 0, fmt.Errorf("%w: status is not an integer", ErrIllegalEnvelope)
+		}
+		status = int(value)
+	default:
+		return 0, fmt.Errorf("%w: status is not an integer", ErrIllegalEnvelope)
+	}
+	if status < 200 || status > 599 {
+		return 0, fmt.Errorf("%w: status %d is out of range", ErrIllegalEnvelope, status)
+	}
+	return status, nil
+}
+
+// envelopeHeader returns the headers of an envelope, in addition to the
+// protected headers of upstream.
+func envelopeHeader(value interface{}, upstream http.Header) (http.Header, error) {
+	headers, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: headers is not an object", ErrIllegalEnvelope)
+	}
+	header := http.Header{}
+	for name, values := range upstream {
+		if protectedHeaders[name] {
+			header[name] = values
+		}
+	}
+	for name, values := range headers {
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("%w: invalid header name %q", ErrIllegalEnvelope, name)
+		}
+		if protectedHeaders[http.CanonicalHeaderKey(name)] {
+			return nil, fmt.Errorf("%w: header %s may not be set", ErrIllegalEnvelope, name)
+		}
+		switch values := values.(type) {
+		case string:
+			header.Add(name, values)
+		case []interface{}:
+			for _, value := range values {
+				s, ok := value.(string)
+				if !ok {
+					return nil, fmt.Errorf("%w: header %s is not a string", ErrIllegalEnvelope, name)
+				}
+				header.Add(name, s)
+			}
+		default:
+			return nil, fmt.Errorf("%w: header %s is not a string", ErrIllegalEnvelope, name)
+		}
+	}
+	return header, nil
+}
+
+// validHeaderName reports whether name is an RFC 7230 token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c >= 0x7f || c <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -5,11 +5,23 @@ import (
 	"github.com/bauerd/jqrp/jq"
 	"github.com/bauerd/jqrp/log"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // ErrorHandler writes the response status code in case of errors.
 func ErrorHandler(logger *log.Logger) func(http.ResponseWriter, *http.Request, error) {
 	return func(responseWriter http.ResponseWriter, req *http.Request, err error) {
+		var userError *jq.UserError
+		if errors.As(err, &userError) {
+			options := optionsFromContext(req.Context())
+			if status, ok := userErrorStatus(userError, options.UserErrorStatus); ok {
+				writeUserError(responseWriter, status, userError)
+				log.FailureResponse(logger, req, err)
+				return
+			}
+		}
+
 		var e *jq.QueryEvaluationError
 		if errors.As(err, &e) {
 			responseWriter.WriteHeader(400)
@@ -17,6 +29,18 @@ func ErrorHandler(logger *log.Logger) func(http.ResponseWriter, *http.Request, e
 			return
 		}
 
+		if err == jq.ErrEvaluatorSaturated {
+			writeSaturated(responseWriter, optionsFromContext(req.Context()).RetryAfter)
+			log.FailureResponse(logger, req, err)
+			return
+		}
+
+		if errors.Is(err, ErrIllegalEnvelope) {
+			writeProblem(responseWriter, 422, err.Error())
+			log.FailureResponse(logger, req, err)
+			return
+		}
+
 		switch err {
 		case ErrInvalidResponseBody:
 			responseWriter.WriteHeader(502)
@@ -30,9 +54,26 @@ func ErrorHandler(logger *log.Logger) func(http.ResponseWriter, *http.Request, e
 		case jq.ErrEvaluationTimeout:
 			responseWriter.WriteHeader(408)
 			log.FailureResponse(logger, req, err)
+		case ErrResponseBodyTooLarge:
+			writeProblem(responseWriter, 502, err.Error())
+			log.FailureResponse(logger, req, err)
+		case jq.ErrResultLimitExceeded, jq.ErrOutputLimitExceeded, ErrUnsupportedInputMode:
+			writeProblem(responseWriter, 422, err.Error())
+			log.FailureResponse(logger, req, err)
 		default:
 			responseWriter.WriteHeader(500)
 			log.FailureResponse(logger, req, err)
 		}
 	}
 }
+
+// writeSaturated responds with 503, asking the client to retry after
+// retryAfter, rounded up to seconds.
+func writeSaturated(w http.ResponseWriter, retryAfter time.Duration) {
+	retryAfterSeconds := seconds(retryAfter)
+	if retryAfterSeconds < 1 {
+		retryAfterSeconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	writeProblem(w, 503, jq.ErrEvaluatorSaturated.Error())
+}
@@ -4,15 +4,53 @@ import "errors"
 
 // Upstream errors.
 var (
-	// ErrInvalidResponseBody signals that an upstream response contained invalid
-	// JSON.
-	ErrInvalidResponseBody = errors.New("upstream response is invalid JSON")
+	// ErrInvalidResponseBody signals that an upstream response body could not be
+	// decoded.
+	ErrInvalidResponseBody = errors.New("upstream response body is invalid")
 
-	// ErrIllegalResponseType signals that an upstream response's Content-Type was
-	// not application/json.
-	ErrIllegalResponseType = errors.New("upstream response is not application/json")
+	// ErrIllegalResponseType signals that an upstream response's Content-Type
+	// has no decoder.
+	ErrIllegalResponseType = errors.New("upstream response media type is not supported")
 
 	// ErrIllegalQueryResult signals that a query resulted in a result type that
 	// has no JSON representation on its own.
 	ErrIllegalQueryResult = errors.New("query resulted in primitive type")
+
+	// ErrIllegalEnvelope signals that a query in the envelope mode resulted in
+	// an invalid envelope.
+	ErrIllegalEnvelope = errors.New("query result is not a valid envelope")
+
+	// ErrResponseBodyTooLarge signals that an upstream response body exceeded
+	// the maximum body size.
+	ErrResponseBodyTooLarge = errors.New("upstream response body is too large")
+)
+
+// Client errors.
+var (
+	// ErrQueryTooLong signals that a query exceeded the maximum query length.
+	ErrQueryTooLong = errors.New("query is too long")
+
+	// ErrInvalidRequestBody signals that a request body to transform contained
+	// invalid JSON.
+	ErrInvalidRequestBody = errors.New("request body is invalid JSON")
+
+	// ErrRequestBodyTooLarge signals that a request body to transform exceeded
+	// the maximum body size.
+	ErrRequestBodyTooLarge = errors.New("request body is too large")
+
+	// ErrIllegalRequestQueryResult signals that a request query did not yield
+	// exactly one result.
+	ErrIllegalRequestQueryResult = errors.New("request query must yield exactly one result")
+
+	// ErrUnsupportedInputMode signals that the requested input mode is not
+	// supported for the upstream response's media type.
+	ErrUnsupportedInputMode = errors.New("input mode is not supported for upstream media type")
+
+	// ErrRateLimitExceeded signals that a client exhausted its request or
+	// evaluation time budget.
+	ErrRateLimitExceeded = errors.New("rate limit exceeded")
+
+	// ErrRateLimiterUnobserved signals that a rate limiter limiting evaluation
+	// time is not notified of evaluations.
+	ErrRateLimiterUnobserved = errors.New("rate limiter is not notified of evaluations")
 )
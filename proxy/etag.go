@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// staleHeaders are upstream response headers that describe the upstream body,
+// and no longer match a transformed one.
+var staleHeaders = []string{"ETag", "Content-MD5", "Digest", "Content-Range"}
+
+// ifNoneMatchContextKey is the context key the entity tags of transformed
+// bodies in the If-None-Match header of query requests are stored under, as
+// they are not forwarded upstream.
+const ifNoneMatchContextKey contextKey = "IF_NONE_MATCH"
+
+// etagPrefix tells entity tags of transformed bodies from upstream ones.
+const etagPrefix = "jqrp-"
+
+// setETag sets a strong entity tag of the transformed body.
+func setETag(payload []byte, response *http.Response) {
+	sum := sha256.Sum256(payload)
+	response.Header.Set("ETag", `"`+etagPrefix+hex.EncodeToString(sum[:16])+`"`)
+}
+
+// splitIfNoneMatch splits an If-None-Match header value into the entity tags
+// of transformed bodies, which jqrp compares, and the others, which upstream
+// compares in case the response is passed through. The wildcard goes to both.
+func splitIfNoneMatch(ifNoneMatch string) (string, string) {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return "*", "*"
+	}
+	var own, upstream []string
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimPrefix(tag, "W/"), `"`+etagPrefix) {
+			own = append(own, tag)
+		} else {
+			upstream = append(upstream, tag)
+		}
+	}
+	return strings.Join(own, ", "), strings.Join(upstream, ", ")
+}
+
+// writeNotModified turns a successful transformed response into 304 Not
+// Modified if its entity tag matches the client's If-None-Match header.
+func writeNotModified(response *http.Response) {
+	if !successful(response.StatusCode) {
+		return
+	}
+	etag := response.Header.Get("ETag")
+	ifNoneMatch, _ := response.Request.Context().Value(ifNoneMatchContextKey).(string)
+	if etag == "" || ifNoneMatch == "" || !etagMatches(ifNoneMatch, etag) {
+		return
+	}
+	response.Body.Close()
+	response.Body = http.NoBody
+	response.ContentLength = 0
+	response.Header.Del("Content-Length")
+	response.StatusCode = 304
+}
+
+// etagMatches reports whether the If-None-Match header value matches etag,
+// using the weak comparison of RFC 7232.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -7,12 +7,22 @@ import (
 	"net/http"
 )
 
+// upstreamAccept is the Accept header forwarded upstream along with queries,
+// since queries apply to JSON whatever the client accepts.
+const upstreamAccept = "application/json, application/*+json"
+
 // HeaderParser attaches the JQ request header value as a context key on client
 // requests.
 var HeaderParser = func(f http.HandlerFunc, logger *log.Logger) http.HandlerFunc {
+	return HeaderParserWithDefaults(f, Options{}, logger)
+}
+
+// HeaderParserWithDefaults is like HeaderParser, but takes the options missing
+// from request headers from defaults.
+var HeaderParserWithDefaults = func(f http.HandlerFunc, defaults Options, logger *log.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Accept"))
-		if err != nil || mediaType != "application/json" {
+		if err != nil || (mediaType != "application/json" && mediaType != "text/plain") {
 			f(w, r)
 			return
 		}
@@ -22,7 +32,42 @@ var HeaderParser = func(f http.HandlerFunc, logger *log.Logger) http.HandlerFunc
 			f(w, r)
 			return
 		}
+
+		if defaults.MaxQueryLength > 0 && len(rawQuery) > defaults.MaxQueryLength {
+			writeProblem(w, 431, ErrQueryTooLong.Error())
+			log.FailureResponse(logger, r, ErrQueryTooLong)
+			return
+		}
+
+		options, err := ParseOptions(r.Header, mediaType, defaults)
+		if err != nil {
+			writeProblem(w, 400, err.Error())
+			log.FailureResponse(logger, r, err)
+			return
+		}
+
+		// Raw output is produced from JSON, which upstream must respond with.
+		if mediaType == "text/plain" {
+			r.Header.Set("Accept", upstreamAccept)
+		}
+
+		// Entity tags of transformed bodies are compared by jqrp, and mean
+		// nothing to upstream. Upstream ones are forwarded, so that responses
+		// passed through untransformed keep conditional requests.
+		ifNoneMatch, upstreamIfNoneMatch := splitIfNoneMatch(r.Header.Get("If-None-Match"))
+		if upstreamIfNoneMatch != "" {
+			r.Header.Set("If-None-Match", upstreamIfNoneMatch)
+		} else {
+			r.Header.Del("If-None-Match")
+		}
+
 		log.Query(logger, r, rawQuery)
-		f(w, r.WithContext(context.WithValue(r.Context(), RawQueryContextKey, rawQuery)))
+		ctx := context.WithValue(r.Context(), RawQueryContextKey, rawQuery)
+		ctx = context.WithValue(ctx, OptionsContextKey, options)
+		if _, ok := ctx.Value(clientContextKey).(client); !ok {
+			ctx = context.WithValue(ctx, clientContextKey, clientOf(r, nil))
+		}
+		ctx = context.WithValue(ctx, ifNoneMatchContextKey, ifNoneMatch)
+		f(w, r.WithContext(ctx))
 	}
 }
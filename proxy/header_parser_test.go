@@ -3,6 +3,8 @@ package proxy
 import (
 	"github.com/bauerd/jqrp/log"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -45,3 +47,89 @@ func TestHeaderParserWithoutQueryHeader(t *testing.T) {
 	}, logger)
 	handler.ServeHTTP(nil, req)
 }
+
+func TestHeaderParserWithPlainTextAcceptHeader(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set(RawQueryHTTPHeader, "foobar")
+	logger := log.New(log.Error)
+	handler := HeaderParser(func(_ http.ResponseWriter, r *http.Request) {
+		options := r.Context().Value(OptionsContextKey).(Options)
+		if options.Output != OutputRaw {
+			t.Errorf("Output mode is %s", options.Output)
+		}
+		if accept := r.Header.Get("Accept"); accept != upstreamAccept {
+			t.Errorf("Accept header forwarded as %s", accept)
+		}
+	}, logger)
+	handler.ServeHTTP(nil, req)
+}
+
+func TestHeaderParserWithOutputHeader(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(RawQueryHTTPHeader, "foobar")
+	req.Header.Set(OutputHTTPHeader, "json")
+	logger := log.New(log.Error)
+	handler := HeaderParser(func(_ http.ResponseWriter, r *http.Request) {
+		options := r.Context().Value(OptionsContextKey).(Options)
+		if options.Output != OutputJSON {
+			t.Errorf("Output mode is %s", options.Output)
+		}
+	}, logger)
+	handler.ServeHTTP(nil, req)
+}
+
+func TestHeaderParserWithInvalidOutputHeader(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(RawQueryHTTPHeader, "foobar")
+	req.Header.Set(OutputHTTPHeader, "yaml")
+	logger := log.New(log.Error)
+	recorder := httptest.NewRecorder()
+	handler := HeaderParser(func(_ http.ResponseWriter, r *http.Request) {
+		t.Error("Handler called")
+	}, logger)
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != 400 {
+		t.Errorf("Unexpected status code %d", recorder.Code)
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, `JQ-Output \"yaml\"`) {
+		t.Errorf("Invalid option not named in %s", body)
+	}
+}
+
+func TestHeaderParserWithTooLongQuery(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(RawQueryHTTPHeader, ".foobar")
+	logger := log.New(log.Error)
+	recorder := httptest.NewRecorder()
+	handler := HeaderParserWithDefaults(func(_ http.ResponseWriter, r *http.Request) {
+		t.Error("Handler called")
+	}, Options{MaxQueryLength: 4}, logger)
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != 431 {
+		t.Errorf("Unexpected status code %d", recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/problem+json" {
+		t.Errorf("Unexpected Content-Type %s", contentType)
+	}
+}
+
+func TestHeaderParserWithStreamedEnvelope(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(RawQueryHTTPHeader, "foobar")
+	req.Header.Set(EnvelopeHTTPHeader, "true")
+	req.Header.Set(StreamHTTPHeader, "true")
+	logger := log.New(log.Error)
+	recorder := httptest.NewRecorder()
+	handler := HeaderParser(func(_ http.ResponseWriter, r *http.Request) {
+		t.Error("Handler called")
+	}, logger)
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != 400 {
+		t.Errorf("Unexpected status code %d", recorder.Code)
+	}
+}
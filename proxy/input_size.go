@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"github.com/bauerd/jqrp/jq"
+	"io"
+	"net/http"
+)
+
+// countingBody counts the bytes read from an upstream response body.
+type countingBody struct {
+	reader io.Reader
+	count  int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.count += int64(n)
+	return n, err
+}
+
+// countInputSize returns body counting the bytes read, and reports the count
+// as input size of evaluations on the request. Cached responses are parsed
+// without reading their body, so their body size is reported instead.
+func countInputSize(body io.Reader, r *http.Response) io.Reader {
+	if cached, ok := r.Body.(*cachedBody); ok {
+		size := int64(len(cached.response.body))
+		ctx := jq.WithInputSize(r.Request.Context(), func() int64 { return size })
+		r.Request = r.Request.WithContext(ctx)
+		return body
+	}
+	counting := &countingBody{reader: body}
+	ctx := jq.WithInputSize(r.Request.Context(), func() int64 { return counting.count })
+	r.Request = r.Request.WithContext(ctx)
+	return counting
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"github.com/bauerd/jqrp/json"
+	"io"
+)
+
+// bodyInputs yields the inputs decoded from an upstream body.
+type bodyInputs struct {
+	inputs json.Stream
+}
+
+func (i *bodyInputs) Next() (interface{}, error) {
+	return nextInput(i.inputs)
+}
+
+// nextInput returns the next input decoded from an upstream body. Decoding
+// errors are returned as ErrInvalidResponseBody.
+func nextInput(inputs json.Stream) (interface{}, error) {
+	input, err := inputs.Next()
+	if err == nil || err == io.EOF || err == ErrResponseBodyTooLarge {
+		return input, err
+	}
+	return nil, ErrInvalidResponseBody
+}
+
+// readValues reads the top-level values decoded from an upstream body, either
+// into an array in the slurp input mode, or as the single value in the value
+// input mode.
+func readValues(mode InputMode, inputs json.Stream) (interface{}, error) {
+	values := make([]interface{}, 0)
+	for {
+		value, err := nextInput(inputs)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	if mode == InputSlurp {
+		return values, nil
+	}
+	if len(values) != 1 {
+		return nil, ErrInvalidResponseBody
+	}
+	return values[0], nil
+}
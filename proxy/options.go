@@ -0,0 +1,438 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bauerd/jqrp/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transformation option HTTP request headers.
+const (
+	// OutputHTTPHeader is the HTTP request header where the output mode is
+	// read from.
+	OutputHTTPHeader string = "JQ-Output"
+
+	// ResultsHTTPHeader is the HTTP request header where the results mode is
+	// read from.
+	ResultsHTTPHeader string = "JQ-Results"
+
+	// EmptyHTTPHeader is the HTTP request header where the empty result mode
+	// is read from.
+	EmptyHTTPHeader string = "JQ-Empty"
+
+	// StreamHTTPHeader is the HTTP request header that enables streaming of
+	// results.
+	StreamHTTPHeader string = "JQ-Stream"
+
+	// InputHTTPHeader is the HTTP request header where the input mode is read
+	// from.
+	InputHTTPHeader string = "JQ-Input"
+
+	// FormatHTTPHeader is the HTTP request header where JSON formatting flags
+	// are read from. The upstream key order is kept only for objects passed
+	// through unchanged, others are encoded with sorted keys.
+	FormatHTTPHeader string = "JQ-Format"
+
+	// EnvelopeHTTPHeader is the HTTP request header that enables the envelope
+	// mode.
+	EnvelopeHTTPHeader string = "JQ-Envelope"
+
+	// StatusHTTPHeader is the HTTP request header where the non-successful
+	// upstream status codes to transform are read from.
+	StatusHTTPHeader string = "JQ-Status"
+
+	// SuccessStatusHTTPHeader is the HTTP request header where the status
+	// policy for successful transformations is read from.
+	SuccessStatusHTTPHeader string = "JQ-Success-Status"
+
+	// CacheHTTPHeader is the HTTP request header that enables caching of
+	// query results.
+	CacheHTTPHeader string = "JQ-Cache"
+)
+
+// optionHTTPHeaders are the request headers jqrp reads queries and
+// transformation options from. They are not forwarded upstream.
+var optionHTTPHeaders = []string{
+	RawQueryHTTPHeader,
+	OutputHTTPHeader,
+	ResultsHTTPHeader,
+	EmptyHTTPHeader,
+	StreamHTTPHeader,
+	InputHTTPHeader,
+	FormatHTTPHeader,
+	EnvelopeHTTPHeader,
+	StatusHTTPHeader,
+	SuccessStatusHTTPHeader,
+	CacheHTTPHeader,
+	RequestQueryHTTPHeader,
+}
+
+// OptionsContextKey is the context key the transformation options are stored
+// under on requests.
+const OptionsContextKey contextKey = "OPTIONS"
+
+// ErrInvalidOptions signals that a request header carried an unknown
+// transformation option.
+var ErrInvalidOptions = errors.New("invalid transformation option")
+
+// OutputMode determines how query results are written to response bodies.
+type OutputMode string
+
+const (
+	// OutputDefault writes objects and arrays as JSON, and rejects single
+	// primitive results.
+	OutputDefault OutputMode = ""
+
+	// OutputJSON writes any JSON value, including primitives and null.
+	OutputJSON OutputMode = "json"
+
+	// OutputRaw writes strings unquoted and other values as their JSON text,
+	// one result per line.
+	OutputRaw OutputMode = "raw"
+)
+
+// ResultsMode determines how multiple query results are combined.
+type ResultsMode string
+
+const (
+	// ResultsAuto writes a single result as is, and wraps multiple results
+	// into an array.
+	ResultsAuto ResultsMode = ""
+
+	// ResultsArray always wraps results into an array.
+	ResultsArray ResultsMode = "array"
+
+	// ResultsFirst writes the first result only.
+	ResultsFirst ResultsMode = "first"
+
+	// ResultsSeq writes results as an RFC 7464 JSON text sequence.
+	ResultsSeq ResultsMode = "seq"
+
+	// ResultsNDJSON writes results as newline-delimited JSON.
+	ResultsNDJSON ResultsMode = "ndjson"
+)
+
+// EmptyMode determines the response to an empty result set.
+type EmptyMode string
+
+const (
+	// EmptyAuto responds with the empty value of the upstream JSON type, i.e.
+	// {} or [], or an empty body for line-based results.
+	EmptyAuto EmptyMode = ""
+
+	// EmptyArray responds with [].
+	EmptyArray EmptyMode = "array"
+
+	// EmptyObject responds with {}.
+	EmptyObject EmptyMode = "object"
+
+	// EmptyNull responds with null.
+	EmptyNull EmptyMode = "null"
+
+	// EmptyNoContent responds with status code 204 and no body.
+	EmptyNoContent EmptyMode = "204"
+
+	// EmptyNotFound responds with status code 404 and no body.
+	EmptyNotFound EmptyMode = "404"
+)
+
+// SuccessStatus determines the status code of successfully transformed
+// responses to 2xx upstream responses.
+type SuccessStatus string
+
+const (
+	// SuccessNonAuthoritative responds with 203 Non-Authoritative Information.
+	SuccessNonAuthoritative SuccessStatus = ""
+
+	// SuccessOK responds with 200 OK.
+	SuccessOK SuccessStatus = "200"
+
+	// SuccessPreserve responds with the upstream status code, e.g. 201.
+	SuccessPreserve SuccessStatus = "preserve"
+)
+
+// InputMode determines how upstream response bodies are fed to queries.
+type InputMode string
+
+const (
+	// InputDocument parses the whole body into a single input, which must be
+	// an object or array.
+	InputDocument InputMode = ""
+
+	// InputValue parses the whole body into a single input of any JSON type.
+	InputValue InputMode = "value"
+
+	// InputSlurp parses the top-level values of the body into an array like
+	// jq --slurp.
+	InputSlurp InputMode = "slurp"
+
+	// InputInputs exposes the top-level values of the body to the query
+	// through the input and inputs functions, with null as input, like
+	// jq --null-input.
+	InputInputs InputMode = "inputs"
+
+	// InputNull ignores the body and evaluates the query with null as input,
+	// e.g. for empty bodies.
+	InputNull InputMode = "null"
+
+	// InputStream tokenizes the body incrementally into [path, leaf] events
+	// like jq --stream, each of which is a separate input.
+	InputStream InputMode = "stream"
+
+	// InputElements decodes the elements of a top-level array one at a time,
+	// each of which is a separate input.
+	InputElements InputMode = "elements"
+)
+
+// Options are the per-request transformation options. Limits are set
+// server-side only.
+type Options struct {
+	// Output is how results are written to the response body.
+	Output OutputMode
+
+	// Results is how multiple results are combined.
+	Results ResultsMode
+
+	// Empty is the response to an empty result set.
+	Empty EmptyMode
+
+	// Stream writes results to the client as they are produced.
+	Stream bool
+
+	// Input is how the upstream response body is fed to the query.
+	Input InputMode
+
+	// Format configures the JSON encoding of results.
+	Format json.Format
+
+	// Envelope makes queries transform {status, headers, body} envelopes
+	// rather than bodies.
+	Envelope bool
+
+	// Status are the non-successful upstream status codes that are
+	// transformed too.
+	Status StatusSet
+
+	// SuccessStatus is the status policy for successful transformations.
+	SuccessStatus SuccessStatus
+
+	// UserErrorStatus are the status codes that errors raised by queries
+	// may respond with.
+	UserErrorStatus StatusSet
+
+	// Cache enables caching of query results, if a result cache is
+	// configured.
+	Cache bool
+
+	// Request is the query applied to request bodies.
+	Request string
+
+	// MaxBodySize is the maximum upstream response body size in bytes.
+	MaxBodySize int64
+
+	// MaxQueryLength is the maximum query length in bytes.
+	MaxQueryLength int
+
+	// RetryAfter is how long clients are asked to wait before retrying
+	// requests rejected because the evaluator is saturated.
+	RetryAfter time.Duration
+}
+
+// ParseOptions reads transformation options from request headers. Options
+// missing from the headers are taken from defaults. The media type is the one
+// the client Accept'ed.
+func ParseOptions(header http.Header, mediaType string, defaults Options) (Options, error) {
+	options := defaults
+
+	if value := header.Get(OutputHTTPHeader); value != "" {
+		output, ok := parseOutputMode(value)
+		if !ok {
+			return options, invalidOption(OutputHTTPHeader, value)
+		}
+		options.Output = output
+	}
+	if mediaType == "text/plain" {
+		options.Output = OutputRaw
+	}
+
+	if value := header.Get(ResultsHTTPHeader); value != "" {
+		results, ok := parseResultsMode(value)
+		if !ok {
+			return options, invalidOption(ResultsHTTPHeader, value)
+		}
+		options.Results = results
+	}
+
+	if value := header.Get(EmptyHTTPHeader); value != "" {
+		empty, ok := ParseEmptyMode(value)
+		if !ok {
+			return options, invalidOption(EmptyHTTPHeader, value)
+		}
+		options.Empty = empty
+	}
+
+	if value := header.Get(StreamHTTPHeader); value != "" {
+		stream, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, invalidOption(StreamHTTPHeader, value)
+		}
+		options.Stream = stream
+	}
+
+	if value := header.Get(InputHTTPHeader); value != "" {
+		input, ok := parseInputMode(value)
+		if !ok {
+			return options, invalidOption(InputHTTPHeader, value)
+		}
+		options.Input = input
+	}
+
+	if value := header.Get(FormatHTTPHeader); value != "" {
+		format, ok := parseFormat(value, options.Format)
+		if !ok {
+			return options, invalidOption(FormatHTTPHeader, value)
+		}
+		options.Format = format
+	}
+
+	if value := header.Get(EnvelopeHTTPHeader); value != "" {
+		envelope, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, invalidOption(EnvelopeHTTPHeader, value)
+		}
+		options.Envelope = envelope
+	}
+
+	if value := header.Get(StatusHTTPHeader); value != "" {
+		status, ok := ParseStatusSet(value)
+		if !ok {
+			return options, invalidOption(StatusHTTPHeader, value)
+		}
+		options.Status = status
+	}
+
+	if value := header.Get(SuccessStatusHTTPHeader); value != "" {
+		status, ok := ParseSuccessStatus(value)
+		if !ok {
+			return options, invalidOption(SuccessStatusHTTPHeader, value)
+		}
+		options.SuccessStatus = status
+	}
+
+	if value := header.Get(CacheHTTPHeader); value != "" {
+		cache, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, invalidOption(CacheHTTPHeader, value)
+		}
+		options.Cache = cache
+	}
+
+	// Envelopes are written as a whole.
+	if options.Envelope && (options.Stream || options.Input == InputStream || options.Input == InputElements) {
+		return options, fmt.Errorf("%w: %s cannot be combined with streamed results or inputs", ErrInvalidOptions, EnvelopeHTTPHeader)
+	}
+
+	if value := header.Get(RequestQueryHTTPHeader); value != "" {
+		options.Request = value
+	}
+
+	return options, nil
+}
+
+// invalidOption returns an error naming the header carrying an invalid value.
+func invalidOption(header string, value string) error {
+	return fmt.Errorf("%w: %s %q", ErrInvalidOptions, header, value)
+}
+
+func parseOutputMode(value string) (OutputMode, bool) {
+	switch mode := OutputMode(value); mode {
+	case OutputJSON, OutputRaw:
+		return mode, true
+	}
+	return OutputDefault, false
+}
+
+func parseResultsMode(value string) (ResultsMode, bool) {
+	switch mode := ResultsMode(value); mode {
+	case ResultsArray, ResultsFirst, ResultsSeq, ResultsNDJSON:
+		return mode, true
+	case "auto":
+		return ResultsAuto, true
+	}
+	return ResultsAuto, false
+}
+
+func parseInputMode(value string) (InputMode, bool) {
+	switch mode := InputMode(value); mode {
+	case InputValue, InputSlurp, InputInputs, InputNull, InputStream, InputElements:
+		return mode, true
+	case "document":
+		return InputDocument, true
+	}
+	return InputDocument, false
+}
+
+// parseFormat applies comma-separated flags mirroring jq's to format: compact,
+// indent=N, tab, sort-keys, ascii and html-escape.
+func parseFormat(value string, format json.Format) (json.Format, bool) {
+	for _, flag := range strings.Split(value, ",") {
+		flag = strings.TrimSpace(flag)
+		switch {
+		case flag == "compact":
+			format.Indent = 0
+			format.Tab = false
+		case strings.HasPrefix(flag, "indent="):
+			indent, err := strconv.Atoi(strings.TrimPrefix(flag, "indent="))
+			if err != nil || indent < 0 || indent > 7 {
+				return format, false
+			}
+			format.Indent = indent
+			format.Tab = false
+		case flag == "tab":
+			format.Tab = true
+		case flag == "sort-keys":
+			format.SortKeys = true
+		case flag == "ascii":
+			format.ASCII = true
+		case flag == "html-escape":
+			format.EscapeHTML = true
+		default:
+			return format, false
+		}
+	}
+	return format, true
+}
+
+// ParseSuccessStatus returns the success status policy named by value.
+func ParseSuccessStatus(value string) (SuccessStatus, bool) {
+	switch status := SuccessStatus(value); status {
+	case SuccessOK, SuccessPreserve:
+		return status, true
+	case "203":
+		return SuccessNonAuthoritative, true
+	}
+	return SuccessNonAuthoritative, false
+}
+
+// ParseEmptyMode returns the empty result mode named by value.
+func ParseEmptyMode(value string) (EmptyMode, bool) {
+	switch mode := EmptyMode(value); mode {
+	case EmptyArray, EmptyObject, EmptyNull, EmptyNoContent, EmptyNotFound:
+		return mode, true
+	case "auto":
+		return EmptyAuto, true
+	}
+	return EmptyAuto, false
+}
+
+func optionsFromContext(ctx context.Context) Options {
+	if options, ok := ctx.Value(OptionsContextKey).(Options); ok {
+		return options
+	}
+	return Options{}
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"github.com/bauerd/jqrp/jq"
 	"github.com/bauerd/jqrp/log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -10,29 +11,97 @@ import (
 
 // Proxy is a mutating reverse proxy.
 type Proxy struct {
-	backend *httputil.ReverseProxy
-	logger  *log.Logger
+	backend   *httputil.ReverseProxy
+	evaluator jq.Evaluator
+	options   Options
+	routes    Routes
+	limiter   *RateLimiter
+	trusted   []*net.IPNet
+	logger    *log.Logger
+}
+
+// ProxyOptions configure a proxy beyond its upstream and evaluator. The zero
+// value configures a proxy like NewProxy does.
+type ProxyOptions struct {
+	// Options are the default transformation options.
+	Options Options
+
+	// Routes override the default options by request path.
+	Routes Routes
+
+	// CoalesceRequests coalesces concurrent identical upstream requests.
+	CoalesceRequests bool
+
+	// CoalesceBufferSize bounds the buffer of response bodies shared by
+	// coalesced requests in bytes, unless 0.
+	CoalesceBufferSize int64
+
+	// ResponseCache caches upstream responses, if set.
+	ResponseCache *ResponseCache
+
+	// RateLimiter limits the requests of clients, if set. If it limits their
+	// evaluation time, the evaluator must report evaluations to it, as the
+	// evaluator of Config.Build does.
+	RateLimiter *RateLimiter
+
+	// TrustedProxies are the networks of the proxies in front of jqrp, whose
+	// X-Forwarded-For addresses identify clients in logs. Clients are
+	// identified by their remote address otherwise.
+	TrustedProxies []*net.IPNet
 }
 
 // NewProxy returns a new proxy that mutates upstream responses by using the
 // given compiler
 func NewProxy(url *url.URL, transport http.RoundTripper, evaluator jq.Evaluator, logger *log.Logger) *Proxy {
+	return newProxy(url, transport, evaluator, ProxyOptions{}, logger)
+}
+
+// NewProxyWithOptions returns a new proxy that mutates upstream responses by
+// using the given evaluator, as configured by options.
+func NewProxyWithOptions(url *url.URL, transport http.RoundTripper, evaluator jq.Evaluator, options ProxyOptions, logger *log.Logger) (*Proxy, error) {
+	if limiter := options.RateLimiter; limiter != nil && limiter.chargesEvaluations() && !jq.Observes(evaluator, limiter) {
+		return nil, ErrRateLimiterUnobserved
+	}
+	return newProxy(url, transport, evaluator, options, logger), nil
+}
+
+func newProxy(url *url.URL, transport http.RoundTripper, evaluator jq.Evaluator, options ProxyOptions, logger *log.Logger) *Proxy {
 	backend := httputil.NewSingleHostReverseProxy(url)
-	transformer := NewTransformer(evaluator, Rewriter(logger))
+	transformer := NewStreamingTransformer(evaluator, Rewriter(logger), Streamer(logger))
 
 	// Preserve the director set by NewSingleHostReverseProxy
 	backend.Director = Director(backend.Director, logger)
 	backend.ModifyResponse = transformer.ModifyResponse
 	backend.ErrorHandler = ErrorHandler(logger)
+	if options.CoalesceRequests {
+		transport = NewCoalescingTransport(transport, options.CoalesceBufferSize)
+	}
+	if options.ResponseCache != nil {
+		transport = NewCachingTransport(transport, options.ResponseCache)
+	}
 	backend.Transport = transport
+	// Flush immediately, so that streamed results reach clients as they are
+	// produced.
+	backend.FlushInterval = -1
 
 	return &Proxy{
-		backend: backend,
-		logger:  logger,
+		backend:   backend,
+		evaluator: evaluator,
+		options:   options.Options,
+		routes:    options.Routes,
+		limiter:   options.RateLimiter,
+		trusted:   options.TrustedProxies,
+		logger:    logger,
 	}
 }
 
 // ServeHTTP serves the proxy.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	RequestID(HeaderParser(p.backend.ServeHTTP, p.logger)).ServeHTTP(w, r)
+	options := p.routes.Options(r.URL.Path, p.options)
+	forward := RequestTransformer(p.backend.ServeHTTP, p.evaluator, options, p.logger)
+	handler := HeaderParserWithDefaults(forward, options, p.logger)
+	if p.limiter != nil {
+		handler = p.limiter.Limit(handler, p.logger)
+	}
+	RequestID(identifyClient(handler, p.trusted)).ServeHTTP(w, r)
 }
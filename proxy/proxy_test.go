@@ -1,13 +1,19 @@
 package proxy
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"github.com/bauerd/jqrp/jq"
 	"github.com/bauerd/jqrp/log"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestProxyWithoutQueryHeader(t *testing.T) {
@@ -479,3 +485,1189 @@ func TestProxyXRequestIDHeader(t *testing.T) {
 	req.Header.Set("Accept", "application/json")
 	frontendClient.Do(req)
 }
+
+func TestProxyRawPrimitiveResult(t *testing.T) {
+	const backendResponse = `{"meta": {"count": 42}}`
+	const backendStatus = 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Like real JSON backends, refuse clients that do not accept JSON.
+		if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.WriteHeader(406)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(backendStatus)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("JQ", ".meta.count")
+	res, _ := frontendClient.Do(req)
+	if actual, expected := res.StatusCode, 203; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+	if actual, expected := res.Header.Get("Content-Type"), "text/plain; charset=utf-8"; actual != expected {
+		t.Errorf("Unexpected Content-Type %s; expected %s", actual, expected)
+	}
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	if actual, expected := string(bodyBytes), "42\n"; actual != expected {
+		t.Fatalf("Unexpected response body: %s", bodyBytes)
+	}
+}
+
+func TestProxyJSONPrimitiveResult(t *testing.T) {
+	const backendResponse = `{"meta": {"count": 42}}`
+	const backendStatus = 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(backendStatus)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", ".meta.missing")
+	req.Header.Set("JQ-Output", "json")
+	res, _ := frontendClient.Do(req)
+	if actual, expected := res.StatusCode, 203; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	if actual, expected := string(bodyBytes), "null"; actual != expected {
+		t.Fatalf("Unexpected response body: %s", bodyBytes)
+	}
+}
+
+func TestProxyEmptyResultNotFound(t *testing.T) {
+	const backendResponse = "[1, 2]"
+	const backendStatus = 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(backendStatus)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	proxy, _ := NewProxyWithOptions(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), ProxyOptions{Options: Options{Empty: EmptyNoContent}}, logger)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", ".[] | select(. > 2)")
+	req.Header.Set("JQ-Empty", "404")
+	res, _ := frontendClient.Do(req)
+	if actual, expected := res.StatusCode, 404; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	if actual, expected := string(bodyBytes), ""; actual != expected {
+		t.Fatalf("Unexpected response body: %s", bodyBytes)
+	}
+}
+
+func TestProxyEmptyResultConfigured(t *testing.T) {
+	const backendResponse = "[1, 2]"
+	const backendStatus = 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(backendStatus)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	proxy, _ := NewProxyWithOptions(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), ProxyOptions{Options: Options{Empty: EmptyNoContent}}, logger)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", "empty")
+	res, _ := frontendClient.Do(req)
+	if actual, expected := res.StatusCode, 204; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+}
+
+func TestProxyStreamedArrayResult(t *testing.T) {
+	const backendResponse = `[{"id": 1}, {"id": 2}]`
+	const backendStatus = 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(backendStatus)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", ".[] .id")
+	req.Header.Set("JQ-Stream", "true")
+	res, _ := frontendClient.Do(req)
+	if actual, expected := res.StatusCode, 203; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	if actual, expected := string(bodyBytes), "[1,2]"; actual != expected {
+		t.Fatalf("Unexpected response body: %s", bodyBytes)
+	}
+	if actual := res.Trailer.Get("JQ-Error"); actual != "" {
+		t.Errorf("Unexpected JQ-Error trailer %s", actual)
+	}
+}
+
+func TestProxyStreamedNDJSONError(t *testing.T) {
+	const backendResponse = `[1, 2]`
+	const backendStatus = 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(backendStatus)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", `.[] | if . == 2 then error("boom") else . end`)
+	req.Header.Set("JQ-Results", "ndjson")
+	req.Header.Set("JQ-Stream", "true")
+	res, _ := frontendClient.Do(req)
+	if actual, expected := res.StatusCode, 203; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	expectedBody := "1\n{\"error\":\"query evaluation failed: error: boom\"}\n"
+	if actual, expected := string(bodyBytes), expectedBody; actual != expected {
+		t.Fatalf("Unexpected response body: %s", bodyBytes)
+	}
+	if actual, expected := res.Trailer.Get("JQ-Error"), "query evaluation failed: error: boom"; actual != expected {
+		t.Errorf("Unexpected JQ-Error trailer %s; expected %s", actual, expected)
+	}
+}
+
+func TestProxyStreamedFailureBeforeFirstResult(t *testing.T) {
+	const backendResponse = `[1, 2]`
+	const backendStatus = 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(backendStatus)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", ".foobar")
+	req.Header.Set("JQ-Stream", "true")
+	res, _ := frontendClient.Do(req)
+	if actual, expected := res.StatusCode, 400; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+}
+
+func TestProxyElementsInput(t *testing.T) {
+	const backendResponse = `[{"id": 1, "active": true}, {"id": 2, "active": false}, {"id": 3, "active": true}]`
+	const backendStatus = 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(backendStatus)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", "select(.active) | .id")
+	req.Header.Set("JQ-Input", "elements")
+	req.Header.Set("JQ-Results", "ndjson")
+	res, _ := frontendClient.Do(req)
+	if actual, expected := res.StatusCode, 203; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	if actual, expected := string(bodyBytes), "1\n3\n"; actual != expected {
+		t.Fatalf("Unexpected response body: %s", bodyBytes)
+	}
+}
+
+func TestProxyEventStreamInput(t *testing.T) {
+	const backendResponse = `{"a": [1, 2]}`
+	const backendStatus = 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(backendStatus)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", ".")
+	req.Header.Set("JQ-Input", "stream")
+	res, _ := frontendClient.Do(req)
+	if actual, expected := res.StatusCode, 203; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	if actual, expected := string(bodyBytes), `[[["a",0],1],[["a",1],2],[["a",1]],[["a"]]]`; actual != expected {
+		t.Fatalf("Unexpected response body: %s", bodyBytes)
+	}
+}
+
+func TestProxyElementsInputNotArray(t *testing.T) {
+	const backendResponse = `{"a": [1, 2]}`
+	const backendStatus = 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(backendStatus)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", ".")
+	req.Header.Set("JQ-Input", "elements")
+	res, _ := frontendClient.Do(req)
+	if actual, expected := res.StatusCode, 502; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+}
+
+func TestProxyResponseBodyTooLarge(t *testing.T) {
+	const backendResponse = `[{"id": 1}, {"id": 2}]`
+	const backendStatus = 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(backendStatus)
+		w.(http.Flusher).Flush() // Omits Content-Length
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	proxy, _ := NewProxyWithOptions(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), ProxyOptions{Options: Options{MaxBodySize: 8}}, logger)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", ".")
+	res, _ := frontendClient.Do(req)
+	if actual, expected := res.StatusCode, 502; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	expectedBody := `{"type":"about:blank","title":"Bad Gateway","status":502,"detail":"upstream response body is too large"}`
+	if actual, expected := string(bodyBytes), expectedBody; actual != expected {
+		t.Fatalf("Unexpected response body: %s", bodyBytes)
+	}
+}
+
+func TestProxyResultLimitExceeded(t *testing.T) {
+	const backendResponse = `[1, 2, 3]`
+	const backendStatus = 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(backendStatus)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	evaluator := jq.NewLimitedQueryEvaluator(jq.QueryCompiler, jq.Limits{MaxResults: 2})
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, evaluator, logger))
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", ".[]")
+	res, _ := frontendClient.Do(req)
+	if actual, expected := res.StatusCode, 422; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+}
+
+func TestProxyNumberPrecision(t *testing.T) {
+	const backendResponse = `{"id": 9007199254740993, "max": 18446744073709551615, "min": -9223372036854775808, "decimal": 1.25, "exponent": 1e3, "tiny": 1.5e-7}`
+	const backendStatus = 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(backendStatus)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", ".")
+	res, _ := frontendClient.Do(req)
+	if actual, expected := res.StatusCode, 203; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	expectedBody := `{"id":9007199254740993,"max":18446744073709551615,"min":-9223372036854775808,"decimal":1.25,"exponent":1000,"tiny":1.5e-7}`
+	if actual, expected := string(bodyBytes), expectedBody; actual != expected {
+		t.Fatalf("Unexpected response body: %s", bodyBytes)
+	}
+}
+
+func TestProxyFormat(t *testing.T) {
+	const backendResponse = `{"b": "<x>", "a": [1]}`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	for format, expectedBody := range map[string]string{
+		"":                  `{"b":"<x>","a":[1]}`,
+		"indent=2":          "{\n  \"b\": \"<x>\",\n  \"a\": [\n    1\n  ]\n}",
+		"sort-keys,compact": `{"a":[1],"b":"<x>"}`,
+		"html-escape":       `{"b":"\u003cx\u003e","a":[1]}`,
+	} {
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("JQ", ".")
+		if format != "" {
+			req.Header.Set("JQ-Format", format)
+		}
+		res, _ := frontendClient.Do(req)
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		if actual, expected := string(bodyBytes), expectedBody; actual != expected {
+			t.Errorf("Unexpected response body for format %q: %q", format, bodyBytes)
+		}
+	}
+}
+
+// Only objects passed through unchanged keep the upstream key order. Objects
+// a query constructs or modifies have their keys sorted.
+func TestProxyKeyOrder(t *testing.T) {
+	const backendResponse = `{"c": 1, "b": {"z": 1, "y": 2}, "a": 3}`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(backendResponse))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+	frontendClient := frontend.Client()
+	for query, expectedBody := range map[string]string{
+		".":                  `{"c":1,"b":{"z":1,"y":2},"a":3}`,
+		".b":                 `{"z":1,"y":2}`,
+		"{c: .c, a: .a}":     `{"a":3,"c":1}`,
+		"{x: .b}":            `{"x":{"z":1,"y":2}}`,
+		".x = 1":             `{"a":3,"b":{"z":1,"y":2},"c":1,"x":1}`,
+		"del(.a)":            `{"b":{"z":1,"y":2},"c":1}`,
+		"with_entries(.)":    `{"a":3,"b":{"z":1,"y":2},"c":1}`,
+		".b.x = 0 | .b":      `{"x":0,"y":2,"z":1}`,
+		"[.b, {z: 1, y: 2}]": `[{"z":1,"y":2},{"y":2,"z":1}]`,
+	} {
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("JQ", query)
+		res, _ := frontendClient.Do(req)
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		if actual, expected := string(bodyBytes), expectedBody; actual != expected {
+			t.Errorf("Unexpected response body for query %q: %s", query, bodyBytes)
+		}
+	}
+}
+
+func TestProxyInputFormats(t *testing.T) {
+	for _, c := range []struct {
+		contentType, body, query, input string
+		status                          int
+		expectedBody                    string
+	}{
+		{"application/yaml", "items:\n  - id: 1\n  - id: 2\n", "[.items[].id]", "", 203, `[1,2]`},
+		{"text/csv", "id,name\n1,a\n2,b\n", "map(.name)", "", 203, `["a","b"]`},
+		{"text/csv", "id,name\n1,a\n2,b\n", ".id", "elements", 203, `["1","2"]`},
+		{"application/xml", `<a x="1"><b>c</b></a>`, ".a", "", 203, `{"@x":"1","b":"c"}`},
+		{"application/x-ndjson", "{\"id\":1}\n{\"id\":2}\n", "map(.id)", "", 203, `[1,2]`},
+		{"application/x-ndjson", "{\"id\":1}\n{\"id\":2}\n", ".id", "elements", 203, `[1,2]`},
+		{"application/vnd.api+json", `{"id":1}`, "{id}", "", 203, `{"id":1}`},
+		{"application/xml", `<a/>`, ".", "stream", 422, ""},
+		{"text/html", `<a/>`, ".", "", 502, ""},
+	} {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", c.contentType)
+			w.WriteHeader(200)
+			w.Write([]byte(c.body))
+		}))
+		backendURL, _ := url.Parse(backend.URL)
+		logger := log.New(log.Error)
+		frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("JQ", c.query)
+		if c.input != "" {
+			req.Header.Set("JQ-Input", c.input)
+		}
+		res, _ := frontend.Client().Do(req)
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		if actual, expected := res.StatusCode, c.status; actual != expected {
+			t.Errorf("Unexpected status code %d for %s; expected %d", actual, c.contentType, expected)
+		}
+		if c.status == 203 {
+			if actual, expected := string(bodyBytes), c.expectedBody; actual != expected {
+				t.Errorf("Unexpected response body for %s: %s", c.contentType, bodyBytes)
+			}
+			if actual, expected := res.Header.Get("Content-Type"), "application/json"; actual != expected && c.input == "" {
+				t.Errorf("Unexpected content type %s for %s", actual, c.contentType)
+			}
+		}
+		frontend.Close()
+		backend.Close()
+	}
+}
+
+func TestProxyInputModes(t *testing.T) {
+	for _, c := range []struct {
+		status       int
+		body, input  string
+		query        string
+		expected     int
+		expectedBody string
+	}{
+		{200, `42`, "value", ". + 1", 203, `43`},
+		{200, `"ok"`, "value", ". == \"ok\"", 203, `true`},
+		{200, `{"a":1} {"a":2}`, "value", ".", 502, ""},
+		{200, `{"a":1} {"a":2}`, "slurp", "map(.a)", 203, `[1,2]`},
+		{200, `{"b":1,"a":2} 3`, "inputs", "[., input, inputs]", 203, `[null,{"b":1,"a":2},3]`},
+		{200, `{"a":1} {"a":`, "inputs", "[inputs]", 502, ""},
+		{200, ``, "null", "{found: false}", 203, `{"found":false}`},
+		{204, ``, "null", "{found: false}", 203, `{"found":false}`},
+		{200, `42`, "", ".", 502, ""},
+	} {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c.body != "" {
+				w.Header().Set("Content-Type", "application/json")
+			}
+			w.WriteHeader(c.status)
+			w.Write([]byte(c.body))
+		}))
+		backendURL, _ := url.Parse(backend.URL)
+		logger := log.New(log.Error)
+		frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("JQ", c.query)
+		req.Header.Set("JQ-Output", "json")
+		if c.input != "" {
+			req.Header.Set("JQ-Input", c.input)
+		}
+		res, _ := frontend.Client().Do(req)
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		if actual, expected := res.StatusCode, c.expected; actual != expected {
+			t.Errorf("Unexpected status code %d for input mode %q and body %q; expected %d", actual, c.input, c.body, expected)
+		}
+		if actual, expected := string(bodyBytes), c.expectedBody; c.expected == 203 && actual != expected {
+			t.Errorf("Unexpected response body for input mode %q: %s", c.input, bodyBytes)
+		}
+		frontend.Close()
+		backend.Close()
+	}
+}
+
+func TestProxyRouteOptions(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"a":1}{"a":2}`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	config := &Config{Routes: Routes{{Prefix: "/legacy/", Options: map[string]string{"JQ-Input": "slurp"}}}}
+	proxy, _ := NewProxyWithOptions(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), config.ProxyOptions(nil), logger)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+	for path, expectedStatus := range map[string]int{"/legacy/items": 203, "/items": 502} {
+		req, _ := http.NewRequest("GET", frontend.URL+path, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("JQ", "map(.a)")
+		res, _ := frontend.Client().Do(req)
+		if actual, expected := res.StatusCode, expectedStatus; actual != expected {
+			t.Errorf("Unexpected status code %d for %s; expected %d", actual, path, expected)
+		}
+	}
+}
+
+func TestProxyRequestQuery(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		w.Write([]byte(fmt.Sprintf(`{"received":%s,"length":%d}`, body, r.ContentLength)))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+	req, _ := http.NewRequest("POST", frontend.URL, strings.NewReader(`{"first": "a", "last": "b"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("JQ-Request", `{name: "\(.first) \(.last)"}`)
+	res, _ := frontend.Client().Do(req)
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	if actual, expected := string(bodyBytes), `{"received":{"name":"a b"},"length":14}`; actual != expected {
+		t.Errorf("Unexpected response body: %s", bodyBytes)
+	}
+}
+
+func TestProxyEnvelope(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Internal", "secret")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"error": "not found"}`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+
+	for _, c := range []struct {
+		query        string
+		status       int
+		expectedBody string
+	}{
+		{`if .body.error then .status = 404 | .body = {message: .body.error} else . end`, 404, `{"message":"not found"}`},
+		{`.headers["Cache-Control"] = "max-age=60" | del(.headers["X-Internal"])`, 200, `{"error":"not found"}`},
+		{`{status: 204}`, 204, ``},
+		{`.status = 99`, 422, ``},
+		{`.headers["Transfer-Encoding"] = "gzip"`, 422, ``},
+		{`.headers["Bad Name"] = "x"`, 422, ``},
+		{`., .`, 422, ``},
+		{`.body`, 422, ``},
+	} {
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("JQ", c.query)
+		req.Header.Set("JQ-Envelope", "true")
+		res, _ := frontend.Client().Do(req)
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		if actual, expected := res.StatusCode, c.status; actual != expected {
+			t.Errorf("Unexpected status code %d for %s; expected %d", actual, c.query, expected)
+		}
+		if c.status == 422 {
+			continue
+		}
+		if actual, expected := string(bodyBytes), c.expectedBody; actual != expected {
+			t.Errorf("Unexpected response body for %s: %s", c.query, bodyBytes)
+		}
+		if c.status == 200 {
+			if res.Header.Get("Cache-Control") != "max-age=60" || res.Header.Get("X-Internal") != "" {
+				t.Errorf("Unexpected headers %v", res.Header)
+			}
+		}
+		if c.status == 404 && res.Header.Get("X-Internal") != "secret" {
+			t.Errorf("Unexpected headers %v", res.Header)
+		}
+	}
+}
+
+func TestProxyErrorStatus(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/html" {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(503)
+			w.Write([]byte(`<h1>Unavailable</h1>`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/moved":
+			w.Header().Set("Location", "/")
+			w.WriteHeader(301)
+			w.Write([]byte(`{"err": {"msg": "moved"}}`))
+			return
+		case "/unchanged":
+			w.WriteHeader(304)
+			return
+		}
+		w.WriteHeader(404)
+		w.Write([]byte(`{"err": {"msg": "no such user"}}`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	config := &Config{TransformStatus: StatusSet{classes: map[int]bool{5: true}}}
+	proxy, _ := NewProxyWithOptions(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), config.ProxyOptions(nil), logger)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	for _, c := range []struct {
+		path, status string
+		expected     int
+		expectedBody string
+	}{
+		{"/", "", 404, `{"err": {"msg": "no such user"}}`},
+		{"/", "4xx", 404, `{"error":"no such user","status":404}`},
+		{"/", "404", 404, `{"error":"no such user","status":404}`},
+		{"/html", "", 503, `<h1>Unavailable</h1>`},
+		{"/moved", "3xx", 301, `{"err": {"msg": "moved"}}`},
+		{"/moved", "301", 301, `{"err": {"msg": "moved"}}`},
+		{"/unchanged", "304", 304, ``},
+	} {
+		req, _ := http.NewRequest("GET", frontend.URL+c.path, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("JQ", "{error: .err.msg, status: $status}")
+		if c.status != "" {
+			req.Header.Set("JQ-Status", c.status)
+		}
+		client := frontend.Client()
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		res, _ := client.Do(req)
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		if actual, expected := res.StatusCode, c.expected; actual != expected {
+			t.Errorf("Unexpected status code %d for %q; expected %d", actual, c.status, expected)
+		}
+		if actual, expected := string(bodyBytes), c.expectedBody; actual != expected {
+			t.Errorf("Unexpected response body for %q: %s", c.status, bodyBytes)
+		}
+	}
+}
+
+func TestProxySuccessStatus(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	config := &Config{SuccessStatus: SuccessOK}
+	proxy, _ := NewProxyWithOptions(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), config.ProxyOptions(nil), logger)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	for policy, expectedStatus := range map[string]int{"": 200, "203": 203, "preserve": 201} {
+		for _, stream := range []string{"false", "true"} {
+			req, _ := http.NewRequest("GET", frontend.URL, nil)
+			req.Header.Set("Accept", "application/json")
+			req.Header.Set("JQ", "{id}")
+			req.Header.Set("JQ-Stream", stream)
+			if policy != "" {
+				req.Header.Set("JQ-Success-Status", policy)
+			}
+			res, _ := frontend.Client().Do(req)
+			ioutil.ReadAll(res.Body)
+			if actual, expected := res.StatusCode, expectedStatus; actual != expected {
+				t.Errorf("Unexpected status code %d for policy %q; expected %d", actual, policy, expected)
+			}
+			if actual, expected := res.Header.Get("X-Jqrp-Transformed"), "true"; actual != expected {
+				t.Errorf("Unexpected transformed header %q", actual)
+			}
+		}
+	}
+
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	res, _ := frontend.Client().Do(req)
+	if res.StatusCode != 201 || res.Header.Get("X-Jqrp-Transformed") != "" {
+		t.Errorf("Unexpected untransformed response %d %v", res.StatusCode, res.Header)
+	}
+}
+
+func TestProxyPreservedStatus(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/partial" {
+			w.Header().Set("Content-Range", "bytes 0-8/20")
+			w.WriteHeader(206)
+		} else {
+			w.WriteHeader(205)
+		}
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	config := &Config{SuccessStatus: SuccessPreserve}
+	proxy, _ := NewProxyWithOptions(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), config.ProxyOptions(nil), logger)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	for _, c := range []struct {
+		path         string
+		expected     int
+		expectedBody string
+		transformed  string
+	}{
+		{"/reset", 200, `{"id":1,"x":true}`, "true"},
+		{"/partial", 206, `{"id": 1}`, ""},
+	} {
+		req, _ := http.NewRequest("GET", frontend.URL+c.path, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("JQ", ".x = true")
+		res, _ := frontend.Client().Do(req)
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		if actual, expected := res.StatusCode, c.expected; actual != expected {
+			t.Errorf("Unexpected status code %d for %s; expected %d", actual, c.path, expected)
+		}
+		if actual, expected := string(bodyBytes), c.expectedBody; actual != expected {
+			t.Errorf("Unexpected response body for %s: %s", c.path, bodyBytes)
+		}
+		if actual, expected := res.Header.Get("X-Jqrp-Transformed"), c.transformed; actual != expected {
+			t.Errorf("Unexpected transformed header %q for %s", actual, c.path)
+		}
+	}
+}
+
+func TestProxyUserError(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	userErrorStatus, _ := ParseStatusSet("404,5xx")
+	config := &Config{UserErrorStatus: userErrorStatus}
+	proxy, _ := NewProxyWithOptions(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), config.ProxyOptions(nil), logger)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	for _, test := range []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{`error({status: 404, message: "no \(.id)"})`, 404, `{"message":"no 1","status":404}`},
+		{`error({status: 503})`, 503, `{"status":503}`},
+		{`error({status: 410})`, 400, ``},
+		{`error({status: 200})`, 400, ``},
+		{`error({status: 404.5})`, 400, ``},
+		{`error("not found")`, 400, ``},
+	} {
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("JQ", test.query)
+		res, _ := frontend.Client().Do(req)
+		body, _ := ioutil.ReadAll(res.Body)
+		if actual, expected := res.StatusCode, test.status; actual != expected {
+			t.Errorf("Unexpected status code %d for %s; expected %d", actual, test.query, expected)
+		}
+		if actual, expected := string(body), test.body; actual != expected {
+			t.Errorf("Unexpected response body %s for %s; expected %s", actual, test.query, expected)
+		}
+		if test.body != "" && res.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected content type %s", res.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestProxyETag(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"upstream"`)
+		w.Header().Set("Content-MD5", "Q2hlY2sgSW50ZWdyaXR5IQ==")
+		w.Header().Set("Digest", "sha-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=")
+		w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+		if r.Header.Get("If-None-Match") == `"upstream"` {
+			w.WriteHeader(304)
+			return
+		}
+		if strings.Contains(r.Header.Get("If-None-Match"), "jqrp-") {
+			t.Errorf("Entity tag of transformed body forwarded: %s", r.Header.Get("If-None-Match"))
+		}
+		w.Write([]byte(`{"id": 1, "name": "alpha"}`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	frontend := httptest.NewServer(NewProxy(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), logger))
+	defer frontend.Close()
+
+	get := func(query string, ifNoneMatch string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("JQ", query)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		res, _ := frontend.Client().Do(req)
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	res, _ := get("{id}", "")
+	etag := res.Header.Get("ETag")
+	if etag == "" || etag == `"upstream"` {
+		t.Fatalf("Unexpected ETag %s", etag)
+	}
+	if res.Header.Get("Content-MD5") != "" || res.Header.Get("Digest") != "" {
+		t.Errorf("Unexpected upstream digests %v", res.Header)
+	}
+	if actual, expected := res.Header.Get("Last-Modified"), "Wed, 21 Oct 2015 07:28:00 GMT"; actual != expected {
+		t.Errorf("Unexpected Last-Modified %s; expected %s", actual, expected)
+	}
+	if actual, expected := res.Header.Get("Vary"), "Accept, JQ, JQ-Output, JQ-Results, JQ-Empty, JQ-Stream, JQ-Input, JQ-Format, JQ-Envelope, JQ-Status, JQ-Success-Status, JQ-Cache, JQ-Request"; actual != expected {
+		t.Errorf("Unexpected Vary %s; expected %s", actual, expected)
+	}
+
+	if res, _ := get("{name}", ""); res.Header.Get("ETag") == etag {
+		t.Errorf("Unexpected ETag %s for another query", etag)
+	}
+
+	res, body := get("{id}", `"other", W/`+etag)
+	if actual, expected := res.StatusCode, 304; actual != expected {
+		t.Errorf("Unexpected status code %d; expected %d", actual, expected)
+	}
+	if body != "" || res.Header.Get("ETag") != etag {
+		t.Errorf("Unexpected 304 response %q %v", body, res.Header)
+	}
+
+	if res, _ := get("{name}", etag); res.StatusCode != 203 {
+		t.Errorf("Unexpected status code %d for a stale ETag", res.StatusCode)
+	}
+
+	if res, _ := get("{id}", etag+`, "upstream"`); res.StatusCode != 304 || res.Header.Get("ETag") != `"upstream"` {
+		t.Errorf("Upstream ETag not forwarded, got %d with %v", res.StatusCode, res.Header)
+	}
+
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", "{id}, {id}")
+	req.Header.Set("JQ-Stream", "true")
+	res, _ = frontend.Client().Do(req)
+	ioutil.ReadAll(res.Body)
+	if res.Header.Get("ETag") != "" || res.Header.Get("Digest") != "" {
+		t.Errorf("Unexpected validators for a streamed response %v", res.Header)
+	}
+}
+
+func TestProxyResponseCache(t *testing.T) {
+	requests := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Vary", "Accept-Language")
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		fmt.Fprintf(w, `{"b": %d, "a": %q}`, requests, r.Header.Get("Accept-Language"))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	config := &Config{ResponseCacheSize: 1 << 20}
+	components, _ := config.Build()
+	proxy, _ := NewProxyWithOptions(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), config.ProxyOptions(components), logger)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	get := func(path string, query string, language string) string {
+		req, _ := http.NewRequest("GET", frontend.URL+path, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Accept-Language", language)
+		if query != "" {
+			req.Header.Set("JQ", query)
+		}
+		res, _ := frontend.Client().Do(req)
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+
+	for _, test := range []struct {
+		path     string
+		query    string
+		language string
+		body     string
+		requests int
+	}{
+		{"/reports", ".", "en", `{"b":1,"a":"en"}`, 1},
+		{"/reports", "{b}", "en", `{"b":1}`, 1},
+		{"/reports", ".b += 1", "en", `{"a":"en","b":2}`, 1},
+		{"/reports", ".", "en", `{"b":1,"a":"en"}`, 1},
+		{"/reports", "", "en", `{"b": 2, "a": "en"}`, 2},
+		{"/reports", ".", "de", `{"b":3,"a":"de"}`, 3},
+		{"/reports", ".", "en", `{"b":1,"a":"en"}`, 3},
+		{"/reports", "{a}", "de", `{"a":"de"}`, 3},
+		{"/private", ".", "en", `{"b":4,"a":"en"}`, 4},
+		{"/private", ".", "en", `{"b":5,"a":"en"}`, 5},
+	} {
+		if actual, expected := get(test.path, test.query, test.language), test.body; actual != expected {
+			t.Errorf("Unexpected response body %s for %s; expected %s", actual, test.query, expected)
+		}
+		if requests != test.requests {
+			t.Errorf("Unexpected upstream request count %d for %s; expected %d", requests, test.query, test.requests)
+		}
+	}
+}
+
+func TestProxyResultCache(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/hot/cached" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte(`{"items": [{"z": 1, "a": 2}], "next": null}`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	logger := log.New(log.Error)
+	evaluator, _ := jq.NewCachedEvaluator(jq.NewQueryEvaluator(jq.QueryCompiler), 8, 0)
+	config := &Config{
+		ResponseCacheSize: 1 << 20,
+		Routes:            Routes{{Prefix: "/hot/", Options: map[string]string{"JQ-Cache": "true"}}},
+	}
+	components, _ := config.Build()
+	proxy, _ := NewProxyWithOptions(backendURL, http.DefaultTransport, evaluator, config.ProxyOptions(components), logger)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	for _, test := range []struct {
+		path  string
+		query string
+		cache string
+		stats jq.CacheStats
+	}{
+		{"/hot/reports", ".items", "", jq.CacheStats{Misses: 1}},
+		{"/hot/reports", ".items", "", jq.CacheStats{Hits: 1, Misses: 1}},
+		{"/hot/reports", ".items ", "", jq.CacheStats{Hits: 2, Misses: 1}},
+		{"/reports", ".items", "", jq.CacheStats{Hits: 2, Misses: 1}},
+		{"/reports", ".items", "true", jq.CacheStats{Hits: 3, Misses: 1}},
+		{"/hot/reports", ".items", "false", jq.CacheStats{Hits: 3, Misses: 1}},
+		{"/hot/cached", ".items", "", jq.CacheStats{Hits: 4, Misses: 1}},
+		{"/hot/cached", ".items", "", jq.CacheStats{Hits: 5, Misses: 1}},
+	} {
+		req, _ := http.NewRequest("GET", frontend.URL+test.path, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("JQ", test.query)
+		if test.cache != "" {
+			req.Header.Set("JQ-Cache", test.cache)
+		}
+		res, _ := frontend.Client().Do(req)
+		body, _ := ioutil.ReadAll(res.Body)
+		if actual, expected := string(body), `[{"z":1,"a":2}]`; actual != expected {
+			t.Errorf("Unexpected response body %s; expected %s", actual, expected)
+		}
+		if actual, expected := evaluator.Stats(), test.stats; actual != expected {
+			t.Errorf("Unexpected stats %+v for %s; expected %+v", actual, test.path, expected)
+		}
+	}
+}
+
+func TestProxySlowQueryLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"items": [1, 2, 3]}`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	var slowQueries bytes.Buffer
+	stats := jq.NewQueryStats(8)
+	evaluator := jq.NewStatsEvaluator(jq.NewQueryEvaluator(jq.QueryCompiler), stats, NewSlowQueryLog(&slowQueries, time.Nanosecond))
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	proxy, _ := NewProxyWithOptions(backendURL, http.DefaultTransport, evaluator, ProxyOptions{
+		TrustedProxies: []*net.IPNet{loopback, private},
+	}, log.New(log.Error))
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("JQ", ".items | map(. * 2)")
+	req.Header.Set("X-Request-ID", "abc")
+	// The client prepended the first address itself.
+	req.Header.Set("X-Forwarded-For", "198.51.100.9, 203.0.113.7, 10.0.0.1")
+	res, _ := frontend.Client().Do(req)
+	res.Body.Close()
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(slowQueries.Bytes(), &entry); err != nil {
+		t.Fatalf("Unexpected slow query log %q: %s", slowQueries.String(), err)
+	}
+	for key, expected := range map[string]interface{}{
+		"request_id":  "abc",
+		"client":      "203.0.113.7",
+		"fingerprint": ".items | map(. * ?)",
+		"input_size":  float64(20),
+		"output_size": float64(7),
+	} {
+		if entry[key] != expected {
+			t.Errorf("Unexpected %s %v in slow query log; expected %v", key, entry[key], expected)
+		}
+	}
+	if top := stats.TopByCount(1); len(top) != 1 || top[0].InputBytes != 20 {
+		t.Errorf("Unexpected query statistics: %+v", top)
+	}
+}
+
+// blockingEvaluator blocks evaluations until unblocked.
+type blockingEvaluator struct {
+	jq.Evaluator
+	unblock chan struct{}
+}
+
+func (e *blockingEvaluator) Evaluate(rawQuery string, input interface{}) ([]interface{}, error) {
+	<-e.unblock
+	return e.Evaluator.Evaluate(rawQuery, input)
+}
+
+func TestProxyEvaluatorSaturated(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	evaluator := &blockingEvaluator{Evaluator: jq.NewQueryEvaluator(jq.QueryCompiler), unblock: make(chan struct{})}
+	pool := jq.NewEvaluatorPool(evaluator, jq.PoolOptions{MaxConcurrent: 1})
+	config := &Config{RetryAfter: 1500 * time.Millisecond}
+	proxy, _ := NewProxyWithOptions(backendURL, http.DefaultTransport, pool, config.ProxyOptions(nil), log.New(log.Error+1))
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	request := func(query string) *http.Response {
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req.Header.Set("Accept", "application/json")
+		if query != "" {
+			req.Header.Set("JQ", query)
+		}
+		res, err := frontend.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	done := make(chan *http.Response)
+	go func() {
+		done <- request(".")
+	}()
+	for i := 0; i < 1000 && pool.Stats().Active == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	if res := request("."); res.StatusCode != 503 || res.Header.Get("Retry-After") != "2" {
+		t.Errorf("Expected 503 with Retry-After 2, got %d with %q", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+	if res := request(""); res.StatusCode != 200 {
+		t.Errorf("Expected pass-through 200 while saturated, got %d", res.StatusCode)
+	}
+	close(evaluator.unblock)
+	if res := <-done; res.StatusCode != 203 {
+		t.Errorf("Expected 203 once unblocked, got %d", res.StatusCode)
+	}
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	config := &Config{RateLimitKey: "header:X-API-Key", RateLimitEvalTime: 1, RateLimitEvalBurst: 1, RateLimitClients: 8, TrustedProxies: "127.0.0.1"}
+	components, err := config.Build()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	proxy, err := NewProxyWithOptions(backendURL, http.DefaultTransport, components.Evaluator, config.ProxyOptions(components), log.New(log.Error+1))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	request := func(apiKey string, results string) *http.Response {
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("JQ", "., .")
+		req.Header.Set("JQ-Results", results)
+		req.Header.Set("X-API-Key", apiKey)
+		res, _ := frontend.Client().Do(req)
+		res.Body.Close()
+		return res
+	}
+
+	// Any evaluation exhausts a budget of one millisecond.
+	if res := request("a", "array"); res.StatusCode != 203 {
+		t.Errorf("Expected 203, got %d", res.StatusCode)
+	}
+	if res := request("a", "array"); res.StatusCode != 429 || res.Header.Get("Retry-After") == "" || res.Header.Get("RateLimit-Limit") != "1" {
+		t.Errorf("Expected 429 with rate limit headers, got %d with %v", res.StatusCode, res.Header)
+	}
+	if res := request("b", "array"); res.StatusCode != 203 {
+		t.Errorf("Expected 203 for other client, got %d", res.StatusCode)
+	}
+
+	// Evaluations abandoned after the first result are charged once the
+	// request ended.
+	if res := request("c", "first"); res.StatusCode != 203 {
+		t.Errorf("Expected 203, got %d", res.StatusCode)
+	}
+	for i := 0; request("c", "first").StatusCode != 429; i++ {
+		if i == 10 {
+			t.Fatalf("Abandoned evaluation not charged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	limiter := config.ProxyOptions(components).RateLimiter
+	options := ProxyOptions{RateLimiter: limiter}
+	if _, err := NewProxyWithOptions(backendURL, http.DefaultTransport, jq.NewQueryEvaluator(jq.QueryCompiler), options, log.New(log.Error+1)); err != ErrRateLimiterUnobserved {
+		t.Errorf("Expected error for rate limiter not notified of evaluations, got %v", err)
+	}
+}
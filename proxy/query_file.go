@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/bauerd/jqrp/jq"
+	"github.com/bauerd/jqrp/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WarmQueryCache compiles the queries of the query file into cache, if any.
+// Invalid queries fail if QueryFileStrict is set, and are logged otherwise. A
+// missing query file is tolerated if queries are dumped to it.
+func (c *Config) WarmQueryCache(cache *jq.CachedCompiler, logger *log.Logger) error {
+	if c.QueryFile == "" || cache == nil {
+		return nil
+	}
+	file, err := os.Open(c.QueryFile)
+	if os.IsNotExist(err) && c.QueryDumpInterval > 0 && c.queryDumpFile() == c.QueryFile {
+		logger.Info(fmt.Sprintf("Query file %s does not exist yet", c.QueryFile))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	queries, err := jq.ReadQueries(file)
+	if err != nil {
+		return err
+	}
+
+	errs := cache.Warm(queries)
+	if len(errs) > 0 && c.QueryFileStrict {
+		return errs[0]
+	}
+	for _, err := range errs {
+		logger.Error(fmt.Sprintf("Failed to warm query cache: %s", err))
+	}
+	logger.Info(fmt.Sprintf("Warmed query cache with %d of %d queries", len(queries)-len(errs), len(queries)))
+	return nil
+}
+
+// DumpQueryCache periodically writes the hottest queries of cache, if any, to
+// the query dump file, so that the next start may warm the cache with them. It
+// returns once done is closed.
+func (c *Config) DumpQueryCache(cache *jq.CachedCompiler, done <-chan struct{}, logger *log.Logger) {
+	if c.queryDumpFile() == "" || c.QueryDumpInterval <= 0 || cache == nil {
+		return
+	}
+	ticker := time.NewTicker(c.QueryDumpInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := c.dumpQueries(cache); err != nil {
+				logger.Error(fmt.Sprintf("Failed to dump query cache: %s", err))
+			}
+		}
+	}
+}
+
+// queryDumpFile returns the file queries are dumped to, by default the query
+// file.
+func (c *Config) queryDumpFile() string {
+	if c.QueryDumpFile != "" {
+		return c.QueryDumpFile
+	}
+	return c.QueryFile
+}
+
+// dumpQueries replaces the query dump file atomically, so that it is never
+// read partially written. The file keeps its mode, and is left alone while no
+// queries are cached.
+func (c *Config) dumpQueries(cache *jq.CachedCompiler) error {
+	queries := cache.Hottest(c.QueryDumpSize)
+	if len(queries) == 0 {
+		return nil
+	}
+	name := c.queryDumpFile()
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(name); err == nil {
+		mode = info.Mode().Perm()
+	}
+	file, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if err := jq.WriteQueries(file, queries); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), name)
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"github.com/bauerd/jqrp/jq"
+	"github.com/bauerd/jqrp/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigWarmQueryCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "jqrp")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "queries")
+	ioutil.WriteFile(file, []byte(".a\n.b |\n"), 0644)
+	logger := log.New(log.Error + 1)
+
+	config := Config{CacheSize: 8, QueryFile: file}
+	components, _ := config.Build()
+	if err := config.WarmQueryCache(components.QueryCache, logger); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if entries := components.QueryCache.Snapshot().Entries; len(entries) != 1 || entries[0].Query != ".a" {
+		t.Errorf("Unexpected cached queries: %v", entries)
+	}
+
+	config = Config{CacheSize: 8, QueryFile: file, QueryFileStrict: true}
+	components, _ = config.Build()
+	if err := config.WarmQueryCache(components.QueryCache, logger); err == nil {
+		t.Errorf("Expected error on invalid query")
+	}
+}
+
+func TestConfigDumpQueries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "jqrp")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "queries")
+	ioutil.WriteFile(file, []byte("# hand-written\n.c\n"), 0640)
+
+	config := Config{CacheSize: 8, QueryFile: file, QueryDumpSize: 1}
+	components, _ := config.Build()
+	if err := config.dumpQueries(components.QueryCache); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if content, _ := ioutil.ReadFile(file); string(content) != "# hand-written\n.c\n" {
+		t.Errorf("Empty query cache was dumped: %q", content)
+	}
+
+	components.QueryCache.Warm([]string{".a", ".b", ".b"})
+	if err := config.dumpQueries(components.QueryCache); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	reader, _ := os.Open(file)
+	defer reader.Close()
+	if queries, _ := jq.ReadQueries(reader); !reflect.DeepEqual(queries, []string{".b"}) {
+		t.Errorf("Unexpected dumped queries: %q", queries)
+	}
+	if info, _ := os.Stat(file); info.Mode().Perm() != 0640 {
+		t.Errorf("Unexpected file mode %s", info.Mode())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Temporary file not removed")
+	}
+
+	dump := filepath.Join(dir, "dump")
+	config.QueryDumpFile = dump
+	if err := config.dumpQueries(components.QueryCache); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if info, err := os.Stat(dump); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Unexpected dump file: %v", err)
+	}
+}
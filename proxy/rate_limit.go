@@ -0,0 +1,384 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/bauerd/jqrp/jq"
+	"github.com/bauerd/jqrp/log"
+	lru "github.com/hashicorp/golang-lru"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// evaluationBudgetContextKey is the context key the evaluation time budget of
+// the client is stored under on requests, to be charged after evaluations.
+const evaluationBudgetContextKey contextKey = "EVALUATION_BUDGET"
+
+// RateLimit configures per-client token buckets of requests and of evaluation
+// time. Zero rates disable the respective budget.
+type RateLimit struct {
+	// Key identifies clients by "ip", the remote address, "forwarded", the
+	// X-Forwarded-For address appended by the outermost trusted proxy,
+	// "header:<name>", a request header set by a trusted proxy, or
+	// "jwt:<claim>", a claim of the verified bearer token. Clients without the
+	// header or a valid token are identified by the remote address.
+	Key string `json:"key"`
+
+	// Requests is the number of requests per minute.
+	Requests int `json:"requests"`
+
+	// Burst is the maximum number of requests at once. It defaults to
+	// Requests.
+	Burst int `json:"burst"`
+
+	// EvaluationTime is the evaluation time per minute in milliseconds.
+	EvaluationTime int `json:"evaluation_time"`
+
+	// EvaluationBurst is the maximum evaluation time at once in
+	// milliseconds. It defaults to EvaluationTime.
+	EvaluationBurst int `json:"evaluation_burst"`
+}
+
+// validRateLimitKey reports whether key identifies clients.
+func validRateLimitKey(key string) bool {
+	switch {
+	case key == "ip", key == "forwarded":
+		return true
+	case strings.HasPrefix(key, "header:"):
+		return len(key) > len("header:")
+	case strings.HasPrefix(key, "jwt:"):
+		return len(key) > len("jwt:")
+	}
+	return false
+}
+
+// validate reports an invalid client key.
+func (l RateLimit) validate() error {
+	if l.Key != "" && !validRateLimitKey(l.Key) {
+		return fmt.Errorf("invalid rate limit key %q", l.Key)
+	}
+	return nil
+}
+
+// clientKey identifies the client of r as key says.
+func (l *RateLimiter) clientKey(key string, r *http.Request) string {
+	switch {
+	case key == "forwarded":
+		return "ip:" + trustedAddress(r, l.options.TrustedProxies)
+	case strings.HasPrefix(key, "header:"):
+		// Only trusted proxies may set the header, as clients could
+		// otherwise pick their key.
+		if !trustedProxy(remoteAddress(r), l.options.TrustedProxies) {
+			break
+		}
+		if value := r.Header.Get(strings.TrimPrefix(key, "header:")); value != "" {
+			return "header:" + value
+		}
+	case strings.HasPrefix(key, "jwt:"):
+		if value, ok := l.jwtClaim(r, strings.TrimPrefix(key, "jwt:")); ok {
+			return "jwt:" + value
+		}
+	}
+	return "ip:" + remoteAddress(r)
+}
+
+// jwtClaim returns a string or number claim of the bearer token of r. Unless
+// tokens are verified in front of jqrp, only HS256 tokens signed with the
+// secret are accepted. Expired tokens are not.
+func (l *RateLimiter) jwtClaim(r *http.Request, claim string) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(authorization, "Bearer "), ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	if !l.options.JWTVerified && !verifyJWT(parts, l.options.JWTSecret) {
+		return "", false
+	}
+	var claims map[string]interface{}
+	if !decodeJWTPart(parts[1], &claims) {
+		return "", false
+	}
+	if exp, ok := claims["exp"].(json.Number); ok {
+		if seconds, err := exp.Float64(); err != nil || float64(l.now().Unix()) >= seconds {
+			return "", false
+		}
+	}
+	switch value := claims[claim].(type) {
+	case string:
+		return value, value != ""
+	case json.Number:
+		return value.String(), true
+	}
+	return "", false
+}
+
+// verifyJWT reports whether the parts of a token are signed with secret by
+// HS256.
+func verifyJWT(parts []string, secret []byte) bool {
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if len(secret) == 0 || !decodeJWTPart(parts[0], &header) || header.Alg != "HS256" {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a token into v.
+func decodeJWTPart(part string, v interface{}) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(decoded))
+	decoder.UseNumber()
+	return decoder.Decode(v) == nil
+}
+
+// tokenBucket is a token bucket refilled at rate tokens per nanosecond up to
+// burst tokens. Its tokens may become negative when charged after the fact.
+type tokenBucket struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimitState is the state of a token bucket as sent in RateLimit headers.
+type rateLimitState struct {
+	limit      int
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+func newTokenBucket(perMinute int, burst int, now time.Time) *tokenBucket {
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &tokenBucket{
+		rate:    float64(perMinute) / float64(time.Minute),
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		updated: now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+float64(now.Sub(b.updated))*b.rate)
+	b.updated = now
+}
+
+// take removes cost tokens if at least one token is left, and reports whether
+// it did.
+func (b *tokenBucket) take(cost float64, now time.Time) (bool, rateLimitState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens < 1 {
+		return false, b.state()
+	}
+	b.tokens -= cost
+	return true, b.state()
+}
+
+// charge removes cost tokens, even if none are left.
+func (b *tokenBucket) charge(cost float64, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens -= cost
+}
+
+func (b *tokenBucket) state() rateLimitState {
+	state := rateLimitState{
+		limit:     int(b.burst),
+		remaining: int(math.Max(0, math.Floor(b.tokens))),
+		reset:     time.Duration(math.Ceil((b.burst - b.tokens) / b.rate)),
+	}
+	if b.tokens < 1 {
+		state.retryAfter = time.Duration(math.Ceil((1 - b.tokens) / b.rate))
+	}
+	return state
+}
+
+// RateLimiterOptions configure how a RateLimiter tracks and identifies
+// clients.
+type RateLimiterOptions struct {
+	// Clients is the number of clients whose buckets are kept.
+	Clients int
+
+	// TrustedProxies are the networks of the proxies in front of jqrp, which
+	// are trusted to append the address of their client to X-Forwarded-For,
+	// and to set the headers "header:<name>" keys identify clients by. These
+	// keys require them.
+	TrustedProxies []*net.IPNet
+
+	// JWTSecret verifies the HS256 signature of the tokens "jwt:<claim>" keys
+	// identify clients by.
+	JWTSecret []byte
+
+	// JWTVerified trusts tokens as verified in front of jqrp, instead of
+	// verifying them with JWTSecret.
+	JWTVerified bool
+}
+
+// RateLimiter limits the requests and evaluation time of clients by token
+// buckets, as the default rate limit or the rate limit of the matching route
+// configures. Only the buckets of up to a maximum number of clients are kept.
+type RateLimiter struct {
+	defaults RateLimit
+	routes   Routes
+	options  RateLimiterOptions
+	buckets  *lru.Cache
+	now      func() time.Time
+}
+
+// NewRateLimiter returns a rate limiter as options configure. Keys that
+// cannot identify clients reliably with these options are refused.
+func NewRateLimiter(defaults RateLimit, routes Routes, options RateLimiterOptions) (*RateLimiter, error) {
+	keys := []string{defaults.Key}
+	for _, route := range routes {
+		if route.RateLimit != nil {
+			keys = append(keys, route.RateLimit.Key)
+		}
+	}
+	for _, key := range keys {
+		if (key == "forwarded" || strings.HasPrefix(key, "header:")) && len(options.TrustedProxies) == 0 {
+			return nil, fmt.Errorf("rate limit key %q requires trusted proxies", key)
+		}
+		if strings.HasPrefix(key, "jwt:") && len(options.JWTSecret) == 0 && !options.JWTVerified {
+			return nil, fmt.Errorf("rate limit key %q requires a JWT secret, or tokens verified in front of jqrp", key)
+		}
+	}
+	buckets, err := lru.New(options.Clients)
+	if err != nil {
+		return nil, err
+	}
+	return &RateLimiter{defaults: defaults, routes: routes, options: options, buckets: buckets, now: time.Now}, nil
+}
+
+// chargesEvaluations reports whether any rate limit has an evaluation time
+// budget, which evaluations must be observed to charge.
+func (l *RateLimiter) chargesEvaluations() bool {
+	limited := l.defaults.EvaluationTime > 0
+	for _, route := range l.routes {
+		limited = limited || (route.RateLimit != nil && route.RateLimit.EvaluationTime > 0)
+	}
+	return limited
+}
+
+// limit returns the rate limit of path, and the scope of its buckets.
+func (l *RateLimiter) limit(path string) (RateLimit, string) {
+	route, ok := l.routes.Match(path)
+	if !ok || route.RateLimit == nil {
+		return l.defaults, ""
+	}
+	limit := *route.RateLimit
+	if limit.Key == "" {
+		limit.Key = l.defaults.Key
+	}
+	return limit, route.Prefix
+}
+
+// bucket returns the bucket of a budget of a client, created full if new.
+func (l *RateLimiter) bucket(key string, perMinute int, burst int) *tokenBucket {
+	bucket := newTokenBucket(perMinute, burst, l.now())
+	previous, ok, _ := l.buckets.PeekOrAdd(key, bucket)
+	if ok {
+		l.buckets.Get(key)
+		return previous.(*tokenBucket)
+	}
+	return bucket
+}
+
+// Limit answers requests of clients that exhausted their request budget, or
+// their evaluation time budget if the request carries a query, with 429.
+// Allowed requests carry the evaluation time budget to be charged. Their
+// context is canceled once the request ends, so that evaluations abandoned
+// before all results were produced are charged too.
+func (l *RateLimiter) Limit(f http.HandlerFunc, logger *log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, scope := l.limit(r.URL.Path)
+		client := scope + " " + l.clientKey(limit.Key, r)
+
+		if limit.Requests > 0 {
+			bucket := l.bucket("requests "+client, limit.Requests, limit.Burst)
+			ok, state := bucket.take(1, l.now())
+			setRateLimitHeaders(w, state)
+			if !ok {
+				writeRateLimited(w, state)
+				log.FailureResponse(logger, r, ErrRateLimitExceeded)
+				return
+			}
+		}
+
+		if limit.EvaluationTime > 0 {
+			bucket := l.bucket("evaluation "+client, limit.EvaluationTime, limit.EvaluationBurst)
+			if hasQuery(r, l.routes) {
+				if ok, state := bucket.take(0, l.now()); !ok {
+					setRateLimitHeaders(w, state)
+					writeRateLimited(w, state)
+					log.FailureResponse(logger, r, ErrRateLimitExceeded)
+					return
+				}
+			}
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			r = r.WithContext(context.WithValue(ctx, evaluationBudgetContextKey, bucket))
+		}
+		f(w, r)
+	}
+}
+
+// Observe charges the evaluation time to the budget of the client.
+func (l *RateLimiter) Observe(ctx context.Context, evaluation jq.Evaluation) {
+	if bucket, ok := ctx.Value(evaluationBudgetContextKey).(*tokenBucket); ok {
+		bucket.charge(float64(evaluation.Duration)/float64(time.Millisecond), l.now())
+	}
+}
+
+// hasQuery reports whether r carries a query applied to the response or
+// request body, or its route applies one to request bodies.
+func hasQuery(r *http.Request, routes Routes) bool {
+	if r.Header.Get(RawQueryHTTPHeader) != "" || r.Header.Get(RequestQueryHTTPHeader) != "" {
+		return true
+	}
+	return routes.Options(r.URL.Path, Options{}).Request != ""
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, state rateLimitState) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(state.limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(state.remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(state.reset)))
+}
+
+func writeRateLimited(w http.ResponseWriter, state rateLimitState) {
+	w.Header().Set("Retry-After", strconv.Itoa(seconds(state.retryAfter)))
+	writeProblem(w, 429, ErrRateLimitExceeded.Error())
+}
+
+// seconds rounds d up to seconds.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
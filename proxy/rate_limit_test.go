@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/bauerd/jqrp/jq"
+	"github.com/bauerd/jqrp/log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(60, 2, now)
+	for i := 0; i < 2; i++ {
+		if ok, _ := bucket.take(1, now); !ok {
+			t.Fatalf("Request %d within burst denied", i)
+		}
+	}
+	ok, state := bucket.take(1, now)
+	if ok || state.remaining != 0 || state.retryAfter != time.Second || state.reset != 2*time.Second {
+		t.Errorf("Unexpected state %+v of exhausted bucket", state)
+	}
+	if ok, _ := bucket.take(1, now.Add(time.Second)); !ok {
+		t.Errorf("Bucket not refilled")
+	}
+
+	bucket.charge(3, now.Add(time.Second))
+	if ok, state := bucket.take(0, now.Add(3*time.Second)); ok || state.retryAfter != 2*time.Second {
+		t.Errorf("Expected charged bucket to be exhausted for 2s, got %+v", state)
+	}
+	if ok, state := bucket.take(0, now.Add(time.Minute)); !ok || state.remaining != 2 {
+		t.Errorf("Bucket refilled beyond burst: %+v", state)
+	}
+}
+
+// signJWT returns an HS256 token of claims signed with secret.
+func signJWT(claims string, secret string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	unsigned := encode([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + encode([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + encode(mac.Sum(nil))
+}
+
+func TestRateLimitClientKey(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	limiter, _ := NewRateLimiter(RateLimit{Key: "ip"}, nil, RateLimiterOptions{
+		Clients:        8,
+		TrustedProxies: []*net.IPNet{trusted},
+		JWTSecret:      []byte("secret"),
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.9, 203.0.113.7, 10.0.0.1")
+	req.Header.Set("X-API-Key", "secret")
+	req.Header.Set("Authorization", "Bearer "+signJWT(`{"sub": "alice", "tenant": 42}`, "secret"))
+
+	for key, expected := range map[string]string{
+		"ip":               "ip:10.0.0.2",
+		"forwarded":        "ip:203.0.113.7",
+		"header:X-API-Key": "header:secret",
+		"header:X-Other":   "ip:10.0.0.2",
+		"jwt:sub":          "jwt:alice",
+		"jwt:tenant":       "jwt:42",
+		"jwt:missing":      "ip:10.0.0.2",
+	} {
+		if actual := limiter.clientKey(key, req); actual != expected {
+			t.Errorf("Unexpected client key %q for %s; expected %q", actual, key, expected)
+		}
+	}
+
+	req.RemoteAddr = "192.0.2.1:1234"
+	if actual := limiter.clientKey("forwarded", req); actual != "ip:192.0.2.1" {
+		t.Errorf("X-Forwarded-For of untrusted client used: %q", actual)
+	}
+	if actual := limiter.clientKey("header:X-API-Key", req); actual != "ip:192.0.2.1" {
+		t.Errorf("Header of untrusted client used: %q", actual)
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub": "mallory"}`))
+	for _, token := range []string{
+		signJWT(`{"sub": "alice"}`, "other"),
+		signJWT(`{"sub": "alice", "exp": 1}`, "secret"),
+		"eyJhbGciOiJub25lIn0." + payload + ".",
+	} {
+		req.Header.Set("Authorization", "Bearer "+token)
+		if actual := limiter.clientKey("jwt:sub", req); actual != "ip:192.0.2.1" {
+			t.Errorf("Invalid token %s accepted as %q", token, actual)
+		}
+	}
+
+	limiter, _ = NewRateLimiter(RateLimit{Key: "jwt:sub"}, nil, RateLimiterOptions{Clients: 8, JWTVerified: true})
+	req.Header.Set("Authorization", "Bearer header."+payload+".signature")
+	if actual := limiter.clientKey("jwt:sub", req); actual != "jwt:mallory" {
+		t.Errorf("Token verified in front not accepted: %q", actual)
+	}
+}
+
+func TestNewRateLimiterUntrustedKeys(t *testing.T) {
+	for _, key := range []string{"forwarded", "header:X-API-Key", "jwt:sub"} {
+		if _, err := NewRateLimiter(RateLimit{Key: key}, nil, RateLimiterOptions{Clients: 8}); err == nil {
+			t.Errorf("Expected error for key %s without trust configured", key)
+		}
+		routes := Routes{{Prefix: "/reports", RateLimit: &RateLimit{Key: key}}}
+		if _, err := NewRateLimiter(RateLimit{Key: "ip"}, routes, RateLimiterOptions{Clients: 8}); err == nil {
+			t.Errorf("Expected error for route key %s without trust configured", key)
+		}
+	}
+}
+
+func TestRateLimiterRequests(t *testing.T) {
+	routes := Routes{{Prefix: "/reports", RateLimit: &RateLimit{Requests: 60, Burst: 1}}}
+	limiter, _ := NewRateLimiter(RateLimit{Key: "ip", Requests: 60, Burst: 2}, routes, RateLimiterOptions{Clients: 8})
+	handler := limiter.Limit(func(w http.ResponseWriter, r *http.Request) {}, log.New(log.Error+1))
+	request := func(path string, address string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = address + ":1234"
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder
+	}
+
+	for i, expected := range []int{200, 200, 429} {
+		if recorder := request("/", "192.0.2.1"); recorder.Code != expected {
+			t.Errorf("Expected %d for request %d, got %d", expected, i, recorder.Code)
+		}
+	}
+	recorder := request("/", "192.0.2.1")
+	for header, expected := range map[string]string{
+		"RateLimit-Limit":     "2",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "2",
+		"Retry-After":         "1",
+	} {
+		if actual := recorder.Header().Get(header); actual != expected {
+			t.Errorf("Unexpected %s %q; expected %q", header, actual, expected)
+		}
+	}
+
+	if recorder := request("/", "192.0.2.2"); recorder.Code != 200 {
+		t.Errorf("Other client limited, got %d", recorder.Code)
+	}
+	if recorder := request("/reports", "192.0.2.1"); recorder.Code != 200 || recorder.Header().Get("RateLimit-Limit") != "1" {
+		t.Errorf("Route without budget of its own, got %d", recorder.Code)
+	}
+	if recorder := request("/reports", "192.0.2.1"); recorder.Code != 429 {
+		t.Errorf("Route limit not applied, got %d", recorder.Code)
+	}
+}
+
+func TestRateLimiterEvaluationTime(t *testing.T) {
+	limiter, _ := NewRateLimiter(RateLimit{Key: "ip", EvaluationTime: 60000, EvaluationBurst: 100}, nil, RateLimiterOptions{Clients: 8})
+	handler := limiter.Limit(func(w http.ResponseWriter, r *http.Request) {
+		limiter.Observe(r.Context(), jq.Evaluation{Duration: 150 * time.Millisecond})
+	}, log.New(log.Error+1))
+	request := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if query != "" {
+			req.Header.Set("JQ", query)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder
+	}
+
+	if recorder := request("."); recorder.Code != 200 {
+		t.Errorf("Expected first evaluation to be allowed, got %d", recorder.Code)
+	}
+	recorder := request(".")
+	if recorder.Code != 429 || recorder.Header().Get("RateLimit-Limit") != "100" || recorder.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 after evaluation budget was exhausted, got %d with %v", recorder.Code, recorder.Header())
+	}
+	if recorder := request(""); recorder.Code != 200 {
+		t.Errorf("Request without query limited by evaluation budget, got %d", recorder.Code)
+	}
+	limiter.Observe(context.Background(), jq.Evaluation{Duration: time.Second})
+}
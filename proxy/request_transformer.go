@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"github.com/bauerd/jqrp/jq"
+	"github.com/bauerd/jqrp/json"
+	"github.com/bauerd/jqrp/log"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RequestQueryHTTPHeader is the HTTP request header where the jq query applied
+// to request bodies is read from.
+const RequestQueryHTTPHeader string = "JQ-Request"
+
+// RequestTransformer applies a query to JSON request bodies before they are
+// forwarded. The query is read from the JQ-Request header, or else from the
+// route options. Invalid bodies and results are answered with 400 before the
+// upstream is called, and failed evaluations like those of response queries.
+var RequestTransformer = func(f http.HandlerFunc, evaluator jq.Evaluator, defaults Options, logger *log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rawQuery := r.Header.Get(RequestQueryHTTPHeader)
+		if rawQuery == "" {
+			rawQuery = defaults.Request
+		}
+		if rawQuery == "" || r.Body == nil || r.Body == http.NoBody || !isJSONRequest(r) {
+			f(w, r)
+			return
+		}
+
+		if defaults.MaxQueryLength > 0 && len(rawQuery) > defaults.MaxQueryLength {
+			writeProblem(w, 431, ErrQueryTooLong.Error())
+			log.FailureResponse(logger, r, ErrQueryTooLong)
+			return
+		}
+
+		body, err := transformRequestBody(r, evaluator, rawQuery, defaults.MaxBodySize)
+		switch err {
+		case nil:
+		case ErrRequestBodyTooLarge, ErrInvalidRequestBody, ErrIllegalRequestQueryResult:
+			writeProblem(w, 400, err.Error())
+			log.FailureResponse(logger, r, err)
+			return
+		default:
+			// Requests without a response query carry no options yet.
+			if _, ok := r.Context().Value(OptionsContextKey).(Options); !ok {
+				r = r.WithContext(context.WithValue(r.Context(), OptionsContextKey, defaults))
+			}
+			ErrorHandler(logger)(w, r, err)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.TransferEncoding = nil
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		f(w, r)
+	}
+}
+
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// transformRequestBody applies rawQuery to the request body, which must yield
+// exactly one result.
+func transformRequestBody(r *http.Request, evaluator jq.Evaluator, rawQuery string, maxBodySize int64) ([]byte, error) {
+	defer r.Body.Close()
+	if maxBodySize > 0 && r.ContentLength > maxBodySize {
+		return nil, ErrRequestBodyTooLarge
+	}
+	inputs := json.NewValueStream(limitBody(r.Body, maxBodySize))
+	input, err := readValues(InputValue, inputs)
+	if err == ErrResponseBodyTooLarge {
+		return nil, ErrRequestBodyTooLarge
+	}
+	if err != nil {
+		return nil, ErrInvalidRequestBody
+	}
+
+	iterator, err := jq.Stream(r.Context(), evaluator, rawQuery, input)
+	if err != nil {
+		return nil, err
+	}
+	results, err := jq.Collect(iterator)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != 1 {
+		return nil, ErrIllegalRequestQueryResult
+	}
+	return json.Marshal(results[0], json.Format{}, inputs.KeyOrder())
+}
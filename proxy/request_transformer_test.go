@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"github.com/bauerd/jqrp/jq"
+	"github.com/bauerd/jqrp/log"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestTransformer(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"name": "a", "id": 1}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(RequestQueryHTTPHeader, "{user: .}")
+	logger := log.New(log.Error)
+	called := false
+	handler := RequestTransformer(func(_ http.ResponseWriter, r *http.Request) {
+		called = true
+		body, _ := ioutil.ReadAll(r.Body)
+		if actual, expected := string(body), `{"user":{"name":"a","id":1}}`; actual != expected {
+			t.Errorf("Unexpected body %s", actual)
+		}
+		if r.ContentLength != int64(len(body)) || r.Header.Get("Content-Length") != "28" {
+			t.Errorf("Unexpected content length %d", r.ContentLength)
+		}
+	}, jq.NewQueryEvaluator(jq.QueryCompiler), Options{}, logger)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !called {
+		t.Errorf("Request not forwarded")
+	}
+}
+
+func TestRequestTransformerRouteQuery(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "/", strings.NewReader(`[1, 2]`))
+	req.Header.Set("Content-Type", "application/vnd.api+json")
+	logger := log.New(log.Error)
+	handler := RequestTransformer(func(_ http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if actual, expected := string(body), `3`; actual != expected {
+			t.Errorf("Unexpected body %s", actual)
+		}
+	}, jq.NewQueryEvaluator(jq.QueryCompiler), Options{Request: "add"}, logger)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestRequestTransformerWithoutJSONBody(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(`a=b`))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(RequestQueryHTTPHeader, "{user: .}")
+	logger := log.New(log.Error)
+	handler := RequestTransformer(func(_ http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if actual, expected := string(body), `a=b`; actual != expected {
+			t.Errorf("Unexpected body %s", actual)
+		}
+	}, jq.NewQueryEvaluator(jq.QueryCompiler), Options{}, logger)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestRequestTransformerFailures(t *testing.T) {
+	for _, c := range []struct {
+		body, query string
+	}{
+		{`{"id": 1}`, ".id, .id"},
+		{`{"id": 1}`, "empty"},
+		{`{"id": `, "."},
+		{`{"id": 1}{}`, "."},
+	} {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(c.body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(RequestQueryHTTPHeader, c.query)
+		logger := log.New(log.Error)
+		handler := RequestTransformer(func(_ http.ResponseWriter, r *http.Request) {
+			t.Errorf("Request with query %s forwarded", c.query)
+		}, jq.NewQueryEvaluator(jq.QueryCompiler), Options{}, logger)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != 400 {
+			t.Errorf("Unexpected status code %d for query %s", recorder.Code, c.query)
+		}
+		if actual, expected := recorder.Header().Get("Content-Type"), "application/problem+json"; actual != expected {
+			t.Errorf("Unexpected content type %s", actual)
+		}
+	}
+}
+
+func TestRequestTransformerEvaluationFailures(t *testing.T) {
+	limited := jq.NewLimitedQueryEvaluator(jq.QueryCompiler, jq.Limits{MaxResults: 1})
+	for _, c := range []struct {
+		query  string
+		status int
+	}{
+		{"{!id}", 400},
+		{`error("boom")`, 400},
+		{`error({status: 409})`, 409},
+		{"[.id, .id][]", 422},
+		{"last(range(1e9))", 408},
+		{"error({status: 200})", 400},
+	} {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"id": 1}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(RequestQueryHTTPHeader, c.query)
+		userErrorStatus, _ := ParseStatusSet("4xx")
+		handler := RequestTransformer(func(_ http.ResponseWriter, r *http.Request) {
+			t.Errorf("Request with query %s forwarded", c.query)
+		}, jq.NewTimeoutEvaluator(limited, 10*time.Millisecond), Options{UserErrorStatus: userErrorStatus}, log.New(log.Error+1))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != c.status {
+			t.Errorf("Unexpected status code %d for query %s; expected %d", recorder.Code, c.query, c.status)
+		}
+	}
+}
+
+func TestRequestTransformerBodyTooLarge(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"id": 1}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(RequestQueryHTTPHeader, ".")
+	logger := log.New(log.Error)
+	handler := RequestTransformer(func(_ http.ResponseWriter, r *http.Request) {
+		t.Errorf("Request forwarded")
+	}, jq.NewQueryEvaluator(jq.QueryCompiler), Options{MaxBodySize: 4}, logger)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != 400 || !strings.Contains(recorder.Body.String(), ErrRequestBodyTooLarge.Error()) {
+		t.Errorf("Unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"github.com/bauerd/jqrp/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCache is an in-memory cache of upstream responses, bounded by size
+// in bytes and evicting least recently used responses first. Responses are
+// cached as HTTP caches would, and keep their parsed body, so that queries
+// sent to the same upstream resource are evaluated without fetching or
+// parsing it again.
+type ResponseCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	maxTTL  time.Duration
+	size    int64
+	entries map[string]*list.Element
+	// variants are the cached variants of resources, by cacheKey.
+	variants map[string]*variants
+	lru      *list.List
+	now      func() time.Time
+}
+
+// variants are the cached responses to a resource, which are selected by the
+// request headers named by the Vary header of its latest response.
+type variants struct {
+	vary  []string
+	count int
+}
+
+// NewResponseCache returns a response cache of given maximum size in bytes.
+// Responses are cached for at most maxTTL, unless maxTTL is 0.
+func NewResponseCache(maxSize int64, maxTTL time.Duration) *ResponseCache {
+	return &ResponseCache{
+		maxSize:  maxSize,
+		maxTTL:   maxTTL,
+		entries:  map[string]*list.Element{},
+		variants: map[string]*variants{},
+		lru:      list.New(),
+		now:      time.Now,
+	}
+}
+
+// cachedResponse is a cached upstream response.
+type cachedResponse struct {
+	key        string
+	statusCode int
+	header     http.Header
+	body       []byte
+	// hash is the hex-encoded SHA-256 hash of the body.
+	hash string
+	// vary are the names of the request headers the response was selected
+	// by.
+	vary    []string
+	stored  time.Time
+	expires time.Time
+
+	once     sync.Once
+	document interface{}
+	order    *json.KeyOrder
+	err      error
+}
+
+// size estimates the memory used by the response, counting the body twice for
+// its parsed document.
+func (c *cachedResponse) size() int64 {
+	size := int64(len(c.key) + 2*len(c.body))
+	for name, values := range c.header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
+
+// resource returns the cacheKey of the response's resource.
+func (c *cachedResponse) resource() string {
+	return strings.SplitN(c.key, "\n", 2)[0]
+}
+
+// response returns a new upstream response to req from the cached one.
+func (c *cachedResponse) response(req *http.Request, now time.Time) *http.Response {
+	header := c.header.Clone()
+	header.Set("Age", strconv.Itoa(int(now.Sub(c.stored).Seconds())))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", c.statusCode, http.StatusText(c.statusCode)),
+		StatusCode:    c.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          &cachedBody{Reader: bytes.NewReader(c.body), response: c},
+		ContentLength: int64(len(c.body)),
+		Request:       req,
+	}
+}
+
+// parse returns a copy of the parsed body, which is parsed on first use. The
+// parsed body is copied for each query, as gojq normalizes the numbers of its
+// input in place. Copying is still cheaper than parsing.
+func (c *cachedResponse) parse(decoder Decoder) (interface{}, *json.KeyOrder, error) {
+	c.once.Do(func() {
+		c.document, c.order, c.err = decoder.Parse(bytes.NewReader(c.body))
+	})
+	if c.err != nil {
+		return nil, nil, c.err
+	}
+	document, order := json.Copy(c.document, c.order)
+	return document, order, nil
+}
+
+// cachedBody is the body of a cached response.
+type cachedBody struct {
+	*bytes.Reader
+	response *cachedResponse
+}
+
+// Close does nothing.
+func (b *cachedBody) Close() error {
+	return nil
+}
+
+// get returns the fresh cached response to req, if any.
+func (c *ResponseCache) get(req *http.Request) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resource := cacheKey(req)
+	variants, ok := c.variants[resource]
+	if !ok {
+		return nil, false
+	}
+	element, ok := c.entries[variantKey(resource, req, variants.vary)]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cachedResponse)
+	if !c.now().Before(entry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return entry, true
+}
+
+// add caches entry, replacing any response cached under the same key, and
+// evicts the least recently used responses beyond the maximum size.
+func (c *ResponseCache) add(entry *cachedResponse) {
+	size := entry.size()
+	if size > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += size
+	resource := entry.resource()
+	if _, ok := c.variants[resource]; !ok {
+		c.variants[resource] = &variants{}
+	}
+	c.variants[resource].vary = entry.vary
+	c.variants[resource].count++
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Purge removes the cached responses to requests whose URL starts with prefix,
+// and returns their count. Prefixes starting with a slash are matched against
+// the path and query of the URL only.
+func (c *ResponseCache) Purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count := 0
+	for _, element := range c.entries {
+		resource := element.Value.(*cachedResponse).resource()
+		if urlHasPrefix(resource[strings.Index(resource, " ")+1:], prefix) {
+			c.remove(element)
+			count++
+		}
+	}
+	return count
+}
+
+func urlHasPrefix(rawURL string, prefix string) bool {
+	if strings.HasPrefix(prefix, "/") {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return false
+		}
+		rawURL = u.RequestURI()
+	}
+	return strings.HasPrefix(rawURL, prefix)
+}
+
+func (c *ResponseCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cachedResponse)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+	resource := entry.resource()
+	if variants, ok := c.variants[resource]; ok {
+		if variants.count--; variants.count == 0 {
+			delete(c.variants, resource)
+		}
+	}
+}
+
+// cacheKey identifies the upstream resource requested by req.
+func cacheKey(req *http.Request) string {
+	return req.Method + " " + req.URL.String()
+}
+
+// variantKey identifies the response to req among the variants of resource,
+// by the values of the request headers named vary.
+func variantKey(resource string, req *http.Request, vary []string) string {
+	key := resource
+	for _, name := range vary {
+		key += "\n" + name + ": " + strings.Join(req.Header.Values(name), ",")
+	}
+	return key
+}
+
+// cacheableStatus are the status codes cacheable by default, as of RFC 7231.
+var cacheableStatus = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 404: true, 410: true}
+
+// freshness returns how long the response to req may be cached, if at all.
+func (c *ResponseCache) freshness(req *http.Request, res *http.Response) (time.Duration, bool) {
+	if !cacheableStatus[res.StatusCode] || res.Header.Get("Vary") == "*" {
+		return 0, false
+	}
+	requestDirectives := cacheControl(req.Header)
+	if _, ok := requestDirectives["no-store"]; ok {
+		return 0, false
+	}
+	directives := cacheControl(res.Header)
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return 0, false
+		}
+	}
+	_, public := directives["public"]
+	sharedMaxAge, shared := directives["s-maxage"]
+	if req.Header.Get("Authorization") != "" && !public && !shared {
+		return 0, false
+	}
+
+	var ttl time.Duration
+	if maxAge, ok := directives["max-age"]; ok || shared {
+		if shared {
+			maxAge = sharedMaxAge
+		}
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil {
+			return 0, false
+		}
+		ttl = time.Duration(seconds) * time.Second
+	} else if value := res.Header.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			return 0, false
+		}
+		date, err := http.ParseTime(res.Header.Get("Date"))
+		if err != nil {
+			date = c.now()
+		}
+		ttl = expires.Sub(date)
+	}
+	if age, err := strconv.Atoi(res.Header.Get("Age")); err == nil {
+		ttl -= time.Duration(age) * time.Second
+	}
+
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl, ttl > 0
+}
+
+// cacheControl returns the Cache-Control directives of header and their
+// arguments.
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, argument := directive, ""
+			if i := strings.Index(directive, "="); i >= 0 {
+				name, argument = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			directives[strings.ToLower(name)] = argument
+		}
+	}
+	return directives
+}
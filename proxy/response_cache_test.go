@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheFreshness(t *testing.T) {
+	cache := NewResponseCache(1024, time.Hour)
+	now := time.Date(2021, 3, 5, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	for _, test := range []struct {
+		requestHeader  http.Header
+		status         int
+		responseHeader http.Header
+		ttl            time.Duration
+		ok             bool
+	}{
+		{nil, 200, http.Header{"Cache-Control": {"max-age=60"}}, time.Minute, true},
+		{nil, 200, http.Header{"Cache-Control": {"public, max-age=60, s-maxage=30"}}, 30 * time.Second, true},
+		{nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, 40 * time.Second, true},
+		{nil, 200, http.Header{"Cache-Control": {"max-age=86400"}}, time.Hour, true},
+		{nil, 200, http.Header{"Expires": {"Fri, 05 Mar 2021 12:05:00 GMT"}, "Date": {"Fri, 05 Mar 2021 12:00:00 GMT"}}, 5 * time.Minute, true},
+		{nil, 200, http.Header{}, 0, false},
+		{nil, 200, http.Header{"Cache-Control": {"max-age=0"}}, 0, false},
+		{nil, 200, http.Header{"Cache-Control": {"no-store, max-age=60"}}, 0, false},
+		{nil, 200, http.Header{"Cache-Control": {"no-cache, max-age=60"}}, 0, false},
+		{nil, 200, http.Header{"Cache-Control": {"private, max-age=60"}}, 0, false},
+		{nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, 0, false},
+		{nil, 500, http.Header{"Cache-Control": {"max-age=60"}}, 0, false},
+		{http.Header{"Cache-Control": {"no-store"}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, 0, false},
+		{http.Header{"Authorization": {"Bearer x"}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, 0, false},
+		{http.Header{"Authorization": {"Bearer x"}}, 200, http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute, true},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		for name, values := range test.requestHeader {
+			req.Header[name] = values
+		}
+		res := &http.Response{StatusCode: test.status, Header: test.responseHeader}
+		ttl, ok := cache.freshness(req, res)
+		if ttl != test.ttl || ok != test.ok {
+			t.Errorf("Unexpected freshness %s, %t for %v; expected %s, %t", ttl, ok, test.responseHeader, test.ttl, test.ok)
+		}
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	cache := NewResponseCache(100, 0)
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		cache.add(&cachedResponse{key: key, header: http.Header{}, body: make([]byte, 20), expires: now.Add(time.Minute)})
+	}
+	if _, ok := cache.entries["a"]; ok {
+		t.Errorf("Least recently used response not evicted")
+	}
+	if cache.size != 82 || len(cache.entries) != 2 {
+		t.Errorf("Unexpected cache size %d with %d entries", cache.size, len(cache.entries))
+	}
+
+	cache.add(&cachedResponse{key: "d", header: http.Header{}, body: make([]byte, 100)})
+	if _, ok := cache.entries["d"]; ok {
+		t.Errorf("Response larger than the cache was cached")
+	}
+}
+
+func TestResponseCachePurge(t *testing.T) {
+	cache := NewResponseCache(1000, 0)
+	for _, key := range []string{
+		"GET http://upstream/users/1",
+		"GET http://upstream/users/2?a=b",
+		"GET http://upstream/posts/1",
+		"GET http://other/users/3",
+	} {
+		cache.add(&cachedResponse{key: key, header: http.Header{}})
+	}
+	if purged := cache.Purge("/users/"); purged != 3 {
+		t.Errorf("Expected 3 responses purged by path, got %d", purged)
+	}
+	if purged := cache.Purge("http://upstream/"); purged != 1 {
+		t.Errorf("Expected 1 response purged by URL, got %d", purged)
+	}
+	if len(cache.entries) != 0 || len(cache.variants) != 0 || cache.size != 0 {
+		t.Errorf("Unexpected cache size %d with %d entries", cache.size, len(cache.entries))
+	}
+}
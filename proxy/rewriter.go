@@ -2,61 +2,246 @@ package proxy
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"github.com/bauerd/jqrp/json"
 	"github.com/bauerd/jqrp/log"
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"strconv"
+	"strings"
 )
 
 type rewriter = func([]interface{}, []byte, *http.Response) error
 
-// Rewriter rewrites response bodies depending on query results.
+// Rewriter rewrites response bodies depending on query results. Requests
+// whose If-None-Match header matches the rewritten body are answered with 304
+// Not Modified.
 func Rewriter(logger *log.Logger) rewriter {
 	return func(results []interface{}, fallbackBody []byte, response *http.Response) error {
-		resultsLen := len(results)
-
-		if resultsLen == 0 {
-			return writeRawBody(fallbackBody, response, logger)
+		if err := rewrite(results, fallbackBody, response, logger); err != nil {
+			return err
 		}
+		writeNotModified(response)
+		return nil
+	}
+}
 
-		if resultsLen > 1 {
-			return writeJSONBody(results, response, logger)
-		}
+func rewrite(results []interface{}, fallbackBody []byte, response *http.Response, logger *log.Logger) error {
+	options := optionsFromContext(response.Request.Context())
 
-		// If the only result is null, it has no JSON representation.
-		if results[0] == nil {
-			return ErrIllegalQueryResult
-		}
+	if options.Envelope {
+		return writeEnvelope(results, response, logger)
+	}
 
-		// If the only result is of another primitive type, it has no JSON
-		// representation.
-		switch reflect.TypeOf(results[0]).Kind() {
-		case reflect.Slice:
-		case reflect.Map:
-			break
-		default:
-			return ErrIllegalQueryResult
-		}
+	if options.Results == ResultsFirst && len(results) > 1 {
+		results = results[:1]
+	}
+
+	resultsLen := len(results)
+
+	if resultsLen == 0 {
+		return writeEmptyBody(options, fallbackBody, response, logger)
+	}
+
+	if options.Output == OutputRaw {
+		return writeRawResults(results, response, logger)
+	}
+
+	switch options.Results {
+	case ResultsArray:
+		return writeJSONBody(results, response, logger)
+	case ResultsSeq:
+		return writeJSONSequence(results, "\x1e", "application/json-seq", response, logger)
+	case ResultsNDJSON:
+		return writeJSONSequence(results, "", "application/x-ndjson", response, logger)
+	}
+
+	if resultsLen > 1 {
+		return writeJSONBody(results, response, logger)
+	}
 
+	// Any single result is a valid JSON text as of RFC 8259.
+	if options.Output == OutputJSON {
 		return writeJSONBody(results[0], response, logger)
 	}
+
+	// If the only result is null, it has no JSON representation.
+	if results[0] == nil {
+		return ErrIllegalQueryResult
+	}
+
+	// If the only result is of another primitive type, it has no JSON
+	// representation.
+	switch reflect.TypeOf(results[0]).Kind() {
+	case reflect.Slice:
+	case reflect.Map:
+		break
+	default:
+		return ErrIllegalQueryResult
+	}
+
+	return writeJSONBody(results[0], response, logger)
+}
+
+// writeEmptyBody responds to an empty result set. By default, the body is the
+// fallback body, i.e. the empty value of the upstream JSON type.
+func writeEmptyBody(options Options, fallbackBody []byte, response *http.Response, logger *log.Logger) error {
+	switch options.Empty {
+	case EmptyArray:
+		return writeRawBody([]byte("[]"), response, logger)
+	case EmptyObject:
+		return writeRawBody([]byte("{}"), response, logger)
+	case EmptyNull:
+		return writeRawBody([]byte("null"), response, logger)
+	case EmptyNoContent:
+		return writeStatus(204, response, logger)
+	case EmptyNotFound:
+		return writeStatus(404, response, logger)
+	}
+
+	if options.Output == OutputRaw {
+		return writeRawResults(nil, response, logger)
+	}
+	switch options.Results {
+	case ResultsArray:
+		return writeRawBody([]byte("[]"), response, logger)
+	case ResultsSeq:
+		return writeJSONSequence(nil, "\x1e", "application/json-seq", response, logger)
+	case ResultsNDJSON:
+		return writeJSONSequence(nil, "", "application/x-ndjson", response, logger)
+	}
+	return writeRawBody(fallbackBody, response, logger)
+}
+
+// writeRawResults writes one result per line like jq --raw-output: strings
+// unquoted, anything else as JSON.
+func writeRawResults(results []interface{}, response *http.Response, logger *log.Logger) error {
+	var body bytes.Buffer
+	for _, result := range results {
+		if s, ok := result.(string); ok {
+			body.WriteString(s)
+		} else {
+			line, err := marshal(result, response)
+			if err != nil {
+				return err
+			}
+			body.Write(line)
+		}
+		body.WriteByte('\n')
+	}
+	setContentType(response, "text/plain; charset=utf-8")
+	return writeRawBody(body.Bytes(), response, logger)
+}
+
+// writeJSONSequence writes each result as a JSON text preceded by prefix and
+// followed by a newline.
+func writeJSONSequence(results []interface{}, prefix string, contentType string, response *http.Response, logger *log.Logger) error {
+	var body bytes.Buffer
+	for _, result := range results {
+		text, err := marshal(result, response)
+		if err != nil {
+			return err
+		}
+		body.WriteString(prefix)
+		body.Write(text)
+		body.WriteByte('\n')
+	}
+	setContentType(response, contentType)
+	return writeRawBody(body.Bytes(), response, logger)
 }
 
 func writeJSONBody(payload interface{}, response *http.Response, logger *log.Logger) error {
-	body, err := json.Marshal(payload)
+	body, err := marshal(payload, response)
 	if err != nil {
 		return err
 	}
 	return writeRawBody(body, response, logger)
 }
 
+// marshal encodes a result in the requested format, preserving the key order
+// of upstream objects. NDJSON is always encoded compactly.
+func marshal(result interface{}, response *http.Response) ([]byte, error) {
+	ctx := response.Request.Context()
+	format := optionsFromContext(ctx).Format
+	if optionsFromContext(ctx).Results == ResultsNDJSON {
+		format.Indent = 0
+		format.Tab = false
+	}
+	return json.Marshal(result, format, keyOrderFromContext(ctx))
+}
+
+func keyOrderFromContext(ctx context.Context) *json.KeyOrder {
+	order, _ := ctx.Value(keyOrderContextKey).(*json.KeyOrder)
+	return order
+}
+
 func writeRawBody(payload []byte, response *http.Response, logger *log.Logger) error {
 	response.Body.Close()
 	response.Body = ioutil.NopCloser(bytes.NewReader(payload))
 	defer response.Body.Close() // no-op
 	response.ContentLength = int64(len(payload))
-	response.StatusCode = 203
+	if response.Header == nil {
+		response.Header = http.Header{}
+	}
+	response.Header.Set("Content-Length", strconv.Itoa(len(payload)))
+	markTransformed(response)
+	setETag(payload, response)
 	log.SuccessResponse(logger, response.Request)
 	return nil
 }
+
+// TransformedHTTPHeader is the HTTP response header that marks transformed
+// responses.
+const TransformedHTTPHeader string = "X-Jqrp-Transformed"
+
+// varyHTTPHeader lists the request headers that transformed responses vary
+// on, i.e. the query and option headers, and Accept selecting raw output.
+var varyHTTPHeader = strings.Join(append([]string{"Accept"}, optionHTTPHeaders...), ", ")
+
+// markTransformed sets the status code of a transformed response according to
+// the success status policy, and marks it as transformed. Opted-in
+// non-successful upstream status codes are preserved. Upstream validators of
+// the body are dropped.
+func markTransformed(response *http.Response) {
+	if successful(response.StatusCode) {
+		switch optionsFromContext(response.Request.Context()).SuccessStatus {
+		case SuccessOK:
+			response.StatusCode = 200
+		case SuccessPreserve:
+			// 204 and 205 responses must not have a body.
+			if bodyless(response.StatusCode) && response.ContentLength != 0 {
+				response.StatusCode = 200
+			}
+		default:
+			response.StatusCode = 203
+		}
+	}
+	if response.Header == nil {
+		response.Header = http.Header{}
+	}
+	for _, name := range staleHeaders {
+		response.Header.Del(name)
+	}
+	// Caches must not serve a body transformed by another query or options.
+	response.Header.Add("Vary", varyHTTPHeader)
+	response.Header.Set(TransformedHTTPHeader, "true")
+}
+
+// bodyless reports whether responses with status must not have a body.
+func bodyless(status int) bool {
+	return status == 204 || status == 205 || status == 304
+}
+
+func writeStatus(statusCode int, response *http.Response, logger *log.Logger) error {
+	err := writeRawBody([]byte{}, response, logger)
+	response.StatusCode = statusCode
+	return err
+}
+
+func setContentType(response *http.Response, contentType string) {
+	if response.Header == nil {
+		response.Header = http.Header{}
+	}
+	response.Header.Set("Content-Type", contentType)
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"github.com/bauerd/jqrp/log"
 	"io/ioutil"
 	"net/http"
@@ -89,3 +90,155 @@ func TestRewriterEmptyWithoutResult(t *testing.T) {
 		t.Errorf("Wrong response body: %s", body)
 	}
 }
+
+func TestRewriterJSONSinglePrimitiveResult(t *testing.T) {
+	url, _ := url.Parse("https://example.com")
+	req := http.Request{URL: url}
+	ctx := context.WithValue(req.Context(), OptionsContextKey, Options{Output: OutputJSON})
+	res := http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte{})), Request: req.WithContext(ctx)}
+	results := []interface{}{nil}
+	logger := log.New(log.Error)
+	err := Rewriter(logger)(results, []byte{}, &res)
+	if err != nil {
+		t.Errorf("Rewriting failed")
+	}
+	expectedBody := []byte("null")
+	body, _ := ioutil.ReadAll(res.Body)
+	if !reflect.DeepEqual(body, expectedBody) {
+		t.Errorf("Wrong response body: %s", body)
+	}
+}
+
+func TestRewriterRawResults(t *testing.T) {
+	url, _ := url.Parse("https://example.com")
+	req := http.Request{URL: url}
+	ctx := context.WithValue(req.Context(), OptionsContextKey, Options{Output: OutputRaw})
+	res := http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte{})), Request: req.WithContext(ctx)}
+	results := []interface{}{"alpha", 2, nil, []interface{}{"beta"}}
+	logger := log.New(log.Error)
+	err := Rewriter(logger)(results, []byte{}, &res)
+	if err != nil {
+		t.Errorf("Rewriting failed")
+	}
+	expectedBody := []byte("alpha\n2\nnull\n[\"beta\"]\n")
+	body, _ := ioutil.ReadAll(res.Body)
+	if !reflect.DeepEqual(body, expectedBody) {
+		t.Errorf("Wrong response body: %s", body)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "text/plain; charset=utf-8" {
+		t.Errorf("Wrong Content-Type: %s", contentType)
+	}
+}
+
+func TestRewriterArraySingleResult(t *testing.T) {
+	url, _ := url.Parse("https://example.com")
+	req := http.Request{URL: url}
+	ctx := context.WithValue(req.Context(), OptionsContextKey, Options{Results: ResultsArray})
+	res := http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte{})), Request: req.WithContext(ctx)}
+	results := []interface{}{map[string]interface{}{"id": 1}}
+	logger := log.New(log.Error)
+	err := Rewriter(logger)(results, []byte{}, &res)
+	if err != nil {
+		t.Errorf("Rewriting failed")
+	}
+	expectedBody := []byte(`[{"id":1}]`)
+	body, _ := ioutil.ReadAll(res.Body)
+	if !reflect.DeepEqual(body, expectedBody) {
+		t.Errorf("Wrong response body: %s", body)
+	}
+}
+
+func TestRewriterFirstResult(t *testing.T) {
+	url, _ := url.Parse("https://example.com")
+	req := http.Request{URL: url}
+	ctx := context.WithValue(req.Context(), OptionsContextKey, Options{Results: ResultsFirst})
+	res := http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte{})), Request: req.WithContext(ctx)}
+	results := []interface{}{map[string]interface{}{"id": 1}, map[string]interface{}{"id": 2}}
+	logger := log.New(log.Error)
+	err := Rewriter(logger)(results, []byte{}, &res)
+	if err != nil {
+		t.Errorf("Rewriting failed")
+	}
+	expectedBody := []byte(`{"id":1}`)
+	body, _ := ioutil.ReadAll(res.Body)
+	if !reflect.DeepEqual(body, expectedBody) {
+		t.Errorf("Wrong response body: %s", body)
+	}
+}
+
+func TestRewriterSeqResults(t *testing.T) {
+	url, _ := url.Parse("https://example.com")
+	req := http.Request{URL: url}
+	ctx := context.WithValue(req.Context(), OptionsContextKey, Options{Results: ResultsSeq})
+	res := http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte{})), Request: req.WithContext(ctx)}
+	results := []interface{}{1, "two"}
+	logger := log.New(log.Error)
+	err := Rewriter(logger)(results, []byte{}, &res)
+	if err != nil {
+		t.Errorf("Rewriting failed")
+	}
+	expectedBody := []byte("\x1e1\n\x1e\"two\"\n")
+	body, _ := ioutil.ReadAll(res.Body)
+	if !reflect.DeepEqual(body, expectedBody) {
+		t.Errorf("Wrong response body: %q", body)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "application/json-seq" {
+		t.Errorf("Wrong Content-Type: %s", contentType)
+	}
+}
+
+func TestRewriterNDJSONResults(t *testing.T) {
+	url, _ := url.Parse("https://example.com")
+	req := http.Request{URL: url}
+	ctx := context.WithValue(req.Context(), OptionsContextKey, Options{Results: ResultsNDJSON})
+	res := http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte{})), Request: req.WithContext(ctx)}
+	results := []interface{}{map[string]interface{}{"id": 1}, map[string]interface{}{"id": 2}}
+	logger := log.New(log.Error)
+	err := Rewriter(logger)(results, []byte{}, &res)
+	if err != nil {
+		t.Errorf("Rewriting failed")
+	}
+	expectedBody := []byte("{\"id\":1}\n{\"id\":2}\n")
+	body, _ := ioutil.ReadAll(res.Body)
+	if !reflect.DeepEqual(body, expectedBody) {
+		t.Errorf("Wrong response body: %q", body)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("Wrong Content-Type: %s", contentType)
+	}
+}
+
+func TestRewriterEmptyNoContent(t *testing.T) {
+	url, _ := url.Parse("https://example.com")
+	req := http.Request{URL: url}
+	ctx := context.WithValue(req.Context(), OptionsContextKey, Options{Empty: EmptyNoContent})
+	res := http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte{})), Request: req.WithContext(ctx)}
+	logger := log.New(log.Error)
+	err := Rewriter(logger)([]interface{}{}, []byte("[]"), &res)
+	if err != nil {
+		t.Errorf("Rewriting failed")
+	}
+	if res.StatusCode != 204 {
+		t.Errorf("Wrong status code %d", res.StatusCode)
+	}
+	if res.ContentLength != 0 {
+		t.Errorf("Wrong Content-Length")
+	}
+}
+
+func TestRewriterEmptyNull(t *testing.T) {
+	url, _ := url.Parse("https://example.com")
+	req := http.Request{URL: url}
+	ctx := context.WithValue(req.Context(), OptionsContextKey, Options{Empty: EmptyNull})
+	res := http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte{})), Request: req.WithContext(ctx)}
+	logger := log.New(log.Error)
+	err := Rewriter(logger)([]interface{}{}, []byte("[]"), &res)
+	if err != nil {
+		t.Errorf("Rewriting failed")
+	}
+	expectedBody := []byte("null")
+	body, _ := ioutil.ReadAll(res.Body)
+	if !reflect.DeepEqual(body, expectedBody) {
+		t.Errorf("Wrong response body: %s", body)
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Route overrides the default transformation options for request paths with
+// a prefix.
+type Route struct {
+	// Prefix is the request path prefix the route applies to.
+	Prefix string `json:"prefix"`
+
+	// Options are transformation options in the syntax of the respective
+	// request headers, e.g. {"JQ-Input": "slurp"}. Request headers still take
+	// precedence.
+	Options map[string]string `json:"options"`
+
+	// RateLimit overrides the default rate limit, with budgets of its own.
+	// The client key defaults to the default one.
+	RateLimit *RateLimit `json:"rate_limit"`
+}
+
+// Routes are routes of which the one with the longest matching prefix
+// applies.
+type Routes []Route
+
+// LoadRoutes reads routes from a JSON file containing an array of routes, and
+// validates their options.
+func LoadRoutes(path string) (Routes, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var routes Routes
+	if err := json.Unmarshal(content, &routes); err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		if _, err := route.options(Options{}); err != nil {
+			return nil, fmt.Errorf("route %s: %w", route.Prefix, err)
+		}
+		if route.RateLimit != nil {
+			if err := route.RateLimit.validate(); err != nil {
+				return nil, fmt.Errorf("route %s: %w", route.Prefix, err)
+			}
+		}
+	}
+	return routes, nil
+}
+
+// Match returns the route with the longest prefix of path, or false if none
+// matches. Prefixes match whole path segments, e.g. /api matches /api and
+// /api/items, but not /apiv2.
+func (r Routes) Match(path string) (Route, bool) {
+	var match Route
+	var found bool
+	for _, route := range r {
+		if hasPathPrefix(path, route.Prefix) && (!found || len(route.Prefix) > len(match.Prefix)) {
+			match = route
+			found = true
+		}
+	}
+	return match, found
+}
+
+// hasPathPrefix reports whether prefix is a prefix of path ending at a path
+// segment boundary.
+func hasPathPrefix(path string, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// Options returns the default transformation options for path, i.e. defaults
+// overridden by the matching route's options.
+func (r Routes) Options(path string, defaults Options) Options {
+	route, ok := r.Match(path)
+	if !ok {
+		return defaults
+	}
+	options, err := route.options(defaults)
+	if err != nil {
+		return defaults
+	}
+	return options
+}
+
+func (r Route) options(defaults Options) (Options, error) {
+	header := http.Header{}
+	for name, value := range r.Options {
+		header.Set(name, value)
+	}
+	return ParseOptions(header, "", defaults)
+}
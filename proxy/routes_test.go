@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeRoutesFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "routes*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(content)
+	file.Close()
+	return file.Name()
+}
+
+func TestLoadRoutes(t *testing.T) {
+	path := writeRoutesFile(t, `[
+  {"prefix": "/", "options": {"JQ-Empty": "404"}},
+  {"prefix": "/legacy/", "options": {"JQ-Input": "slurp", "jq-results": "array"}}
+]`)
+	defer os.Remove(path)
+	routes, err := LoadRoutes(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	options := routes.Options("/legacy/items", Options{MaxBodySize: 1})
+	if options.Input != InputSlurp || options.Results != ResultsArray || options.Empty != EmptyAuto || options.MaxBodySize != 1 {
+		t.Errorf("Unexpected options: %+v", options)
+	}
+	options = routes.Options("/items", Options{})
+	if options.Input != InputDocument || options.Empty != EmptyNotFound {
+		t.Errorf("Unexpected options: %+v", options)
+	}
+	if _, ok := Routes(nil).Match("/items"); ok {
+		t.Errorf("Unexpected match")
+	}
+	api := Routes{{Prefix: "/api"}}
+	for path, expected := range map[string]bool{"/api": true, "/api/items": true, "/apiv2": false, "/ap": false} {
+		if _, ok := api.Match(path); ok != expected {
+			t.Errorf("Unexpected match of %s: %t", path, ok)
+		}
+	}
+}
+
+func TestLoadRoutesInvalidOptions(t *testing.T) {
+	path := writeRoutesFile(t, `[{"prefix": "/", "options": {"JQ-Input": "bogus"}}]`)
+	defer os.Remove(path)
+	if _, err := LoadRoutes(path); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestLoadRoutesRateLimit(t *testing.T) {
+	path := writeRoutesFile(t, `[{"prefix": "/reports", "rate_limit": {"key": "jwt:sub", "requests": 10, "evaluation_time": 1000}}]`)
+	defer os.Remove(path)
+	routes, err := LoadRoutes(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if limit := routes[0].RateLimit; limit == nil || *limit != (RateLimit{Key: "jwt:sub", Requests: 10, EvaluationTime: 1000}) {
+		t.Errorf("Unexpected rate limit: %+v", limit)
+	}
+
+	path = writeRoutesFile(t, `[{"prefix": "/", "rate_limit": {"key": "cookie"}}]`)
+	defer os.Remove(path)
+	if _, err := LoadRoutes(path); err == nil {
+		t.Errorf("Expected error for invalid rate limit key")
+	}
+}
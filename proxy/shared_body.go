@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// errSlowReader is returned to a reader of a shared body that fell too far
+// behind the other readers.
+var errSlowReader = errors.New("shared response body reader fell behind")
+
+// slowReaderTimeout is how long readers wait for the slowest reader of a full
+// shared body to catch up, before it is detached.
+const slowReaderTimeout = time.Second
+
+// sharedBody fans out a response body to several readers. Whichever reader
+// runs out of buffered data reads on from the source, so the body is read as
+// fast as the fastest reader. Data is buffered only until every reader has
+// read it. A reader that is maxSize bytes ahead of the slowest one waits for it
+// to catch up, but only for a while, after which the slowest readers are
+// detached rather than holding up the others.
+type sharedBody struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	source io.ReadCloser
+	// buffer holds the body from offset start on.
+	buffer []byte
+	start  int
+	// maxSize bounds the buffer, unless 0.
+	maxSize int
+	// stalled is when the buffer last filled up, and patience is how long
+	// readers wait for it to shrink.
+	stalled  time.Time
+	patience time.Duration
+	err      error
+	reading  bool
+	// pending counts the readers not yet handed out.
+	pending int
+	// detached counts the readers not yet handed out that were detached.
+	detached int
+	open     map[*sharedBodyReader]bool
+}
+
+func newSharedBody(source io.ReadCloser, readers int, maxSize int) *sharedBody {
+	body := &sharedBody{
+		source:   source,
+		maxSize:  maxSize,
+		patience: slowReaderTimeout,
+		pending:  readers,
+		open:     map[*sharedBodyReader]bool{},
+	}
+	body.cond = sync.NewCond(&body.mu)
+	return body
+}
+
+// reader returns a reader of the body, unless the reader was detached before
+// it was handed out. Each of the readers returned must be closed.
+func (b *sharedBody) reader() (io.ReadCloser, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.detached > 0 {
+		b.detached--
+		return nil, false
+	}
+	b.pending--
+	reader := &sharedBodyReader{body: b}
+	b.open[reader] = true
+	return reader, true
+}
+
+func (b *sharedBody) read(r *sharedBodyReader, p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for !r.detached && r.offset == b.start+len(b.buffer) && b.err == nil {
+		if b.reading {
+			b.cond.Wait()
+			continue
+		}
+		if b.full() {
+			if b.stalled.IsZero() {
+				b.stalled = time.Now()
+				time.AfterFunc(b.patience, func() {
+					b.mu.Lock()
+					defer b.mu.Unlock()
+					b.cond.Broadcast()
+				})
+			}
+			if time.Since(b.stalled) < b.patience {
+				b.cond.Wait()
+			} else {
+				b.detach()
+			}
+			continue
+		}
+		b.reading = true
+		size := 32 * 1024
+		if b.maxSize > 0 && size > b.maxSize-len(b.buffer) {
+			size = b.maxSize - len(b.buffer)
+		}
+		b.mu.Unlock()
+		chunk := make([]byte, size)
+		n, err := b.source.Read(chunk)
+		b.mu.Lock()
+		b.buffer = append(b.buffer, chunk[:n]...)
+		b.err = err
+		b.reading = false
+		b.cond.Broadcast()
+	}
+	if r.detached {
+		return 0, errSlowReader
+	}
+	if r.offset < b.start+len(b.buffer) {
+		n := copy(p, b.buffer[r.offset-b.start:])
+		r.offset += n
+		b.trim()
+		return n, nil
+	}
+	return 0, b.err
+}
+
+// full reports whether the buffer reached its maximum size.
+func (b *sharedBody) full() bool {
+	return b.maxSize > 0 && len(b.buffer) >= b.maxSize
+}
+
+// detach detaches the readers that have read the least, including those not
+// yet handed out, so that the buffer can shrink.
+func (b *sharedBody) detach() {
+	if b.pending > 0 {
+		b.detached += b.pending
+		b.pending = 0
+	}
+	for reader := range b.open {
+		if reader.offset == b.start {
+			reader.detached = true
+			delete(b.open, reader)
+		}
+	}
+	b.trim()
+}
+
+// trim drops the buffered data that all readers have read, and wakes up
+// readers waiting for the buffer to shrink.
+func (b *sharedBody) trim() {
+	if b.pending > 0 {
+		return
+	}
+	offset := b.start + len(b.buffer)
+	for reader := range b.open {
+		if reader.offset < offset {
+			offset = reader.offset
+		}
+	}
+	if offset > b.start {
+		b.buffer = b.buffer[offset-b.start:]
+		b.start = offset
+		b.stalled = time.Time{}
+		b.cond.Broadcast()
+	}
+}
+
+func (b *sharedBody) close(r *sharedBodyReader) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.detached {
+		return nil
+	}
+	delete(b.open, r)
+	if len(b.open) == 0 && b.pending == 0 {
+		b.buffer = nil
+		return b.source.Close()
+	}
+	b.trim()
+	return nil
+}
+
+type sharedBodyReader struct {
+	body     *sharedBody
+	offset   int
+	closed   bool
+	detached bool
+}
+
+func (r *sharedBodyReader) Read(p []byte) (int, error) {
+	return r.body.read(r, p)
+}
+
+func (r *sharedBodyReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.body.close(r)
+}
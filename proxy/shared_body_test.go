@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSharedBodyBuffer(t *testing.T) {
+	body := newSharedBody(ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 10000))), 2, 100)
+	fast, _ := body.reader()
+	slow, _ := body.reader()
+
+	p := make([]byte, 60)
+	for read := 0; read < 10000; {
+		n, err := fast.Read(p)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		read += n
+		if _, err := slow.Read(p[:n]); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		body.mu.Lock()
+		size := len(body.buffer)
+		body.mu.Unlock()
+		if size > 100 {
+			t.Fatalf("Unexpected buffer size %d", size)
+		}
+	}
+
+	fast.Close()
+	rest, _ := ioutil.ReadAll(slow)
+	slow.Close()
+	if len(rest) != 0 || body.buffer != nil {
+		t.Errorf("Unexpected rest of %d bytes", len(rest))
+	}
+}
+
+func TestSharedBodySlowReader(t *testing.T) {
+	body := newSharedBody(ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 10000))), 3, 100)
+	body.patience = 10 * time.Millisecond
+	fast, _ := body.reader()
+	slow, _ := body.reader()
+
+	rest, err := ioutil.ReadAll(fast)
+	if err != nil || len(rest) != 10000 {
+		t.Fatalf("Unexpected result of %d bytes: %v", len(rest), err)
+	}
+	if _, err := slow.Read(make([]byte, 10)); err != errSlowReader {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, ok := body.reader(); ok {
+		t.Errorf("Expected pending reader to be detached")
+	}
+
+	slow.Close()
+	fast.Close()
+	if body.buffer != nil {
+		t.Errorf("Expected buffer to be released")
+	}
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bauerd/jqrp/jq"
+	"io"
+	"sync"
+	"time"
+)
+
+// SlowQueryLog writes evaluations that took at least a threshold to a
+// dedicated log, as one JSON object per line.
+type SlowQueryLog struct {
+	mu        sync.Mutex
+	writer    io.Writer
+	threshold time.Duration
+	now       func() time.Time
+}
+
+// slowQuery is an entry of the slow query log.
+type slowQuery struct {
+	Time        string  `json:"time"`
+	RequestID   string  `json:"request_id"`
+	Client      string  `json:"client"`
+	Fingerprint string  `json:"fingerprint"`
+	Query       string  `json:"query"`
+	DurationMs  float64 `json:"duration_ms"`
+	InputSize   int64   `json:"input_size"`
+	OutputSize  int64   `json:"output_size"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// NewSlowQueryLog returns a slow query log writing evaluations that took at
+// least threshold to writer.
+func NewSlowQueryLog(writer io.Writer, threshold time.Duration) *SlowQueryLog {
+	return &SlowQueryLog{writer: writer, threshold: threshold, now: time.Now}
+}
+
+// Observe writes the evaluation to the log if it was slow.
+func (l *SlowQueryLog) Observe(ctx context.Context, evaluation jq.Evaluation) {
+	if evaluation.Duration < l.threshold {
+		return
+	}
+	client := clientFromContext(ctx)
+	entry := slowQuery{
+		Time:        l.now().UTC().Format(time.RFC3339Nano),
+		RequestID:   client.RequestID,
+		Client:      client.Address,
+		Fingerprint: evaluation.Fingerprint,
+		Query:       evaluation.Query,
+		DurationMs:  float64(evaluation.Duration) / float64(time.Millisecond),
+		InputSize:   evaluation.InputSize,
+		OutputSize:  evaluation.OutputSize,
+	}
+	if evaluation.Err != nil {
+		entry.Error = evaluation.Err.Error()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writer.Write(append(line, '\n'))
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+)
+
+// StatusSet is a set of status codes, written as comma-separated codes and
+// classes, e.g. "4xx,503".
+type StatusSet struct {
+	classes map[int]bool
+	codes   map[int]bool
+}
+
+// ParseStatusSet returns the status set written as value.
+func ParseStatusSet(value string) (StatusSet, bool) {
+	set := StatusSet{classes: map[int]bool{}, codes: map[int]bool{}}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if len(item) != 3 {
+			return StatusSet{}, false
+		}
+		if strings.HasSuffix(item, "xx") {
+			class, err := strconv.Atoi(item[:1])
+			if err != nil || class < 1 || class > 5 {
+				return StatusSet{}, false
+			}
+			set.classes[class] = true
+			continue
+		}
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 100 || code > 599 {
+			return StatusSet{}, false
+		}
+		set.codes[code] = true
+	}
+	return set, true
+}
+
+// Contains reports whether status is in the set.
+func (s StatusSet) Contains(status int) bool {
+	return s.codes[status] || s.classes[status/100]
+}
+
+// String returns the set as written.
+func (s StatusSet) String() string {
+	var items []string
+	for class := 1; class <= 5; class++ {
+		if s.classes[class] {
+			items = append(items, strconv.Itoa(class)+"xx")
+		}
+	}
+	for code := 100; code <= 599; code++ {
+		if s.codes[code] && !s.classes[code/100] {
+			items = append(items, strconv.Itoa(code))
+		}
+	}
+	return strings.Join(items, ",")
+}
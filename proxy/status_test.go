@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestParseStatusSet(t *testing.T) {
+	set, ok := ParseStatusSet("4xx, 503")
+	if !ok {
+		t.Fatalf("Unexpected parse failure")
+	}
+	for status, expected := range map[int]bool{404: true, 499: true, 503: true, 500: false, 200: false} {
+		if actual := set.Contains(status); actual != expected {
+			t.Errorf("Unexpected containment of %d: %v", status, actual)
+		}
+	}
+	if actual, expected := set.String(), "4xx,503"; actual != expected {
+		t.Errorf("Unexpected string %s", actual)
+	}
+	for _, value := range []string{"", "6xx", "4x", "abc", "99", "4xx,"} {
+		if _, ok := ParseStatusSet(value); ok {
+			t.Errorf("Unexpected parse success for %q", value)
+		}
+	}
+}
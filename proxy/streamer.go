@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/bauerd/jqrp/jq"
+	"github.com/bauerd/jqrp/log"
+	"io"
+	"net/http"
+)
+
+// StreamErrorTrailer is the HTTP trailer that carries errors occurring after
+// a streamed response was committed.
+const StreamErrorTrailer string = "JQ-Error"
+
+type streamer = func([]interface{}, *evaluation, *http.Response) error
+
+// streamFormat describes how streamed results are framed.
+type streamFormat struct {
+	contentType string
+	open        string
+	prefix      string
+	separator   string
+	suffix      string
+	close       string
+	raw         bool
+	errorRecord bool
+}
+
+func streamFormatFor(options Options) streamFormat {
+	if options.Output == OutputRaw {
+		return streamFormat{contentType: "text/plain; charset=utf-8", suffix: "\n", raw: true}
+	}
+	switch options.Results {
+	case ResultsSeq:
+		return streamFormat{contentType: "application/json-seq", prefix: "\x1e", suffix: "\n", errorRecord: true}
+	case ResultsNDJSON:
+		return streamFormat{contentType: "application/x-ndjson", suffix: "\n", errorRecord: true}
+	}
+	return streamFormat{contentType: "application/json", open: "[", separator: ",", close: "]"}
+}
+
+// Streamer writes results to response bodies as they are produced, following
+// the results produced so far. The response status and headers are committed
+// right away, and the evaluation is canceled once the stream ends, e.g. when
+// the client disconnects. Errors
+// occurring afterwards are reported in the JQ-Error trailer, and for NDJSON
+// and JSON text sequences additionally as a terminal {"error": ...} record.
+// Streamed JSON arrays are left unterminated on error.
+func Streamer(logger *log.Logger) streamer {
+	return func(results []interface{}, evaluation *evaluation, response *http.Response) error {
+		format := streamFormatFor(optionsFromContext(response.Request.Context()))
+		reader, writer := io.Pipe()
+
+		// The upstream body may still be read by the iterator, and is closed
+		// once the stream ends.
+		upstreamBody := response.Body
+		response.Body = reader
+		response.ContentLength = -1
+		setContentType(response, format.contentType)
+		markTransformed(response)
+		response.Header.Del("Content-Length")
+		response.Trailer = http.Header{StreamErrorTrailer: nil}
+
+		go func() {
+			err := writeStream(writer, format, results, evaluation, response)
+			evaluation.Close()
+			if err != nil && err != io.ErrClosedPipe {
+				response.Trailer.Set(StreamErrorTrailer, err.Error())
+				if format.errorRecord {
+					record, _ := json.Marshal(map[string]string{"error": err.Error()})
+					io.WriteString(writer, format.prefix+string(record)+format.suffix)
+				}
+				log.FailureResponse(logger, response.Request, err)
+			}
+			writer.Close()
+			upstreamBody.Close()
+		}()
+
+		log.SuccessResponse(logger, response.Request)
+		return nil
+	}
+}
+
+func writeStream(writer io.Writer, format streamFormat, results []interface{}, iterator jq.Iterator, response *http.Response) error {
+	if _, err := io.WriteString(writer, format.open); err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		var result interface{}
+		if i < len(results) {
+			result = results[i]
+		} else {
+			var err error
+			result, err = iterator.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if i > 0 {
+			if _, err := io.WriteString(writer, format.separator); err != nil {
+				return err
+			}
+		}
+		text, err := encodeStreamResult(result, format, response)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(writer, format.prefix+string(text)+format.suffix); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(writer, format.close)
+	return err
+}
+
+func encodeStreamResult(result interface{}, format streamFormat, response *http.Response) ([]byte, error) {
+	if s, ok := result.(string); ok && format.raw {
+		return []byte(s), nil
+	}
+	return marshal(result, response)
+}
@@ -1,11 +1,14 @@
 package proxy
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/bauerd/jqrp/jq"
 	"github.com/bauerd/jqrp/json"
+	"io"
 	"mime"
 	"net/http"
-	"reflect"
 )
 
 // RawQueryHTTPHeader is the HTTP request header where the jq query is read
@@ -18,17 +21,34 @@ type contextKey string
 // requests.
 const RawQueryContextKey contextKey = "RAW_QUERY"
 
+// keyOrderContextKey is the context key the key order of the upstream JSON
+// objects is stored under on requests.
+const keyOrderContextKey contextKey = "KEY_ORDER"
+
+// inputHashContextKey is the context key the hash of the parsed upstream body
+// is stored under on requests, if query results are cached.
+const inputHashContextKey contextKey = "INPUT_HASH"
+
 // Transformer transforms some upstream responses.
 type Transformer struct {
 	evaluator jq.Evaluator
 	rewriter  rewriter
+	streamer  streamer
 }
 
-// NewTransformer returns a new Transformer.
+// NewTransformer returns a new Transformer, which collects all results before
+// rewriting responses, even if streaming was requested.
 func NewTransformer(evaluator jq.Evaluator, rewriter rewriter) *Transformer {
+	return NewStreamingTransformer(evaluator, rewriter, nil)
+}
+
+// NewStreamingTransformer returns a new Transformer, which streams results
+// with streamer if requested, unless streamer is nil.
+func NewStreamingTransformer(evaluator jq.Evaluator, rewriter rewriter, streamer streamer) *Transformer {
 	return &Transformer{
 		evaluator: evaluator,
 		rewriter:  rewriter,
+		streamer:  streamer,
 	}
 }
 
@@ -43,33 +63,281 @@ func (t *Transformer) ModifyResponse(r *http.Response) error {
 		return nil
 	}
 
-	// Non-successful responses are proxied verbatim.
-	if !(r.StatusCode >= 200 && r.StatusCode <= 299) {
+	// Non-successful responses are proxied verbatim, unless their status code
+	// is opted in.
+	options := optionsFromContext(r.Request.Context())
+	if !transformable(r.StatusCode, options) {
 		return nil
 	}
 
+	// Queries can branch on the upstream status code.
+	variables := map[string]interface{}{"$status": r.StatusCode}
+	r.Request = r.Request.WithContext(jq.WithVariables(r.Request.Context(), variables))
+
+	// The body is ignored in the null input mode, so that it may be empty.
+	if options.Input == InputNull {
+		setContentType(r, "application/json")
+		return t.evaluate(rawQuery.(string), nil, nil, r)
+	}
+
 	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	decoder, ok := decoderFor(mediaType)
+	if (err != nil || !ok) && !successful(r.StatusCode) {
+		// Error pages that cannot be decoded are proxied verbatim.
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	if mediaType != "application/json" {
-		// The backend responded with a Content-Type != application/json,
+	if !ok {
+		// The backend responded with a Content-Type that cannot be decoded,
 		// but the client request only Accept'ed application/json.
 		return ErrIllegalResponseType
 	}
 
-	input, err := json.Parse(r.Body)
+	if options.MaxBodySize > 0 && r.ContentLength > options.MaxBodySize {
+		return ErrResponseBodyTooLarge
+	}
+	body := countInputSize(limitBody(r.Body, options.MaxBodySize), r)
+
+	// Results of decoded non-JSON bodies are JSON.
+	if mediaType != "application/json" {
+		setContentType(r, "application/json")
+	}
+
+	if options.Input == InputDocument {
+		input, err := t.parse(mediaType, decoder, body, r)
+		if err == ErrResponseBodyTooLarge {
+			return err
+		}
+		if err != nil {
+			return ErrInvalidResponseBody
+		}
+		return t.evaluate(rawQuery.(string), input, nil, r)
+	}
+
+	inputs, ok := decoder.stream(options.Input, body)
+	if !ok {
+		return ErrUnsupportedInputMode
+	}
+	recordKeyOrder(inputs, r)
+
+	switch options.Input {
+	case InputStream, InputElements:
+		// The inputs are evaluated as one evaluation, so that they take one
+		// slot of an evaluator pool, and are observed once.
+		ctx, cancel := context.WithCancel(r.Request.Context())
+		iterator, err := jq.StreamEach(ctx, t.evaluator, rawQuery.(string), &bodyInputs{inputs: inputs})
+		if err != nil {
+			cancel()
+			return err
+		}
+		return t.stream(&evaluation{iterator: iterator, cancel: cancel}, []byte("[]"), r)
+	case InputInputs:
+		return t.evaluate(rawQuery.(string), nil, &bodyInputs{inputs: inputs}, r)
+	}
+
+	input, err := readValues(options.Input, inputs)
+	if err != nil {
+		return err
+	}
+	return t.evaluate(rawQuery.(string), input, nil, r)
+}
+
+// evaluate applies the query to input and rewrites the response. If inputs
+// are given, the query reads them with the input and inputs functions.
+func (t *Transformer) evaluate(rawQuery string, input interface{}, inputs jq.Iterator, r *http.Response) error {
+	fallbackBody := fallbackBodyFor(input)
+
+	ctx := r.Request.Context()
+	if inputs != nil {
+		ctx = jq.WithInputs(ctx, inputs)
+	}
+	if optionsFromContext(ctx).Envelope {
+		input = envelope(input, r)
+	}
+	// Cached results keep the key order of the input they were evaluated on.
+	var cachedOrder *json.KeyOrder
+	if cacheKey, ok := t.cacheKey(ctx, inputs); ok {
+		cacheKey.Hit = func(annotation interface{}) {
+			cachedOrder, _ = annotation.(*json.KeyOrder)
+		}
+		ctx = jq.WithCacheKey(ctx, cacheKey)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	iterator, err := jq.Stream(ctx, t.evaluator, rawQuery, input)
+	if err != nil {
+		cancel()
+		return err
+	}
+	evaluation := &evaluation{iterator: iterator, cancel: cancel}
+	if cachedOrder != nil {
+		ctx := context.WithValue(r.Request.Context(), keyOrderContextKey, cachedOrder)
+		r.Request = r.Request.WithContext(ctx)
+	}
+
+	if optionsFromContext(ctx).Stream {
+		return t.stream(evaluation, fallbackBody, r)
+	}
+	defer evaluation.Close()
+	results, err := jq.Collect(evaluation)
+	if err != nil {
+		return err
+	}
+
+	return t.rewriter(results, fallbackBody, r)
+}
+
+// cacheKey returns the key that the query results are cached under, if
+// enabled. Results are cached only if the input is the parsed upstream body.
+func (t *Transformer) cacheKey(ctx context.Context, inputs jq.Iterator) (jq.CacheKey, bool) {
+	options := optionsFromContext(ctx)
+	hash, ok := ctx.Value(inputHashContextKey).(string)
+	if !ok || !options.Cache || options.Envelope || inputs != nil {
+		return jq.CacheKey{}, false
+	}
+	return jq.CacheKey{Input: hash, Annotation: keyOrderFromContext(ctx), Copy: copyResults}, true
+}
+
+// copyResults returns deep copies of results along with the key order of the
+// copied objects, which is all of order the copies need.
+func copyResults(results []interface{}, annotation interface{}) ([]interface{}, interface{}) {
+	order, _ := annotation.(*json.KeyOrder)
+	copied, copiedOrder := json.Copy(results, order)
+	return copied.([]interface{}), copiedOrder
+}
+
+// transformable reports whether responses with status are transformed, i.e.
+// 2xx responses, and non-successful ones opted in. Informational and
+// redirection responses are never transformed, as they do not represent the
+// requested resource, and some of them must not have a body. Neither is 206
+// Partial Content, whose body is a range of the resource only.
+func transformable(status int, options Options) bool {
+	if status < 200 || status == 206 || (status >= 300 && status <= 399) {
+		return false
+	}
+	return successful(status) || options.Status.Contains(status)
+}
+
+// successful reports whether status is a 2xx status code.
+func successful(status int) bool {
+	return status >= 200 && status <= 299
+}
+
+// fallbackBodyFor returns the response body to empty result sets, i.e. the
+// empty value of the input's JSON type, or null for primitive inputs.
+func fallbackBodyFor(input interface{}) []byte {
+	switch input.(type) {
+	case []interface{}:
+		return []byte("[]")
+	case map[string]interface{}:
+		return []byte("{}")
+	}
+	return []byte("null")
+}
+
+// parse decodes the upstream body, or copies the parsed body of a cached
+// response. The key order of objects, if known, is recorded on the request, to
+// be preserved on encoding. If query results are cached, a hash of the media
+// type and body is recorded too.
+func (t *Transformer) parse(mediaType string, decoder Decoder, body io.Reader, r *http.Response) (interface{}, error) {
+	var input interface{}
+	var order *json.KeyOrder
+	var hash string
+	var err error
+	if cached, ok := r.Body.(*cachedBody); ok {
+		input, order, err = cached.response.parse(decoder)
+		hash = cached.response.hash
+	} else if optionsFromContext(r.Request.Context()).Cache {
+		hasher := sha256.New()
+		input, order, err = decoder.Parse(io.TeeReader(body, hasher))
+		hash = hex.EncodeToString(hasher.Sum(nil))
+	} else {
+		input, order, err = decoder.Parse(body)
+	}
 	if err != nil {
-		return ErrInvalidResponseBody
+		return nil, err
+	}
+	ctx := r.Request.Context()
+	if order != nil {
+		ctx = context.WithValue(ctx, keyOrderContextKey, order)
+	}
+	if hash != "" {
+		ctx = context.WithValue(ctx, inputHashContextKey, mediaType+" "+hash)
 	}
+	r.Request = r.Request.WithContext(ctx)
+	return input, nil
+}
 
-	results, err := t.evaluator.Evaluate(rawQuery.(string), input)
+// recordKeyOrder records the key order of objects decoded by inputs on the
+// request, if inputs keep track of it.
+func recordKeyOrder(inputs json.Stream, r *http.Response) {
+	if ordered, ok := inputs.(interface{ KeyOrder() *json.KeyOrder }); ok {
+		ctx := context.WithValue(r.Request.Context(), keyOrderContextKey, ordered.KeyOrder())
+		r.Request = r.Request.WithContext(ctx)
+	}
+}
+
+// stream writes lazily evaluated results. Failures up to the first result are
+// returned, so that they are answered with an error status. Once the first
+// result is produced, the response is committed and results are streamed. In
+// the auto results mode, the second result is awaited first, so that a single
+// result is written as is, like collected results. Without a streamer, the
+// remaining results are collected and written at once.
+func (t *Transformer) stream(evaluation *evaluation, fallbackBody []byte, r *http.Response) error {
+	first, err := evaluation.Next()
+	if err == io.EOF {
+		return t.rewriter(nil, fallbackBody, r)
+	}
 	if err != nil {
 		return err
 	}
+	results := []interface{}{first}
+
+	options := optionsFromContext(r.Request.Context())
+	if options.Results == ResultsFirst {
+		evaluation.Close()
+		return t.rewriter(results, fallbackBody, r)
+	}
+	if options.Results == ResultsAuto && options.Output != OutputRaw {
+		second, err := evaluation.Next()
+		if err == io.EOF {
+			return t.rewriter(results, fallbackBody, r)
+		}
+		if err != nil {
+			return err
+		}
+		results = append(results, second)
+	}
+	if t.streamer == nil {
+		defer evaluation.Close()
+		rest, err := jq.Collect(evaluation)
+		if err != nil {
+			return err
+		}
+		return t.rewriter(append(results, rest...), fallbackBody, r)
+	}
+	return t.streamer(results, evaluation, r)
+}
 
-	if reflect.TypeOf(input).Kind() == reflect.Slice {
-		return t.rewriter(results, []byte("[]"), r)
+// evaluation iterates the results of an evaluation, which is canceled once
+// all results were produced, or once it is closed before, so that abandoned
+// evaluations release their resources.
+type evaluation struct {
+	iterator jq.Iterator
+	cancel   context.CancelFunc
+}
+
+func (e *evaluation) Next() (interface{}, error) {
+	result, err := e.iterator.Next()
+	if err != nil {
+		e.cancel()
 	}
-	return t.rewriter(results, []byte("{}"), r)
+	return result, err
+}
+
+// Close cancels the evaluation.
+func (e *evaluation) Close() {
+	e.cancel()
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"github.com/bauerd/jqrp/jq"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"reflect"
@@ -267,3 +268,80 @@ func TestTransformerTimeout(t *testing.T) {
 		t.Errorf("Rewriter called")
 	}
 }
+
+// countingStreamer yields count results lazily, or endlessly if count is
+// negative, and keeps the context of the last evaluation.
+type countingStreamer struct {
+	count int
+	ctx   context.Context
+}
+
+func (s *countingStreamer) Evaluate(rawQuery string, input interface{}) ([]interface{}, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *countingStreamer) Stream(ctx context.Context, _ string, _ interface{}) (jq.Iterator, error) {
+	s.ctx = ctx
+	return &countingIterator{remaining: s.count}, nil
+}
+
+type countingIterator struct {
+	remaining int
+}
+
+func (i *countingIterator) Next() (interface{}, error) {
+	if i.remaining == 0 {
+		return nil, io.EOF
+	}
+	i.remaining--
+	return map[string]interface{}{}, nil
+}
+
+func streamedResponse(options Options) *http.Response {
+	res := http.Response{StatusCode: 200, Header: http.Header{}}
+	res.Header.Set("Content-Type", "application/json")
+	res.Body = ioutil.NopCloser(bytes.NewBufferString(`{}`))
+	ctx := context.WithValue(context.Background(), RawQueryContextKey, ".")
+	ctx = context.WithValue(ctx, OptionsContextKey, options)
+	res.Request = (&http.Request{}).WithContext(ctx)
+	return &res
+}
+
+func TestTransformerStreamSingleResult(t *testing.T) {
+	evaluator := &countingStreamer{count: 1}
+	rewriter := mockRewriter{}
+	transformer := NewTransformer(evaluator, rewriter.Rewrite)
+	if err := transformer.ModifyResponse(streamedResponse(Options{Stream: true})); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if results, ok := rewriter.Result.([]interface{}); !ok || len(results) != 1 {
+		t.Errorf("Single streamed result not written as is: %v", rewriter.Result)
+	}
+}
+
+func TestTransformerStreamWithoutStreamer(t *testing.T) {
+	evaluator := &countingStreamer{count: 3}
+	rewriter := mockRewriter{}
+	transformer := NewTransformer(evaluator, rewriter.Rewrite)
+	if err := transformer.ModifyResponse(streamedResponse(Options{Stream: true})); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if results, ok := rewriter.Result.([]interface{}); !ok || len(results) != 3 {
+		t.Errorf("Results not collected without streamer: %v", rewriter.Result)
+	}
+}
+
+func TestTransformerStreamFirstResult(t *testing.T) {
+	evaluator := &countingStreamer{count: -1}
+	rewriter := mockRewriter{}
+	transformer := NewTransformer(evaluator, rewriter.Rewrite)
+	if err := transformer.ModifyResponse(streamedResponse(Options{Stream: true, Results: ResultsFirst})); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if results, ok := rewriter.Result.([]interface{}); !ok || len(results) != 1 {
+		t.Errorf("Unexpected results %v", rewriter.Result)
+	}
+	if evaluator.ctx.Err() != context.Canceled {
+		t.Errorf("Evaluation not canceled after the first result")
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/bauerd/jqrp/jq"
+	"net/http"
+	"strconv"
+)
+
+// userErrorStatus returns the status code a query-raised error responds with.
+// Only errors raised with an object whose status field is an allowed status
+// code have one.
+func userErrorStatus(e *jq.UserError, allowed StatusSet) (int, bool) {
+	object, ok := e.Value.(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	var status int64
+	switch value := object["status"].(type) {
+	case json.Number:
+		i, err := value.Int64()
+		if err != nil {
+			return 0, false
+		}
+		status = i
+	case float64:
+		if value != float64(int64(value)) {
+			return 0, false
+		}
+		status = int64(value)
+	default:
+		return 0, false
+	}
+	if status < 400 || status > 599 || !allowed.Contains(int(status)) {
+		return 0, false
+	}
+	return int(status), true
+}
+
+// writeUserError responds with status code status and the raised error object
+// as body.
+func writeUserError(w http.ResponseWriter, status int, e *jq.UserError) {
+	body, err := json.Marshal(e.Value)
+	if err != nil {
+		writeProblem(w, 400, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}